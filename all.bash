@@ -3,7 +3,7 @@
 # Script to exercise everything.
 set -eux
 
-for x in fs mtp
+for x in fs mtp iofs
 do
     go build github.com/hanwen/go-mtpfs/$x
     go test -i github.com/hanwen/go-mtpfs/$x
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hanwen/go-mtpfs/mtp"
+)
+
+// Tar and zip archives of device trees, for export and restore.
+
+// manifestName is the archive member holding the manifest. Export
+// writes it first, so a restore can read it before the files.
+const manifestName = ".mtp-manifest.json"
+
+// archiveManifest records the device metadata of the archived
+// objects, which tar and zip headers cannot hold.
+type archiveManifest struct {
+	Manufacturer string
+	Model        string
+	SerialNumber string
+	Created      time.Time
+	Objects      []manifestObject
+}
+
+// manifestObject describes an archive member. Path is the member
+// name, without the trailing slash of directories.
+type manifestObject struct {
+	Path       string
+	Size       int64
+	Info       mtp.ObjectInfo
+	Properties []manifestProp `json:",omitempty"`
+}
+
+// manifestProp is an object property. Value is in the syntax of
+// parsePropValue.
+type manifestProp struct {
+	Code     uint16
+	Name     string `json:",omitempty"`
+	DataType uint16
+	Value    string
+}
+
+// archiveWriter writes archive members in order. The writer returned
+// by file must receive exactly size bytes before the next call.
+type archiveWriter interface {
+	dir(name string, mtime time.Time) error
+	file(name string, size int64, mtime time.Time) (io.Writer, error)
+	Close() error
+}
+
+func newArchiveWriter(format string, w io.Writer) (archiveWriter, error) {
+	switch format {
+	case "tar":
+		return &tarWriter{tar.NewWriter(w)}, nil
+	case "zip":
+		return &zipWriter{zip.NewWriter(w)}, nil
+	}
+	return nil, usageError(fmt.Sprintf("unknown archive format %q", format))
+}
+
+type tarWriter struct {
+	w *tar.Writer
+}
+
+func (w *tarWriter) dir(name string, mtime time.Time) error {
+	return w.w.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     name + "/",
+		Mode:     0755,
+		ModTime:  mtime,
+	})
+}
+
+func (w *tarWriter) file(name string, size int64, mtime time.Time) (io.Writer, error) {
+	err := w.w.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0644,
+		ModTime:  mtime,
+	})
+	return w.w, err
+}
+
+func (w *tarWriter) Close() error {
+	return w.w.Close()
+}
+
+// zipWriter stores the data uncompressed: media files hardly
+// compress, and deflating would slow down the transfer.
+type zipWriter struct {
+	w *zip.Writer
+}
+
+func (w *zipWriter) dir(name string, mtime time.Time) error {
+	h := &zip.FileHeader{Name: name + "/", Method: zip.Store, Modified: mtime}
+	h.SetMode(os.ModeDir | 0755)
+	_, err := w.w.CreateHeader(h)
+	return err
+}
+
+func (w *zipWriter) file(name string, size int64, mtime time.Time) (io.Writer, error) {
+	h := &zip.FileHeader{Name: name, Method: zip.Store, Modified: mtime}
+	h.SetMode(0644)
+	return w.w.CreateHeader(h)
+}
+
+func (w *zipWriter) Close() error {
+	return w.w.Close()
+}
+
+// archiveEntry is a member read from an archive. Name has no
+// trailing slash.
+type archiveEntry struct {
+	name  string
+	dir   bool
+	size  int64
+	mtime time.Time
+}
+
+// archiveReader returns the members in archive order. Next returns
+// io.EOF after the last member; the reader it returns is valid until
+// the next call.
+type archiveReader interface {
+	next() (*archiveEntry, io.Reader, error)
+	Close() error
+}
+
+// openArchive opens a tar or zip file, telling them apart by their
+// contents. Name "-" reads a tar archive from stdin.
+func openArchive(name string) (archiveReader, error) {
+	if name == "-" {
+		return &tarReader{r: tar.NewReader(os.Stdin)}, nil
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(f, magic); err == nil && string(magic) == "PK\x03\x04" {
+		f.Close()
+		zr, err := zip.OpenReader(name)
+		if err != nil {
+			return nil, err
+		}
+		return &zipReader{r: zr}, nil
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &tarReader{tar.NewReader(f), f}, nil
+}
+
+type tarReader struct {
+	r *tar.Reader
+	c io.Closer
+}
+
+// next skips members other than files and directories.
+func (r *tarReader) next() (*archiveEntry, io.Reader, error) {
+	for {
+		h, err := r.r.Next()
+		if err != nil {
+			return nil, nil, err
+		}
+		e := &archiveEntry{
+			name:  strings.TrimSuffix(h.Name, "/"),
+			size:  h.Size,
+			mtime: h.ModTime,
+		}
+		switch h.Typeflag {
+		case tar.TypeDir:
+			e.dir = true
+			e.size = 0
+		case tar.TypeReg:
+		default:
+			continue
+		}
+		return e, r.r, nil
+	}
+}
+
+func (r *tarReader) Close() error {
+	if r.c == nil {
+		return nil
+	}
+	return r.c.Close()
+}
+
+type zipReader struct {
+	r    *zip.ReadCloser
+	i    int
+	open io.Closer
+}
+
+func (r *zipReader) next() (*archiveEntry, io.Reader, error) {
+	if r.open != nil {
+		r.open.Close()
+		r.open = nil
+	}
+	for r.i < len(r.r.File) {
+		f := r.r.File[r.i]
+		r.i++
+		mode := f.Mode()
+		if !mode.IsDir() && !mode.IsRegular() {
+			continue
+		}
+		e := &archiveEntry{
+			name:  strings.TrimSuffix(f.Name, "/"),
+			dir:   mode.IsDir(),
+			mtime: f.Modified,
+		}
+		if e.dir {
+			return e, strings.NewReader(""), nil
+		}
+		e.size = int64(f.UncompressedSize64)
+		rc, err := f.Open()
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", f.Name, err)
+		}
+		r.open = rc
+		return e, rc, nil
+	}
+	return nil, nil, io.EOF
+}
+
+func (r *zipReader) Close() error {
+	if r.open != nil {
+		r.open.Close()
+	}
+	return r.r.Close()
+}
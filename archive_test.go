@@ -0,0 +1,172 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-mtpfs/mtp"
+)
+
+type archiveMember struct {
+	name    string
+	dir     bool
+	content string
+	mtime   time.Time
+}
+
+var testMembers = []archiveMember{
+	{name: "DCIM", dir: true, mtime: time.Date(2020, 1, 2, 3, 4, 6, 0, time.UTC)},
+	{name: "DCIM/IMG_0001.JPG", content: "jpeg data", mtime: time.Date(2020, 1, 2, 3, 4, 8, 0, time.UTC)},
+	{name: "DCIM/empty", content: "", mtime: time.Date(2021, 5, 6, 7, 8, 10, 0, time.UTC)},
+}
+
+func writeTestArchive(t *testing.T, format string) []byte {
+	var buf bytes.Buffer
+	aw, err := newArchiveWriter(format, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range testMembers {
+		if m.dir {
+			if err := aw.dir(m.name, m.mtime); err != nil {
+				t.Fatalf("dir %s: %v", m.name, err)
+			}
+			continue
+		}
+		w, err := aw.file(m.name, int64(len(m.content)), m.mtime)
+		if err != nil {
+			t.Fatalf("file %s: %v", m.name, err)
+		}
+		io.WriteString(w, m.content)
+	}
+	if err := aw.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func checkMember(t *testing.T, want archiveMember, name string, dir bool, mtime time.Time, content []byte) {
+	wantName := want.name
+	if want.dir {
+		wantName += "/"
+	}
+	if name != wantName || dir != want.dir || !mtime.Equal(want.mtime) || string(content) != want.content {
+		t.Errorf("got %q dir %v %v %q, want %+v", name, dir, mtime, content, want)
+	}
+}
+
+func TestTarWriter(t *testing.T) {
+	tr := tar.NewReader(bytes.NewReader(writeTestArchive(t, "tar")))
+	for _, want := range testMembers {
+		h, err := tr.Next()
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		content, _ := ioutil.ReadAll(tr)
+		checkMember(t, want, h.Name, h.Typeflag == tar.TypeDir, h.ModTime, content)
+	}
+	if _, err := tr.Next(); err != io.EOF {
+		t.Errorf("trailing members: %v", err)
+	}
+}
+
+func TestZipWriter(t *testing.T) {
+	data := writeTestArchive(t, "zip")
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zr.File) != len(testMembers) {
+		t.Fatalf("got %d members", len(zr.File))
+	}
+	for i, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := ioutil.ReadAll(rc)
+		rc.Close()
+		checkMember(t, testMembers[i], f.Name, f.FileInfo().IsDir(), f.Modified.UTC(), content)
+	}
+}
+
+func TestArchiveFormat(t *testing.T) {
+	if _, err := newArchiveWriter("cpio", ioutil.Discard); err == nil {
+		t.Error("unknown format accepted")
+	}
+}
+
+func TestPropString(t *testing.T) {
+	for _, c := range []struct {
+		t    mtp.DataTypeSelector
+		v    interface{}
+		want string
+	}{
+		{mtp.DTC_STR, "Artist", "Artist"},
+		{mtp.DTC_UINT16, uint16(80), "80"},
+		{mtp.DTC_INT32, int32(-1), "-1"},
+		{mtp.DTC_UINT128, [16]byte{1, 2}, "0x01020000000000000000000000000000"},
+	} {
+		got, ok := propString(c.t, c.v)
+		if !ok || got != c.want {
+			t.Errorf("propString(%v) = %q, %v, want %q", c.v, got, ok, c.want)
+		}
+		if v, err := parsePropValue(got, c.t); err != nil || v != c.v {
+			t.Errorf("parsePropValue(%q) = %v, %v", got, v, err)
+		}
+	}
+	if _, ok := propString(mtp.DTC_UINT16|mtp.DTC_ARRAY_MASK, []uint16{1}); ok {
+		t.Error("array value accepted")
+	}
+}
+
+func TestArchiveReader(t *testing.T) {
+	for _, format := range []string{"tar", "zip"} {
+		name := filepath.Join(t.TempDir(), "test."+format)
+		if err := ioutil.WriteFile(name, writeTestArchive(t, format), 0644); err != nil {
+			t.Fatal(err)
+		}
+		ar, err := openArchive(name)
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		for _, want := range testMembers {
+			e, src, err := ar.next()
+			if err != nil {
+				t.Fatalf("%s: next: %v", format, err)
+			}
+			content, err := ioutil.ReadAll(src)
+			if err != nil {
+				t.Fatalf("%s: read %s: %v", format, e.name, err)
+			}
+			if e.size != int64(len(content)) {
+				t.Errorf("%s: %s: size %d, read %d bytes", format, e.name, e.size, len(content))
+			}
+			if want.dir {
+				e.name += "/"
+			}
+			checkMember(t, want, e.name, e.dir, e.mtime.UTC(), content)
+		}
+		if _, _, err := ar.next(); err != io.EOF {
+			t.Errorf("%s: trailing members: %v", format, err)
+		}
+		ar.Close()
+	}
+}
+
+func TestCleanArchivePath(t *testing.T) {
+	if got, err := cleanArchivePath("./DCIM//a.jpg"); got != "DCIM/a.jpg" || err != nil {
+		t.Errorf("got %q, %v", got, err)
+	}
+	for _, bad := range []string{"../a.jpg", "DCIM/../../a.jpg", "/", ""} {
+		if _, err := cleanArchivePath(bad); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,534 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/hanwen/go-mtpfs/mtp"
+)
+
+// Commands for scripting access to a device without FUSE.
+
+type command struct {
+	args string
+	help string
+	run  func(c *deviceConfig, args []string) error
+}
+
+var commands = map[string]*command{
+	"devices": {"", "list MTP devices", cmdDevices},
+	"storages": {"", "list storages of the device", func(c *deviceConfig, args []string) error {
+		return withRemote(c, args, 0, 0, cmdStorages)
+	}},
+	"ls": {"[-l] [PATH]", "list a directory", cmdLs},
+	"stat": {"PATH...", "show object information", func(c *deviceConfig, args []string) error {
+		return withRemote(c, args, 1, -1, cmdStat)
+	}},
+	"get":   {"[-r] [-q] PATH [LOCAL]", "copy from the device; LOCAL - is stdout", cmdGet},
+	"put":   {"[-r] [-q] LOCAL PATH", "copy to the device", cmdPut},
+	"rm":    {"[-r] PATH...", "remove files or directories", cmdRm},
+	"mkdir": {"[-p] PATH...", "create directories", cmdMkdir},
+	"mv": {"SRC DST", "rename or move", func(c *deviceConfig, args []string) error {
+		return withRemote(c, args, 2, 2, cmdMv)
+	}},
+	"export": {"[-format tar|zip] [-manifest=false] [-q] PATH",
+		"write PATH and everything below it as an archive to stdout", cmdExport},
+	"import-archive": {"[-q] ARCHIVE PATH",
+		"restore an archive from export into a device folder; ARCHIVE - is a tar on stdin", cmdImportArchive},
+	"info": {"[-json]", "describe the device, its storages and properties", cmdInfo},
+	"prop": {"[list | get PROP... | set PROP VALUE | reset PROP...]",
+		"read or write device properties, by DPC name or hex code", cmdProp},
+	"serve-webdav": {"[-addr HOST:PORT]",
+		"serve the storages over WebDAV, for systems without FUSE", cmdServeWebdav},
+	"serve-sftp": {"[-addr HOST:PORT] [-user NAME] [-authorized-keys FILE] [-host-key FILE]",
+		"serve the storages over SFTP, for remote access", cmdServeSFTP},
+	"verify": {"[-all] [-update] [-q] [PATH]",
+		"check files against the hashes recorded by mounts with -verify", cmdVerify},
+	"daemon": {"[-interval DURATION] [-retry DURATION] BASE-DIR",
+		"mount devices under BASE-DIR as they are plugged in", cmdDaemon},
+	"import": {"[-n] [-delete] [-template YYYY/MM/DD] DEST-DIR",
+		"copy new photos from the DCIM folders, sorted by capture date", cmdImport},
+	"sync": {"[-n] [-delete] [-include PAT] [-exclude PAT] LOCAL-DIR PATH",
+		"push changes from a local directory to a device folder", cmdSync},
+}
+
+// usageError indicates wrong arguments to a command.
+type usageError string
+
+func (e usageError) Error() string {
+	return string(e)
+}
+
+// Exit codes for the commands.
+const (
+	exitOK       = 0
+	exitFailure  = 1
+	exitUsage    = 2
+	exitNotFound = 3
+)
+
+func runCommand(c *deviceConfig, cmd *command, args []string) int {
+	name := ""
+	for n, c := range commands {
+		if c == cmd {
+			name = n
+		}
+	}
+
+	err := cmd.run(c, args)
+	switch err.(type) {
+	case nil:
+		return exitOK
+	case usageError:
+		fmt.Fprintf(os.Stderr, "%s: %v\nUsage: %s %s %s\n", name, err, os.Args[0], name, cmd.args)
+		return exitUsage
+	case notFoundError:
+		fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+		return exitNotFound
+	default:
+		fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+		return exitFailure
+	}
+}
+
+// parseFlags parses command flags, and checks the number of
+// remaining arguments. Max < 0 means no limit.
+func parseFlags(fl *flag.FlagSet, args []string, min, max int) ([]string, error) {
+	fl.SetOutput(ioutil.Discard)
+	if err := fl.Parse(args); err != nil {
+		return nil, usageError(err.Error())
+	}
+	rest := fl.Args()
+	if len(rest) < min || (max >= 0 && len(rest) > max) {
+		return nil, usageError("wrong number of arguments")
+	}
+	return rest, nil
+}
+
+// withRemote opens the device, and runs fn with the arguments.
+func withRemote(c *deviceConfig, args []string, min, max int, fn func(r *remote, args []string) error) error {
+	args, err := parseFlags(flag.NewFlagSet("", flag.ContinueOnError), args, min, max)
+	if err != nil {
+		return err
+	}
+	return c.withRemote(func(r *remote) error { return fn(r, args) })
+}
+
+func (c *deviceConfig) withRemote(fn func(r *remote) error) error {
+	dev, err := c.open()
+	if err != nil {
+		return err
+	}
+	defer dev.Close()
+
+	r, err := newRemote(dev, c.storageFilter)
+	if err != nil {
+		return err
+	}
+	return fn(r)
+}
+
+func cmdDevices(c *deviceConfig, args []string) error {
+	if _, err := parseFlags(flag.NewFlagSet("", flag.ContinueOnError), args, 0, 0); err != nil {
+		return err
+	}
+	devs, err := mtp.SelectDevices(c.filter)
+	if err != nil {
+		return err
+	}
+	for _, dev := range devs {
+		id, err := dev.ID()
+		if err != nil {
+			id = fmt.Sprintf("(%v)", err)
+		}
+		c.setDebug(dev)
+		var info mtp.DeviceInfo
+		if err := dev.GetDeviceInfo(&info); err != nil {
+			fmt.Printf("%s\n", id)
+		} else {
+			fmt.Printf("%s\t%s %s\n", id, info.Manufacturer, info.Model)
+		}
+		dev.Close()
+		dev.Done()
+	}
+	return nil
+}
+
+func cmdStorages(r *remote, args []string) error {
+	for _, s := range r.storages {
+		var info mtp.StorageInfo
+		if err := r.dev.GetStorageInfo(s.StorageID, &info); err != nil {
+			return err
+		}
+		fmt.Printf("0x%08x\t%d\t%d\t%s\n", s.StorageID, info.MaxCapability, info.FreeSpaceInBytes, s.Path)
+	}
+	return nil
+}
+
+func printEntry(o *remoteObject, long bool) {
+	name := path.Base(o.Path)
+	if !long {
+		fmt.Println(name)
+		return
+	}
+	kind := "-"
+	if o.IsDir() {
+		kind = "d"
+	}
+	fmt.Printf("%s %12d %s %s\n", kind, o.Size,
+		o.Info.ModificationDate.Format("2006-01-02 15:04"), name)
+}
+
+func cmdLs(c *deviceConfig, args []string) error {
+	fl := flag.NewFlagSet("ls", flag.ContinueOnError)
+	long := fl.Bool("l", false, "long listing")
+	args, err := parseFlags(fl, args, 0, 1)
+	if err != nil {
+		return err
+	}
+	p := ""
+	if len(args) > 0 {
+		p = args[0]
+	}
+	return c.withRemote(func(r *remote) error {
+		o, err := r.lookup(p)
+		if err != nil {
+			return err
+		}
+		if !o.IsDir() {
+			printEntry(o, *long)
+			return nil
+		}
+		chs, err := r.children(o)
+		if err != nil {
+			return err
+		}
+		for _, ch := range chs {
+			printEntry(ch, *long)
+		}
+		return nil
+	})
+}
+
+func cmdStat(r *remote, args []string) error {
+	for _, p := range args {
+		o, err := r.lookup(p)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Path: %s\n", o.Path)
+		if o.StorageID == 0 {
+			continue
+		}
+		fmt.Printf("Handle: 0x%x\n", o.Handle)
+		fmt.Printf("Storage: 0x%x\n", o.StorageID)
+		if o.IsStorage() {
+			continue
+		}
+		fmt.Printf("Format: %s\n", formatName(o.Info.ObjectFormat))
+		fmt.Printf("Size: %d\n", o.Size)
+		fmt.Printf("Modified: %s\n", o.Info.ModificationDate.Format("2006-01-02 15:04:05"))
+		if !o.Info.CaptureDate.IsZero() {
+			fmt.Printf("Captured: %s\n", o.Info.CaptureDate.Format("2006-01-02 15:04:05"))
+		}
+		fmt.Printf("Parent: 0x%x\n", o.Info.ParentObject)
+		fmt.Printf("Protection: 0x%x\n", o.Info.ProtectionStatus)
+	}
+	return nil
+}
+
+func formatName(code uint16) string {
+	if n, ok := mtp.OFC_names[int(code)]; ok {
+		return n
+	}
+	return fmt.Sprintf("0x%x", code)
+}
+
+func cmdGet(c *deviceConfig, args []string) error {
+	fl := flag.NewFlagSet("get", flag.ContinueOnError)
+	recursive := fl.Bool("r", false, "copy directories recursively")
+	quiet := fl.Bool("q", false, "do not report progress")
+	args, err := parseFlags(fl, args, 1, 2)
+	if err != nil {
+		return err
+	}
+
+	return c.withRemote(func(r *remote) error {
+		o, err := r.lookup(args[0])
+		if err != nil {
+			return err
+		}
+		local := path.Base(o.Path)
+		if len(args) > 1 {
+			local = args[1]
+			if fi, err := os.Stat(local); err == nil && fi.IsDir() {
+				local = filepath.Join(local, path.Base(o.Path))
+			}
+		}
+		if o.IsDir() {
+			if !*recursive {
+				return fmt.Errorf("%s: is a directory", o.Path)
+			}
+			return getDir(r, o, local, *quiet)
+		}
+		return getFile(r, o, local, *quiet)
+	})
+}
+
+func getFile(r *remote, o *remoteObject, local string, quiet bool) error {
+	var w io.Writer
+	if local == "-" {
+		w = os.Stdout
+		quiet = true
+	} else {
+		f, err := os.Create(local)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	p := newProgress(o.Path, o.Size, quiet)
+	err := r.dev.GetObject(o.Handle, &progressWriter{w, p})
+	if err != nil {
+		if local != "-" {
+			os.Remove(local)
+		}
+		return fmt.Errorf("GetObject %s: %v", o.Path, err)
+	}
+	p.finish()
+	if local != "-" {
+		os.Chtimes(local, o.Info.ModificationDate, o.Info.ModificationDate)
+	}
+	return nil
+}
+
+func getDir(r *remote, o *remoteObject, local string, quiet bool) error {
+	if err := os.MkdirAll(local, 0755); err != nil {
+		return err
+	}
+	chs, err := r.children(o)
+	if err != nil {
+		return err
+	}
+	for _, ch := range chs {
+		dest := filepath.Join(local, path.Base(ch.Path))
+		if ch.IsDir() {
+			err = getDir(r, ch, dest, quiet)
+		} else {
+			err = getFile(r, ch, dest, quiet)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func cmdPut(c *deviceConfig, args []string) error {
+	fl := flag.NewFlagSet("put", flag.ContinueOnError)
+	recursive := fl.Bool("r", false, "copy directories recursively")
+	quiet := fl.Bool("q", false, "do not report progress")
+	args, err := parseFlags(fl, args, 2, 2)
+	if err != nil {
+		return err
+	}
+	local, remotePath := args[0], args[1]
+	fi, err := os.Stat(local)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() && !*recursive {
+		return fmt.Errorf("%s: is a directory", local)
+	}
+
+	return c.withRemote(func(r *remote) error {
+		dir, name, err := r.lookupDest(remotePath, filepath.Base(local))
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return putDir(r, local, dir, name, *quiet)
+		}
+		return putFile(r, local, fi, dir, name, *quiet)
+	})
+}
+
+// lookupDest resolves the destination of a copy: an existing
+// directory receives the file under its own name.
+func (r *remote) lookupDest(p string, name string) (*remoteObject, string, error) {
+	if o, err := r.lookup(p); err == nil && o.IsDir() {
+		return o, name, nil
+	} else if _, ok := err.(notFoundError); err != nil && !ok {
+		return nil, "", err
+	}
+	return r.lookupParent(p)
+}
+
+func putFile(r *remote, local string, fi os.FileInfo, dir *remoteObject, name string, quiet bool) error {
+	f, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	p := newProgress(path.Join(dir.Path, name), fi.Size(), quiet)
+	if _, err := r.send(dir, name, &progressReader{f, p}, fi.Size(), fi.ModTime()); err != nil {
+		return err
+	}
+	p.finish()
+	return nil
+}
+
+func putDir(r *remote, local string, dir *remoteObject, name string, quiet bool) error {
+	sub, err := r.child(dir, name)
+	if _, ok := err.(notFoundError); ok {
+		sub, err = r.mkdir(dir, name)
+	}
+	if err != nil {
+		return err
+	}
+	if !sub.IsDir() {
+		return fmt.Errorf("%s: not a directory", sub.Path)
+	}
+
+	entries, err := ioutil.ReadDir(local)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		src := filepath.Join(local, e.Name())
+		if e.IsDir() {
+			err = putDir(r, src, sub, e.Name(), quiet)
+		} else if e.Mode().IsRegular() {
+			err = putFile(r, src, e, sub, e.Name(), quiet)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func cmdRm(c *deviceConfig, args []string) error {
+	fl := flag.NewFlagSet("rm", flag.ContinueOnError)
+	recursive := fl.Bool("r", false, "remove directories and their contents")
+	args, err := parseFlags(fl, args, 1, -1)
+	if err != nil {
+		return err
+	}
+	return c.withRemote(func(r *remote) error {
+		for _, p := range args {
+			o, err := r.lookup(p)
+			if err != nil {
+				return err
+			}
+			if o.StorageID == 0 || o.IsStorage() {
+				return fmt.Errorf("%s: cannot remove storage", o.Path)
+			}
+			if o.IsDir() && !*recursive {
+				chs, err := r.children(o)
+				if err != nil {
+					return err
+				}
+				if len(chs) > 0 {
+					return fmt.Errorf("%s: directory not empty", o.Path)
+				}
+			}
+			// Deleting a folder deletes its contents.
+			if err := r.deleteObject(o.Handle, o.Path); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func cmdMkdir(c *deviceConfig, args []string) error {
+	fl := flag.NewFlagSet("mkdir", flag.ContinueOnError)
+	parents := fl.Bool("p", false, "create parent directories, and accept existing directories")
+	args, err := parseFlags(fl, args, 1, -1)
+	if err != nil {
+		return err
+	}
+	return c.withRemote(func(r *remote) error {
+		for _, p := range args {
+			if *parents {
+				if _, err := r.mkdirAll(p); err != nil {
+					return err
+				}
+				continue
+			}
+			dir, name, err := r.lookupParent(p)
+			if err != nil {
+				return err
+			}
+			if _, err := r.child(dir, name); err == nil {
+				return fmt.Errorf("%s: file exists", path.Join(dir.Path, name))
+			}
+			if _, err := r.mkdir(dir, name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// mkdirAll returns the folder at p, creating missing folders.
+func (r *remote) mkdirAll(p string) (*remoteObject, error) {
+	o := &r.root
+	for _, c := range splitPath(p) {
+		ch, err := r.child(o, c)
+		if _, ok := err.(notFoundError); ok {
+			ch, err = r.mkdir(o, c)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !ch.IsDir() {
+			return nil, fmt.Errorf("%s: not a directory", ch.Path)
+		}
+		o = ch
+	}
+	return o, nil
+}
+
+func cmdMv(r *remote, args []string) error {
+	src, err := r.lookup(args[0])
+	if err != nil {
+		return err
+	}
+	if src.StorageID == 0 || src.IsStorage() {
+		return fmt.Errorf("%s: cannot move storage", src.Path)
+	}
+	dir, name, err := r.lookupDest(args[1], path.Base(src.Path))
+	if err != nil {
+		return err
+	}
+	if dir.StorageID == 0 {
+		return fmt.Errorf("cannot move outside a storage")
+	}
+	if _, err := r.child(dir, name); err == nil {
+		return fmt.Errorf("%s: file exists", path.Join(dir.Path, name))
+	}
+
+	r.forget()
+	if dir.Handle != parentHandle(src.Info.ParentObject) || dir.StorageID != src.StorageID {
+		if err := r.dev.MoveObject(src.Handle, dir.StorageID, dir.Handle); err != nil {
+			return fmt.Errorf("MoveObject %s: %v", src.Path, err)
+		}
+	}
+	if name != src.Info.Filename {
+		v := mtp.StringValue{Value: name}
+		if err := r.dev.SetObjectPropValue(src.Handle, mtp.OPC_ObjectFileName, &v); err != nil {
+			return fmt.Errorf("rename %s: %v", src.Path, err)
+		}
+	}
+	return nil
+}
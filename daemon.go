@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-mtpfs/fs"
+	"github.com/hanwen/go-mtpfs/mtp"
+)
+
+// The daemon mounts devices under a base directory as they are
+// attached, and unmounts them when they go away.
+
+type daemonMount struct {
+	name   string
+	dir    string
+	dev    *mtp.Device
+	root   interface{ OnUnmount() }
+	server *fuse.Server
+	// done is closed when the server stops, eg. after fusermount -u.
+	done chan struct{}
+}
+
+type daemon struct {
+	config *deviceConfig
+	base   string
+	retry  time.Duration
+
+	// mounts holds the mounted devices by location.
+	mounts map[string]*daemonMount
+	// retryAt holds when to try again devices that could not be
+	// mounted, eg. because they were locked.
+	retryAt map[string]time.Time
+}
+
+// never is the retry time for devices that were unmounted by hand:
+// they are mounted again only after they are plugged in again.
+var never = time.Unix(1<<62, 0)
+
+func (d *daemon) scan() {
+	now := time.Now()
+	skip := map[string]bool{}
+	for loc := range d.mounts {
+		skip[loc] = true
+	}
+	for loc, t := range d.retryAt {
+		if now.Before(t) {
+			skip[loc] = true
+		}
+	}
+
+	present, devs, err := mtp.ScanDevices(d.config.filter, skip)
+	if err != nil {
+		log.Printf("scanning devices: %v", err)
+		return
+	}
+
+	for loc, m := range d.mounts {
+		select {
+		case <-m.done:
+			log.Printf("%s was unmounted", m.dir)
+			d.release(m)
+			delete(d.mounts, loc)
+			if present[loc] {
+				d.retryAt[loc] = never
+			}
+			continue
+		default:
+		}
+		if !present[loc] {
+			d.unmount(loc, m)
+		}
+	}
+	for loc := range d.retryAt {
+		if !present[loc] {
+			delete(d.retryAt, loc)
+		}
+	}
+
+	for _, dev := range devs {
+		loc := dev.Location()
+		m, err := d.mount(dev)
+		if err != nil {
+			log.Printf("device at %s: %v; retrying in %v", loc, err, d.retry)
+			dev.Close()
+			dev.Done()
+			d.retryAt[loc] = now.Add(d.retry)
+			continue
+		}
+		delete(d.retryAt, loc)
+		d.mounts[loc] = m
+		log.Printf("mounted %q on %s", m.name, m.dir)
+	}
+}
+
+func (d *daemon) mount(dev *mtp.Device) (*daemonMount, error) {
+	if err := d.config.configure(dev); err != nil {
+		return nil, err
+	}
+	var info mtp.DeviceInfo
+	if err := dev.GetDeviceInfo(&info); err != nil {
+		return nil, err
+	}
+	sids, err := fs.SelectStorages(dev, d.config.storageFilter)
+	if err != nil {
+		return nil, err
+	}
+	if len(sids) == 0 {
+		// Android hides the storages until the phone is unlocked.
+		return nil, fmt.Errorf("no storages; is the device locked?")
+	}
+	root, err := fs.NewDeviceFSRoot(dev, sids, d.config.fsOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	name := fs.DeviceName(&info)
+	for i := 2; d.inUse(name); i++ {
+		name = fmt.Sprintf("%s (%d)", fs.DeviceName(&info), i)
+	}
+	dir := filepath.Join(d.base, name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	server, err := fusefs.Mount(dir, root, d.config.mountOptions())
+	if err != nil {
+		root.OnUnmount()
+		os.Remove(dir)
+		return nil, fmt.Errorf("mount failed: %v", err)
+	}
+
+	m := &daemonMount{
+		name:   name,
+		dir:    dir,
+		dev:    dev,
+		root:   root,
+		server: server,
+		done:   make(chan struct{}),
+	}
+	go func() {
+		server.Wait()
+		close(m.done)
+	}()
+	return m, nil
+}
+
+func (d *daemon) inUse(name string) bool {
+	for _, m := range d.mounts {
+		if m.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// unmount unmounts a device that went away. If the mount is busy, it
+// is tried again on the next scan. Pending operations fail by
+// themselves, as USB transfers to a detached device fail at once; the
+// device is closed only after the server and the event reader stop.
+func (d *daemon) unmount(loc string, m *daemonMount) {
+	if err := m.server.Unmount(); err != nil {
+		log.Printf("unmount %s: %v; retrying", m.dir, err)
+		return
+	}
+	<-m.done
+	d.release(m)
+	delete(d.mounts, loc)
+	log.Printf("unmounted %q from %s", m.name, m.dir)
+}
+
+// release frees the resources of a stopped mount.
+func (d *daemon) release(m *daemonMount) {
+	m.root.OnUnmount()
+	m.dev.Close()
+	m.dev.Done()
+	os.Remove(m.dir)
+}
+
+func (d *daemon) unmountAll() {
+	for loc, m := range d.mounts {
+		d.unmount(loc, m)
+	}
+}
+
+// isUSBEvent returns whether a kernel uevent message announces a USB
+// device being added or removed. Messages are NUL separated
+// KEY=VALUE fields, after an "ACTION@DEVPATH" header.
+func isUSBEvent(msg []byte) bool {
+	usb, action := false, false
+	for _, f := range bytes.Split(msg, []byte{0}) {
+		switch string(f) {
+		case "SUBSYSTEM=usb":
+			usb = true
+		case "ACTION=add", "ACTION=remove", "ACTION=bind", "ACTION=unbind":
+			action = true
+		}
+	}
+	return usb && action
+}
+
+// Time for a device to settle after a uevent, before it is scanned.
+const settleTime = 500 * time.Millisecond
+
+func cmdDaemon(c *deviceConfig, args []string) error {
+	fl := flag.NewFlagSet("daemon", flag.ContinueOnError)
+	interval := fl.Duration("interval", 2*time.Second, "how often to look for devices, if uevents are not available")
+	retry := fl.Duration("retry", 5*time.Second, "how long to wait before retrying a device that could not be mounted")
+	args, err := parseFlags(fl, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(args[0], 0755); err != nil {
+		return err
+	}
+
+	d := &daemon{
+		config:  c,
+		base:    args[0],
+		retry:   *retry,
+		mounts:  map[string]*daemonMount{},
+		retryAt: map[string]time.Time{},
+	}
+
+	events, err := watchUevents()
+	if err != nil {
+		log.Printf("cannot watch uevents: %v; polling every %v", err, *interval)
+	} else {
+		// Still needed for retries, and mounts that go away.
+		*interval = *retry
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+
+	d.scan()
+	for {
+		select {
+		case _, ok := <-events:
+			if !ok {
+				log.Printf("uevents stopped; polling every %v", *interval)
+				events = nil
+				continue
+			}
+			time.Sleep(settleTime)
+			d.scan()
+		case <-ticker.C:
+			d.scan()
+		case sig := <-sigs:
+			log.Printf("got %v, unmounting", sig)
+			d.unmountAll()
+			if len(d.mounts) > 0 {
+				return fmt.Errorf("%d mounts are busy", len(d.mounts))
+			}
+			return nil
+		}
+	}
+}
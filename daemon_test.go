@@ -0,0 +1,19 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIsUSBEvent(t *testing.T) {
+	for msg, want := range map[string]bool{
+		"add@/devices/pci0000:00/usb1/1-2\x00ACTION=add\x00DEVPATH=/devices/pci0000:00/usb1/1-2\x00SUBSYSTEM=usb\x00DEVTYPE=usb_device\x00": true,
+		"remove@/devices/pci0000:00/usb1/1-2\x00ACTION=remove\x00SUBSYSTEM=usb\x00":                                                         true,
+		"change@/devices/pci0000:00/usb1/1-2\x00ACTION=change\x00SUBSYSTEM=usb\x00":                                                         false,
+		"add@/devices/virtual/net/tun0\x00ACTION=add\x00SUBSYSTEM=net\x00":                                                                  false,
+	} {
+		if got := isUSBEvent([]byte(msg)); got != want {
+			t.Errorf("isUSBEvent(%q): got %v, want %v", strings.Split(msg, "\x00")[0], got, want)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"time"
+
+	"github.com/hanwen/go-mtpfs/mtp"
+)
+
+// Export of a device tree as an archive on stdout. Objects are
+// copied from GetObject into the archive, without temporary files.
+
+// exportItem is an object to archive under name.
+type exportItem struct {
+	name string
+	obj  *remoteObject
+}
+
+// exportList appends o and everything below it to items. Names are
+// relative to the parent of the exported object.
+func exportList(r *remote, o *remoteObject, name string, items []exportItem) ([]exportItem, error) {
+	if name != "" {
+		items = append(items, exportItem{name, o})
+	}
+	if !o.IsDir() {
+		return items, nil
+	}
+	chs, err := r.children(o)
+	if err != nil {
+		return nil, err
+	}
+	for _, ch := range chs {
+		items, err = exportList(r, ch, path.Join(name, path.Base(ch.Path)), items)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return items, nil
+}
+
+// propString formats a property value for the manifest. Array
+// values are not supported.
+func propString(t mtp.DataTypeSelector, v interface{}) (string, bool) {
+	switch x := v.(type) {
+	case string:
+		return x, true
+	case [16]byte:
+		return string(jsonValue(x).(hexValue)), true
+	}
+	if _, ok := intTypes[t]; ok {
+		return fmt.Sprint(v), true
+	}
+	return "", false
+}
+
+// propReader reads object properties, with GetObjPropList if the
+// device has it, and one property at a time otherwise. Properties
+// that fail are left out, as devices announce more than they
+// implement.
+type propReader struct {
+	dev       *mtp.Device
+	list      bool
+	supported map[uint16][]uint16
+	// types is keyed by format<<16 | property code.
+	types map[uint32]mtp.DataTypeSelector
+}
+
+func newPropReader(dev *mtp.Device, info *mtp.DeviceInfo) *propReader {
+	return &propReader{
+		dev:       dev,
+		list:      info.HasOperation(mtp.OC_MTP_GetObjPropList),
+		supported: map[uint16][]uint16{},
+		types:     map[uint32]mtp.DataTypeSelector{},
+	}
+}
+
+func (p *propReader) read(o *remoteObject) []manifestProp {
+	var props []manifestProp
+	add := func(code uint16, t mtp.DataTypeSelector, v interface{}) {
+		if s, ok := propString(t, v); ok {
+			props = append(props, manifestProp{code, mtp.OPC_names[int(code)], uint16(t), s})
+		}
+	}
+
+	if p.list {
+		err := p.dev.WalkObjPropList(o.Handle, 0, 0xFFFFFFFF, 0, 0, func(v *mtp.ObjectPropValue) error {
+			add(v.PropertyCode, v.DataType, v.Value)
+			return nil
+		})
+		if err == nil {
+			return props
+		}
+		log.Printf("GetObjPropList %s: %v; reading properties one by one", o.Path, err)
+		p.list = false
+		props = nil
+	}
+
+	format := o.Info.ObjectFormat
+	codes, ok := p.supported[format]
+	if !ok {
+		var arr mtp.Uint16Array
+		if err := p.dev.GetObjectPropsSupported(format, &arr); err == nil {
+			codes = arr.Values
+		}
+		p.supported[format] = codes
+	}
+	for _, code := range codes {
+		key := uint32(format)<<16 | uint32(code)
+		t, ok := p.types[key]
+		if !ok {
+			var desc mtp.ObjectPropDesc
+			if err := p.dev.GetObjectPropDesc(code, format, &desc); err == nil {
+				t = desc.DataType
+			}
+			p.types[key] = t
+		}
+		if t == mtp.DTC_UNDEF {
+			continue
+		}
+		val := mtp.DataValue{DataType: t}
+		if err := p.dev.GetObjectPropValue(o.Handle, code, &val); err != nil {
+			continue
+		}
+		add(code, t, val.Value)
+	}
+	return props
+}
+
+func exportManifest(r *remote, items []exportItem) (*archiveManifest, error) {
+	var info mtp.DeviceInfo
+	if err := r.dev.GetDeviceInfo(&info); err != nil {
+		return nil, err
+	}
+	m := &archiveManifest{
+		Manufacturer: info.Manufacturer,
+		Model:        info.Model,
+		SerialNumber: info.SerialNumber,
+		Created:      time.Now(),
+	}
+	pr := newPropReader(r.dev, &info)
+	for _, it := range items {
+		mo := manifestObject{Path: it.name, Size: it.obj.Size, Info: it.obj.Info}
+		if !it.obj.IsStorage() {
+			mo.Properties = pr.read(it.obj)
+		}
+		m.Objects = append(m.Objects, mo)
+	}
+	return m, nil
+}
+
+func cmdExport(c *deviceConfig, args []string) error {
+	fl := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := fl.String("format", "tar", "archive format: tar or zip")
+	withManifest := fl.Bool("manifest", true, "include a manifest of object information and properties")
+	quiet := fl.Bool("q", false, "do not report progress")
+	args, err := parseFlags(fl, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	aw, err := newArchiveWriter(*format, os.Stdout)
+	if err != nil {
+		return err
+	}
+	if fi, err := os.Stdout.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+		return usageError("not writing an archive to a terminal")
+	}
+
+	return c.withRemote(func(r *remote) error {
+		o, err := r.lookup(args[0])
+		if err != nil {
+			return err
+		}
+		name := ""
+		if o.StorageID != 0 {
+			name = path.Base(o.Path)
+		}
+		items, err := exportList(r, o, name, nil)
+		if err != nil {
+			return err
+		}
+
+		if *withManifest {
+			m, err := exportManifest(r, items)
+			if err != nil {
+				return err
+			}
+			data, err := json.MarshalIndent(m, "", " ")
+			if err != nil {
+				return err
+			}
+			w, err := aw.file(manifestName, int64(len(data)), m.Created)
+			if err != nil {
+				return err
+			}
+			if _, err := w.Write(data); err != nil {
+				return err
+			}
+		}
+
+		for _, it := range items {
+			mtime := it.obj.Info.ModificationDate
+			if it.obj.IsDir() {
+				if err := aw.dir(it.name, mtime); err != nil {
+					return err
+				}
+				continue
+			}
+			w, err := aw.file(it.name, it.obj.Size, mtime)
+			if err != nil {
+				return err
+			}
+			p := newProgress(it.obj.Path, it.obj.Size, *quiet)
+			if err := r.dev.GetObject(it.obj.Handle, &progressWriter{w, p}); err != nil {
+				return fmt.Errorf("GetObject %s: %v", it.obj.Path, err)
+			}
+			p.finish()
+		}
+		return aw.Close()
+	})
+}
@@ -53,6 +53,7 @@ func (n *androidNode) endEdit() bool {
 		log.Println("AndroidEndEditObject failed:", err)
 		return false
 	}
+	n.fs.storageChanged(n.StorageID())
 	n.write = false
 	return true
 }
@@ -71,17 +72,17 @@ func (n *androidNode) Setattr(ctx context.Context, file fs.FileHandle, in *fuse.
 	if size, ok := in.GetSize(); ok {
 		w := n.write
 		if !n.startEdit() {
-			return syscall.EIO
+			return n.ioError()
 		}
 		if err := n.fs.dev.AndroidTruncate(n.Handle(), int64(size)); err != nil {
 			log.Println("AndroidTruncate failed:", err)
-			return syscall.EIO
+			return n.ioError()
 		}
 		n.Size = int64(size)
 
 		if !w {
 			if !n.endEdit() {
-				return syscall.EIO
+				return n.ioError()
 			}
 		}
 	}
@@ -110,7 +111,7 @@ func (f *androidFile) Read(ctx context.Context, dest []byte, off int64) (fuse.Re
 	err := f.node.fs.dev.AndroidGetPartialObject64(f.node.Handle(), b, off, uint32(len(dest)))
 	if err != nil {
 		log.Println("AndroidGetPartialObject64 failed:", err)
-		return nil, syscall.EIO
+		return nil, f.node.ioError()
 	}
 
 	return fuse.ReadResultData(dest[:b.Len()]), 0
@@ -124,14 +125,14 @@ var _ = (fs.FileWriter)((*androidFile)(nil))
 
 func (f *androidFile) Write(ctx context.Context, dest []byte, off int64) (written uint32, status syscall.Errno) {
 	if !f.node.startEdit() {
-		return 0, syscall.EIO
+		return 0, f.node.ioError()
 	}
 	f.node.byteCount += int64(len(dest))
 	b := bytes.NewBuffer(dest)
 	err := f.node.fs.dev.AndroidSendPartialObject(f.node.Handle(), off, uint32(len(dest)), b)
 	if err != nil {
 		log.Println("AndroidSendPartialObject failed:", err)
-		return 0, syscall.EIO
+		return 0, f.node.ioError()
 	}
 	written = uint32(len(dest) - b.Len())
 	if off+int64(written) > f.node.Size {
@@ -144,7 +145,7 @@ var _ = (fs.FileFlusher)((*androidFile)(nil))
 
 func (f *androidFile) Flush(ctx context.Context) syscall.Errno {
 	if !f.node.endEdit() {
-		return syscall.EIO
+		return f.node.ioError()
 	}
 	return 0
 }
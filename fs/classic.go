@@ -2,7 +2,10 @@ package fs
 
 import (
 	"context"
+	"crypto/sha1"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
@@ -62,9 +65,6 @@ func (n *classicNode) send() error {
 	if n.obj.Filename == "" {
 		return nil
 	}
-	if n.fs.mungeVfat[n.StorageID()] {
-		f.Filename = SanitizeDosName(f.Filename)
-	}
 
 	backing, err := os.Open(n.backing)
 	if err != nil {
@@ -91,18 +91,38 @@ func (n *classicNode) send() error {
 
 	_, _, handle, err := n.fs.dev.SendObjectInfo(n.StorageID(), f.ParentObject, f)
 	if err != nil {
-		log.Printf("SendObjectInfo failed %v", err)
+		if errno := toErrno("SendObjectInfo", err); errno != syscall.EIO {
+			return errno
+		}
 		return syscall.EINVAL
 	}
-	if err = n.fs.dev.SendObject(backing, fi.Size()); err != nil {
+	n.fs.storageChanged(n.StorageID())
+	h := sha1.New()
+	if err = n.fs.dev.SendObject(io.TeeReader(backing, h), fi.Size()); err != nil {
 		log.Printf("SendObject failed %v", err)
+		// Do not leave a truncated file behind.
+		if err := n.fs.dev.DeleteObject(handle); err != nil {
+			log.Printf("DeleteObject failed: %v", err)
+		}
+		if n.fs.storageGone(n.StorageID()) {
+			return syscall.ENODEV
+		}
 		return syscall.EINVAL
 	}
 	dt := time.Now().Sub(start)
 	log.Printf("sent %d bytes in %d ms. %.1f MB/s", fi.Size(),
 		dt.Nanoseconds()/1e6, 1e3*float64(fi.Size())/float64(dt.Nanoseconds()))
-	n.dirty = false
 	n.handle = handle
+	if err := n.verify(backing, hex.EncodeToString(h.Sum(nil)), fi.Size()); err != nil {
+		// Stay dirty, so the next flush sends it again.
+		log.Printf("verifying %q failed: %v; deleting it from the device", f.Filename, err)
+		if err := n.fs.dev.DeleteObject(handle); err != nil {
+			log.Printf("DeleteObject failed: %v", err)
+		}
+		n.handle = 0
+		return syscall.EIO
+	}
+	n.dirty = false
 
 	// TODO - we should create a new child with the new handle as
 	// the Inode number here, and send a notification so the new
@@ -114,6 +134,30 @@ func (n *classicNode) send() error {
 	return err
 }
 
+// verify checks a sent file as set by the Verify option, and records
+// its hash. Only full reads count as verified.
+func (n *classicNode) verify(backing *os.File, sum string, size int64) error {
+	switch n.fs.options.Verify {
+	case VerifyOff:
+		return nil
+	case VerifySample:
+		if err := n.fs.verifySample(n.handle, backing, size); err != nil {
+			return err
+		}
+		n.fs.recordHash(n.devicePath(), size, sum, false)
+	case VerifyFull:
+		h := sha1.New()
+		if err := n.fs.dev.GetObject(n.handle, h); err != nil {
+			return fmt.Errorf("reading back: %v", err)
+		}
+		if got := hex.EncodeToString(h.Sum(nil)); got != sum {
+			return fmt.Errorf("read back SHA-1 %s, sent %s", got, sum)
+		}
+		n.fs.recordHash(n.devicePath(), size, sum, true)
+	}
+	return nil
+}
+
 // Drop backing data if unused. Returns freed up space.
 func (n *classicNode) trim() int64 {
 	if n.dirty || n.backing == "" { // XXX || n.Inode().AnyFile() != nil {
@@ -152,8 +196,15 @@ func (n *classicNode) fetch() error {
 	defer f.Close()
 
 	start := time.Now()
-	err = n.fs.dev.GetObject(n.Handle(), f)
+	h := sha1.New()
+	err = n.fs.dev.GetObject(n.Handle(), io.MultiWriter(f, h))
 	dt := time.Now().Sub(start)
+	if err == nil && n.fs.options.Verify != VerifyOff {
+		err = n.checkFetched(f, hex.EncodeToString(h.Sum(nil)))
+		if err != nil {
+			os.Remove(f.Name())
+		}
+	}
 	if err == nil {
 		n.backing = f.Name()
 		n.dirty = false
@@ -161,12 +212,32 @@ func (n *classicNode) fetch() error {
 			dt.Nanoseconds()/1e6, 1e3*float64(sz)/float64(dt.Nanoseconds()))
 	} else {
 		log.Printf("error fetching: %v", err)
-		err = syscall.EIO
+		err = n.ioError()
 	}
 
 	return err
 }
 
+// checkFetched checks the size of a fetched file. A hash differing
+// from the recorded one is only reported, as the device may have
+// changed the file.
+func (n *classicNode) checkFetched(f *os.File, sum string) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() != n.Size {
+		return fmt.Errorf("fetched %d bytes of %q, want %d", fi.Size(), n.obj.Filename, n.Size)
+	}
+	if n.fs.hashes == nil {
+		return nil
+	}
+	if e, ok := n.fs.hashes.Entries[n.devicePath()]; ok && e.Size == fi.Size() && e.Hash != sum {
+		log.Printf("%q has SHA-1 %s; %s was recorded when it was sent", n.obj.Filename, sum, e.Hash)
+	}
+	return nil
+}
+
 var _ = (fs.NodeOpener)((*classicNode)(nil))
 
 func (n *classicNode) Open(ctx context.Context, flags uint32) (file fs.FileHandle, fuseFlags uint32, code syscall.Errno) {
@@ -215,7 +286,7 @@ func (p *pendingFile) Read(ctx context.Context, data []byte, off int64) (fuse.Re
 	if p.loopback == nil {
 		if err := p.node.fetch(); err != nil {
 			log.Printf("fetch failed: %v", err)
-			return nil, syscall.EIO
+			return nil, fs.ToErrno(err)
 		}
 		f, err := os.OpenFile(p.node.backing, os.O_RDWR|os.O_CREATE, 0644)
 		if err != nil {
@@ -99,6 +99,7 @@ func startFs(t *testing.T, useAndroid bool) (storageRoot string, cleanup func())
 	dev = nil
 	return storageRoot, func() {
 		server.Unmount()
+		root.OnUnmount()
 		d.Close()
 	}
 }
@@ -0,0 +1,112 @@
+package fs
+
+import (
+	"log"
+	"sync"
+
+	"github.com/hanwen/go-mtpfs/mtp"
+)
+
+// Device events. A goroutine reads them from the interrupt endpoint,
+// and records what they ask for. The file system runs single
+// threaded, and acts on the record the next time it needs it, so the
+// reader never starts transactions itself.
+
+// eventPoll is how long, in milliseconds, a read of the interrupt
+// endpoint waits. It bounds how long stopping the reader takes.
+const eventPoll = 500
+
+type eventState struct {
+	mu sync.Mutex
+	// staleInfo holds the storages whose StorageInfo changed.
+	staleInfo map[uint32]bool
+	// allStale is set if any storage may have changed.
+	allStale bool
+	// stores holds the storages added and removed, in order.
+	stores []storeChange
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// startEvents starts reading events.
+func (fs *deviceFS) startEvents() {
+	fs.events.staleInfo = map[uint32]bool{}
+	fs.events.stop = make(chan struct{})
+	fs.events.done = make(chan struct{})
+	go fs.readEvents()
+}
+
+// stopEvents stops the reader, and waits for it to exit. It must be
+// called before the device is closed.
+func (fs *deviceFS) stopEvents() {
+	if fs.events.stop == nil {
+		return
+	}
+	close(fs.events.stop)
+	<-fs.events.done
+	fs.events.stop = nil
+}
+
+func (fs *deviceFS) readEvents() {
+	defer close(fs.events.done)
+	for {
+		select {
+		case <-fs.events.stop:
+			return
+		default:
+		}
+		e, err := fs.dev.ReadEvent(eventPoll)
+		if err == mtp.ErrClosed {
+			// Closed after an error in a transaction.
+			return
+		}
+		if err != nil {
+			log.Printf("reading events: %v; ignoring further events", err)
+			return
+		}
+		if e != nil {
+			fs.handleEvent(e)
+		}
+	}
+}
+
+func (fs *deviceFS) handleEvent(e *mtp.Event) {
+	if fs.dev.MTPDebug {
+		log.Printf("event %v", e)
+	}
+	fs.events.mu.Lock()
+	defer fs.events.mu.Unlock()
+	switch e.Code {
+	case mtp.EC_StorageInfoChanged, mtp.EC_StoreFull:
+		if len(e.Param) > 0 {
+			fs.events.staleInfo[e.Param[0]] = true
+		} else {
+			fs.events.allStale = true
+		}
+	case mtp.EC_StoreAdded, mtp.EC_StoreRemoved:
+		if len(e.Param) > 0 {
+			fs.events.stores = append(fs.events.stores, storeChange{e.Param[0], e.Code == mtp.EC_StoreAdded})
+		}
+	case mtp.EC_ObjectAdded, mtp.EC_ObjectRemoved:
+		// The parameter is an object handle, so the storage is
+		// not known.
+		fs.events.allStale = true
+	}
+}
+
+// takeStale returns whether the StorageInfo of a storage changed
+// since the last call.
+func (fs *deviceFS) takeStale(sid uint32) bool {
+	fs.events.mu.Lock()
+	defer fs.events.mu.Unlock()
+	if fs.events.allStale {
+		for _, s := range fs.storages {
+			fs.events.staleInfo[s] = true
+		}
+		fs.events.allStale = false
+	}
+	stale := fs.events.staleInfo[sid]
+	delete(fs.events.staleInfo, sid)
+	return stale
+}
@@ -10,6 +10,8 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path"
+	"regexp"
 	"strings"
 	"syscall"
 	"time"
@@ -31,6 +33,36 @@ type DeviceFsOptions struct {
 
 	// Use android extensions if available.
 	Android bool
+
+	// Permission bits to clear from the modes of files (0666)
+	// and directories (0777), as for vfat.
+	FileMask, DirMask uint32
+
+	// Masks for both files and directories that replace FileMask
+	// and DirMask, by storage description.
+	StorageMasks map[string]uint32
+
+	// Index of the device in a mount with several devices,
+	// starting at 1. It keeps their inode numbers apart.
+	DeviceIndex int
+
+	// Show abstract playlists as .m3u8 files, and turn .m3u8
+	// files written to the mount into playlists.
+	Playlists bool
+
+	// How to check transfers of files. Android writes files in
+	// place, so this needs Android off on devices with the
+	// extensions.
+	Verify VerifyMode
+
+	// Directory for the hashes of verified files, one file per
+	// device. If empty, no hashes are kept.
+	HashDir string
+
+	// Regular expression for the storages that are added while
+	// mounted, such as SD cards. The storages passed to
+	// NewDeviceFSRoot are shown regardless.
+	StorageFilter string
 }
 
 // DeviceFS implements a fuse.NodeFileSystem that mounts multiple
@@ -42,7 +74,21 @@ type deviceFS struct {
 	dev           *mtp.Device
 	devInfo       mtp.DeviceInfo
 	storages      []uint32
-	mungeVfat     map[uint32]bool
+	// storageFilter is the compiled StorageFilter.
+	storageFilter *regexp.Regexp
+	// storageCount numbers the storages for their inodes.
+	storageCount uint64
+	mungeVfat    map[uint32]bool
+	// storageMasks holds StorageMasks by storage ID.
+	storageMasks map[uint32]uint32
+	// androidExt is set if the device has the Android extensions,
+	// even if they are not used for files.
+	androidExt bool
+	// hashes is set if verified files are recorded.
+	hashes *HashDB
+	// stats caches the statfs state by storage ID.
+	stats  map[uint32]*storageStat
+	events eventState
 
 	options *DeviceFsOptions
 }
@@ -58,14 +104,25 @@ func NewDeviceFSRoot(d *mtp.Device, storages []uint32, options DeviceFsOptions)
 		options: &options,
 	}
 	fs.root.fs = fs
-	fs.storages = storages
+	fs.storages = append([]uint32{}, storages...)
+	if options.DeviceIndex > maxDeviceIndex {
+		return nil, fmt.Errorf("device index %d too large", options.DeviceIndex)
+	}
 	if err := d.GetDeviceInfo(&fs.devInfo); err != nil {
 		return nil, err
 	}
+	var err error
+	if fs.storageFilter, err = regexp.Compile(options.StorageFilter); err != nil {
+		return nil, err
+	}
 
-	if !strings.Contains(fs.devInfo.MTPExtension, "android.com") {
+	fs.androidExt = strings.Contains(fs.devInfo.MTPExtension, "android.com")
+	if !fs.androidExt {
 		fs.options.Android = false
 	}
+	if fs.options.Android && options.Verify != VerifyOff {
+		return nil, fmt.Errorf("cannot verify files written with android extensions; use -android=false")
+	}
 
 	if !options.Android {
 		if err := fs.setupClassic(); err != nil {
@@ -73,18 +130,54 @@ func NewDeviceFSRoot(d *mtp.Device, storages []uint32, options DeviceFsOptions)
 		}
 	}
 
+	if options.Verify != VerifyOff && options.HashDir != "" {
+		id, err := d.ID()
+		if err != nil {
+			return nil, err
+		}
+		if fs.hashes, err = LoadHashDB(HashDBName(options.HashDir, id), id); err != nil {
+			return nil, err
+		}
+	}
+
 	fs.mungeVfat = make(map[uint32]bool)
+	fs.storageMasks = make(map[uint32]uint32)
 	for _, sid := range fs.storages {
 		var info mtp.StorageInfo
 		if err := fs.dev.GetStorageInfo(sid, &info); err != nil {
 			return nil, err
 		}
-		fs.mungeVfat[sid] = info.IsRemovable() && fs.options.RemovableVFat
+		fs.setupStorage(sid, &info)
 	}
+	fs.stats = make(map[uint32]*storageStat)
 
+	fs.startEvents()
 	return fs.Root(), nil
 }
 
+// Inode numbers of a device stay below bit 52, see ino().
+const maxDeviceIndex = 1<<9 - 1
+
+// ino returns the inode number for a node of this device. Storages
+// use bits 33-51, objects bits 1-32, and the services tree bits 61
+// and 62, leaving bits 52-60 for the device index.
+func (dfs *deviceFS) ino(n uint64) uint64 {
+	return uint64(dfs.options.DeviceIndex)<<52 | n
+}
+
+// mode returns the permission bits for files or directories in a
+// storage.
+func (dfs *deviceFS) mode(sid uint32, dir bool) uint32 {
+	fmask, dmask := dfs.options.FileMask, dfs.options.DirMask
+	if m, ok := dfs.storageMasks[sid]; ok {
+		fmask, dmask = m, m
+	}
+	if dir {
+		return 0777 &^ dmask
+	}
+	return 0666 &^ fmask
+}
+
 func (fs *deviceFS) Root() *rootNode {
 	return fs.root
 }
@@ -100,30 +193,11 @@ func (dfs *deviceFS) OnAdd(ctx context.Context) {
 			log.Printf("GetStorageInfo %x: %v", sid, err)
 			continue
 		}
-
-		obj := mtp.ObjectInfo{
-			ParentObject: NOPARENT_ID,
-			StorageID:    sid,
-			Filename:     info.StorageDescription,
-		}
-		folder := dfs.newFolder(obj, NOPARENT_ID)
-		name := info.StorageDescription
-		stable := fs.StableAttr{
-			Mode: syscall.S_IFDIR,
-			Ino:  uint64(sid) << 33,
-		}
-
-		dfs.root.Inode.AddChild(name,
-			dfs.root.Inode.NewPersistentInode(
-				ctx,
-				folder, stable),
-			false)
+		dfs.addStorage(ctx, sid, &info)
 	}
+	dfs.addServices(ctx)
 }
 
-// TODO - this should be per storage and return just the free space in
-// the storage.
-
 func (fs *deviceFS) newFile(obj mtp.ObjectInfo, size int64, id uint32) (node fs.InodeEmbedder) {
 	if obj.CompressedSize != 0xFFFFFFFF {
 		size = int64(obj.CompressedSize)
@@ -161,36 +235,57 @@ func (r *rootNode) OnAdd(ctx context.Context) {
 
 const NOPARENT_ID = 0xFFFFFFFF
 
-// XXX
+// OnUnmount stops reading events, and removes the backing
+// directory. It must be called before the device is closed.
 func (n *rootNode) OnUnmount() {
+	n.fs.stopEvents()
 	if n.fs.delBackingDir {
 		os.RemoveAll(n.fs.options.Dir)
 		n.fs.delBackingDir = false
 	}
 }
 
+var _ = (fs.NodeReaddirer)((*rootNode)(nil))
+
+func (n *rootNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	n.fs.applyStoreChanges(ctx)
+	return readdirChildren(&n.Inode), 0
+}
+
+var _ = (fs.NodeLookuper)((*rootNode)(nil))
+
+func (n *rootNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	n.fs.applyStoreChanges(ctx)
+	return lookupChild(ctx, &n.Inode, name, out)
+}
+
+// Statfs adds up the storages.
 func (n *rootNode) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
-	total := uint64(0)
-	free := uint64(0)
-	for _, ch := range n.Children() {
-		var s fuse.StatfsOut
-		if errno := ch.Operations().(fs.NodeStatfser).Statfs(ctx, &s); errno == 0 {
-			total += s.Blocks
-			free += s.Bfree
+	n.fs.applyStoreChanges(ctx)
+	*out = fuse.StatfsOut{Bsize: blockSize}
+	for _, sid := range n.fs.storages {
+		st, err := n.fs.storageStat(sid)
+		if err != nil {
+			log.Printf("GetStorageInfo %x: %v", sid, err)
+			continue
 		}
-	}
-
-	*out = fuse.StatfsOut{
-		Bsize:  blockSize,
-		Blocks: total,
-		Bavail: free,
-		Bfree:  free,
+		var s fuse.StatfsOut
+		st.fill(&s)
+		out.Blocks += s.Blocks
+		out.Bfree += s.Bfree
+		out.Bavail += s.Bavail
+		out.Files += s.Files
+		out.Ffree += s.Ffree
 	}
 	return 0
 }
 
 const forbidden = ":*?\"<>|"
 
+// SanitizeDosName replaces the characters VFAT forbids by '_'.
+//
+// Deprecated: the file system now maps names on VFAT storages
+// reversibly, see vfatEncode.
 func SanitizeDosName(name string) string {
 	if strings.IndexAny(name, forbidden) == -1 {
 		return name
@@ -206,12 +301,39 @@ func SanitizeDosName(name string) string {
 	return string(dest)
 }
 
+// checkName returns ENAMETOOLONG if name does not fit in an MTP
+// string, which is limited to 254 UTF-16 code units.
+func checkName(name string) syscall.Errno {
+	if !mtp.StringFits(name) {
+		return syscall.ENAMETOOLONG
+	}
+	return 0
+}
+
+// toErrno converts an MTP error into an errno, logging the
+// operation that failed.
+func toErrno(op string, err error) syscall.Errno {
+	log.Printf("%s failed: %v", op, err)
+	if errno, ok := err.(syscall.Errno); ok {
+		return errno
+	}
+	if _, ok := err.(mtp.StringTooLongError); ok {
+		return syscall.ENAMETOOLONG
+	}
+	if rc, ok := err.(mtp.RCError); ok && (rc == mtp.RC_InvalidStorageId || rc == mtp.RC_StoreNotAvailable) {
+		return syscall.ENODEV
+	}
+	return syscall.EIO
+}
+
 ////////////////
 // mtpNode
 
 type mtpNode interface {
 	Handle() uint32
 	StorageID() uint32
+	// Name returns the name on the device.
+	Name() string
 	SetName(string)
 }
 
@@ -233,24 +355,12 @@ type mtpNodeImpl struct {
 var _ = (fs.NodeStatfser)((*mtpNodeImpl)(nil))
 
 func (n *mtpNodeImpl) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
-	total := uint64(0)
-	free := uint64(0)
-
-	var info mtp.StorageInfo
-	if err := n.fs.dev.GetStorageInfo(n.StorageID(), &info); err != nil {
+	st, err := n.fs.storageStat(n.StorageID())
+	if err != nil {
 		log.Printf("GetStorageInfo %x: %v", n.StorageID(), err)
 		return 0
 	}
-
-	total += uint64(info.MaxCapability)
-	free += uint64(info.FreeSpaceInBytes)
-
-	*out = fuse.StatfsOut{
-		Bsize:  blockSize,
-		Blocks: total / blockSize,
-		Bavail: free / blockSize,
-		Bfree:  free / blockSize,
-	}
+	st.fill(out)
 	return 0
 }
 
@@ -269,13 +379,13 @@ func (n *mtpNodeImpl) Setxattr(ctx context.Context, attr string, dest []byte, fl
 var _ = (fs.NodeGetattrer)((*mtpNodeImpl)(nil))
 
 func (n *mtpNodeImpl) Getattr(ctx context.Context, file fs.FileHandle, out *fuse.AttrOut) (code syscall.Errno) {
-	if n.IsDir() {
-		out.Mode = 0755
-	} else {
-		out.Mode = 0644
+	f := n.obj
+	var sid uint32
+	if f != nil {
+		sid = f.StorageID
 	}
+	out.Mode = n.fs.mode(sid, n.IsDir())
 
-	f := n.obj
 	if f != nil {
 		out.Size = uint64(n.Size)
 		t := f.ModificationDate
@@ -296,10 +406,20 @@ func (n *mtpNodeImpl) setTime(mTime *time.Time) {
 	}
 }
 
+// devicePath returns the path of the node below the device root,
+// STORAGE/dir/file.
+func (n *mtpNodeImpl) devicePath() string {
+	return n.Path(&n.fs.root.Inode)
+}
+
 func (n *mtpNodeImpl) Handle() uint32 {
 	return n.handle
 }
 
+func (n *mtpNodeImpl) Name() string {
+	return n.obj.Filename
+}
+
 func (n *mtpNodeImpl) SetName(nm string) {
 	n.obj.Filename = nm
 }
@@ -332,6 +452,11 @@ var _ = mtpNode((*folderNode)(nil))
 type folderNode struct {
 	mtpNodeImpl
 	fetched bool
+	// aliases holds the names under which lookups found a child
+	// that has another spelling, on VFAT storages. They are
+	// dropped before listing the folder, so it shows each child
+	// once.
+	aliases map[string]bool
 }
 
 func (fs *deviceFS) newFolder(obj mtp.ObjectInfo, h uint32) *folderNode {
@@ -356,37 +481,32 @@ func (n *folderNode) fetch(ctx context.Context) bool {
 		return true
 	}
 
-	handles := mtp.Uint32Array{}
-	if err := n.fs.dev.GetObjectHandles(n.StorageID(), 0x0, n.Handle(), &handles); err != nil {
-		log.Printf("GetObjectHandles failed: %v", err)
-		return false
-	}
-
 	infos := map[uint32]*mtp.ObjectInfo{}
 	sizes := map[uint32]int64{}
-	for _, handle := range handles.Values {
-		obj := mtp.ObjectInfo{}
-		if err := n.fs.dev.GetObjectInfo(handle, &obj); err != nil {
-			log.Printf("GetObjectInfo for handle %d failed: %v", handle, err)
-			continue
-		}
+	propList := n.fs.devInfo.HasOperation(mtp.OC_MTP_GetObjPropList)
+	err := n.fs.dev.WalkFolder(n.StorageID(), n.Handle(), propList, func(handle uint32, obj *mtp.ObjectInfo, size int64) error {
 		if obj.Filename == "" {
 			log.Printf("ignoring handle 0x%x with empty name in dir 0x%x",
 				handle, n.Handle())
-			continue
+			return nil
 		}
+		infos[handle] = obj
+		sizes[handle] = size
+		return nil
+	})
+	if err != nil {
+		log.Printf("listing dir 0x%x failed: %v", n.Handle(), err)
+		return false
+	}
 
-		if obj.CompressedSize == 0xFFFFFFFF {
-			var val mtp.Uint64Value
-			if err := n.fs.dev.GetObjectPropValue(handle, mtp.OPC_ObjectSize, &val); err != nil {
-				log.Printf("GetObjectPropValue handle %d failed: %v", handle, err)
-				return false
-			}
-
-			sizes[handle] = int64(val.Value)
+	names := map[uint32]string{}
+	for handle, info := range infos {
+		names[handle] = n.fs.mountName(n.StorageID(), info.Filename)
+		if n.fs.options.Playlists && isPlaylist(info.ObjectFormat) {
+			names[handle] = playlistName(names[handle])
 		}
-		infos[handle] = &obj
 	}
+	unique := UniqueNames(names)
 
 	for handle, info := range infos {
 		var node fs.InodeEmbedder
@@ -395,19 +515,28 @@ func (n *folderNode) fetch(ctx context.Context) bool {
 
 		stable := fs.StableAttr{
 			// Avoid ID 1.
-			Ino: uint64(handle) << 1,
+			Ino: n.fs.ino(uint64(handle) << 1),
+		}
+		// The object keeps its name on the device; only the
+		// mount shows duplicates under another name.
+		name := unique[handle]
+		if name != names[handle] {
+			log.Printf("showing duplicate %q (handle 0x%x) as %q", names[handle], handle, name)
 		}
 		if isdir {
 			fNode := n.fs.newFolder(*info, handle)
 			node = fNode
 			stable.Mode = syscall.S_IFDIR
+		} else if n.fs.options.Playlists && isPlaylist(info.ObjectFormat) {
+			node = n.fs.newPlaylist(*info, handle)
+			stable.Mode = syscall.S_IFREG
 		} else {
 			sz := sizes[handle]
 			node = n.fs.newFile(*info, sz, handle)
 			stable.Mode = syscall.S_IFREG
 		}
 
-		n.AddChild(info.Filename,
+		n.AddChild(name,
 			n.NewPersistentInode(ctx, node, stable),
 			true)
 	}
@@ -419,19 +548,11 @@ var _ = (fs.NodeReaddirer)((*folderNode)(nil))
 
 func (n *folderNode) Readdir(ctx context.Context) (stream fs.DirStream, status syscall.Errno) {
 	if !n.fetch(ctx) {
-		return nil, syscall.EIO
+		return nil, n.ioError()
 	}
 
-	r := []fuse.DirEntry{}
-	for k, ch := range n.Children() {
-		r = append(r, fuse.DirEntry{
-			Mode: ch.Mode(),
-			Name: k,
-			Ino:  ch.StableAttr().Ino,
-		})
-	}
-
-	return fs.NewListDirStream(r), 0
+	n.dropAliases("")
+	return readdirChildren(&n.Inode), 0
 }
 
 func (n *folderNode) basenameRename(oldName string, newName string) error {
@@ -439,13 +560,26 @@ func (n *folderNode) basenameRename(oldName string, newName string) error {
 
 	mFile := ch.Operations().(mtpNode)
 
+	devName := newName
+	if _, ok := mFile.(*playlistNode); ok {
+		devName = playlistDeviceName(newName)
+	}
+	devName, errno := n.fs.deviceName(n.StorageID(), devName)
+	if errno != 0 {
+		return errno
+	}
 	if mFile.Handle() != 0 {
 		// Only rename on device if it was sent already.
-		v := mtp.StringValue{Value: newName}
+		v := mtp.StringValue{Value: devName}
 		if err := n.fs.dev.SetObjectPropValue(mFile.Handle(), mtp.OPC_ObjectFileName, &v); err != nil {
 			return err
 		}
 	}
+	mFile.SetName(devName)
+	if n.fs.hashes != nil {
+		n.fs.hashes.Rename(path.Join(n.devicePath(), oldName), path.Join(n.devicePath(), newName))
+		n.fs.saveHashes()
+	}
 	return nil
 }
 
@@ -471,68 +605,89 @@ func (n *folderNode) Rename(ctx context.Context, oldName string, newParent fs.In
 	if fn != n {
 		return syscall.ENOSYS
 	}
+	if errno := checkName(newName); errno != 0 {
+		return errno
+	}
+	found := n.foldName(oldName)
+	if errno := n.vfatCollision(newName, found); errno != 0 {
+		return errno
+	}
 
-	if newName != oldName {
-		if err := n.basenameRename(oldName, newName); err != nil {
-			log.Printf("basenameRename failed: %v", err)
-			return syscall.EIO
+	if newName != found {
+		if err := n.basenameRename(found, newName); err != nil {
+			return toErrno("basenameRename", err)
 		}
 	}
-
+	// The bridge moves the entry for oldName to newName, so that
+	// must be the child's only entry.
+	n.dropAliases(oldName)
+	if found != oldName {
+		n.MvChild(found, &n.Inode, oldName, true)
+	}
 	return 0
 }
 
 var _ = (fs.NodeLookuper)((*folderNode)(nil))
 
 func (n *folderNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (node *fs.Inode, code syscall.Errno) {
-	if !n.fetch(ctx) {
-		return nil, syscall.EIO
+	if errno := checkName(name); errno != 0 {
+		return nil, errno
 	}
-	ch := n.GetChild(name)
-	if ch == nil {
-		return nil, syscall.ENOENT
-	}
-
-	if ga, ok := ch.Operations().(fs.NodeGetattrer); ok {
-		var attr fuse.AttrOut
-		code = ga.Getattr(ctx, nil, &attr)
-		out.Attr = attr.Attr
+	if !n.fetch(ctx) {
+		return nil, n.ioError()
+	}
+	// VFAT does not tell case apart, so neither do lookups. The
+	// bridge adds the child under the name looked up.
+	found := n.foldName(name)
+	ch, errno := lookupChild(ctx, &n.Inode, found, out)
+	if errno == 0 && found != name {
+		if n.aliases == nil {
+			n.aliases = map[string]bool{}
+		}
+		n.aliases[name] = true
 	}
-
-	return ch, code
+	return ch, errno
 }
 
 var _ = (fs.NodeMkdirer)((*folderNode)(nil))
 
 func (n *folderNode) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	if errno := checkName(name); errno != 0 {
+		return nil, errno
+	}
 	if !n.fetch(ctx) {
-		return nil, syscall.EIO
+		return nil, n.ioError()
+	}
+
+	if errno := n.vfatCollision(name, ""); errno != 0 {
+		return nil, errno
+	}
+	devName, errno := n.fs.deviceName(n.StorageID(), name)
+	if errno != 0 {
+		return nil, errno
 	}
 
 	obj := mtp.ObjectInfo{
-		Filename:         name,
+		Filename:         devName,
 		ObjectFormat:     mtp.OFC_Association,
 		ModificationDate: time.Now(),
 		ParentObject:     n.Handle(),
 		StorageID:        n.StorageID(),
 	}
-	if n.fs.mungeVfat[n.StorageID()] {
-		obj.Filename = SanitizeDosName(obj.Filename)
-	}
 	_, _, newId, err := n.fs.dev.SendObjectInfo(n.StorageID(), n.Handle(), &obj)
 	if err != nil {
-		log.Printf("CreateFolder failed: %v", err)
-		return nil, syscall.EIO
+		return nil, toErrno("CreateFolder", err)
 	}
+	n.fs.storageChanged(n.StorageID())
 
 	f := n.fs.newFolder(obj, newId)
 	stable := fs.StableAttr{
 		Mode: syscall.S_IFDIR,
-		Ino:  uint64(newId) << 1,
+		Ino:  n.fs.ino(uint64(newId) << 1),
 	}
 	ch := n.NewPersistentInode(ctx, f, stable)
 	f.fetched = true
-	out.Mode = 0755
+	out.Mode = n.fs.mode(n.StorageID(), true)
 	return ch, 0
 }
 
@@ -540,9 +695,10 @@ var _ = (fs.NodeUnlinker)((*folderNode)(nil))
 
 func (n *folderNode) Unlink(ctx context.Context, name string) syscall.Errno {
 	if !n.fetch(ctx) {
-		return syscall.EIO
+		return n.ioError()
 	}
 
+	name = n.foldName(name)
 	ch := n.GetChild(name)
 	if ch == nil {
 		return syscall.ENOENT
@@ -552,11 +708,17 @@ func (n *folderNode) Unlink(ctx context.Context, name string) syscall.Errno {
 	if f.Handle() != 0 {
 		if err := n.fs.dev.DeleteObject(f.Handle()); err != nil {
 			log.Printf("DeleteObject failed: %v", err)
-			return syscall.EIO
+			return n.ioError()
+		}
+		n.fs.storageChanged(n.StorageID())
+		if n.fs.hashes != nil {
+			n.fs.hashes.Remove(path.Join(n.devicePath(), name))
+			n.fs.saveHashes()
 		}
 	} else {
 		f.SetName("")
 	}
+	n.dropAliases("")
 	n.RmChild(name)
 	return 0
 }
@@ -565,13 +727,13 @@ var _ = (fs.NodeRmdirer)((*folderNode)(nil))
 
 func (n *folderNode) Rmdir(ctx context.Context, name string) (errno syscall.Errno) {
 	if !n.fetch(ctx) {
-		errno = syscall.EIO
+		errno = n.ioError()
 		return
 	}
-	if child := n.GetChild(name); child.IsDir() {
+	if child := n.GetChild(n.foldName(name)); child.IsDir() {
 		asFolder := child.Operations().(*folderNode)
 		if !asFolder.fetch(ctx) {
-			errno = syscall.EIO
+			errno = n.ioError()
 			return
 		}
 
@@ -586,14 +748,24 @@ func (n *folderNode) Rmdir(ctx context.Context, name string) (errno syscall.Errn
 var _ = (fs.NodeCreater)((*folderNode)(nil))
 
 func (n *folderNode) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (ch *fs.Inode, file fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	if errno = checkName(name); errno != 0 {
+		return
+	}
 	if !n.fetch(ctx) {
-		errno = syscall.EIO
+		errno = n.ioError()
+		return
+	}
+	if errno = n.vfatCollision(name, ""); errno != 0 {
+		return
+	}
+	devName, errno := n.fs.deviceName(n.StorageID(), name)
+	if errno != 0 {
 		return
 	}
 
 	obj := mtp.ObjectInfo{
 		StorageID:        n.StorageID(),
-		Filename:         name,
+		Filename:         devName,
 		ObjectFormat:     mtp.OFC_Undefined,
 		ModificationDate: time.Now(),
 		ParentObject:     n.Handle(),
@@ -602,19 +774,21 @@ func (n *folderNode) Create(ctx context.Context, name string, flags uint32, mode
 
 	var fsNode fs.InodeEmbedder
 	var stable fs.StableAttr
-	if n.fs.options.Android {
+	if n.fs.options.Playlists && strings.HasSuffix(name, playlistExt) {
+		file, fsNode = n.fs.createPlaylist(obj)
+	} else if n.fs.options.Android {
 		_, _, handle, err := n.fs.dev.SendObjectInfo(n.StorageID(), n.Handle(), &obj)
 		if err != nil {
-			log.Println("SendObjectInfo failed", err)
-			errno = syscall.EIO
+			errno = toErrno("SendObjectInfo", err)
 			return
 		}
 
 		if err = n.fs.dev.SendObject(&bytes.Buffer{}, 0); err != nil {
 			log.Println("SendObject failed:", err)
-			errno = syscall.EIO
+			errno = n.ioError()
 			return
 		}
+		n.fs.storageChanged(n.StorageID())
 
 		aNode := &androidNode{
 			mtpNodeImpl: mtpNodeImpl{
@@ -625,14 +799,14 @@ func (n *folderNode) Create(ctx context.Context, name string, flags uint32, mode
 		}
 
 		if !aNode.startEdit() {
-			errno = syscall.EIO
+			errno = n.ioError()
 			return
 		}
 		file = &androidFile{
 			node: aNode,
 		}
 		fsNode = aNode
-		stable.Ino = uint64(handle) << 1
+		stable.Ino = n.fs.ino(uint64(handle) << 1)
 	} else {
 		var err error
 
@@ -645,6 +819,9 @@ func (n *folderNode) Create(ctx context.Context, name string, flags uint32, mode
 	ch = n.NewPersistentInode(ctx, fsNode, stable)
 
 	var a fuse.AttrOut
+	if ga, ok := fsNode.(fs.NodeGetattrer); ok {
+		ga.Getattr(ctx, file, &a)
+	}
 	out.Attr = a.Attr
 	return ch, file, 0, 0
 }
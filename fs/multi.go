@@ -0,0 +1,201 @@
+package fs
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-mtpfs/mtp"
+)
+
+// ScanFunc returns the locations (see mtp.Device.Location) of the
+// attached devices, and newly opened and configured devices, skipping
+// the locations in known.
+type ScanFunc func(known map[string]bool) (present map[string]bool, added []*mtp.Device)
+
+// How often the device list may be refreshed.
+const scanInterval = time.Second
+
+// multiRootNode is the root of a mount holding several devices,
+// each in a directory named "Manufacturer Model Serial". Devices
+// are picked up and dropped when the root is listed.
+type multiRootNode struct {
+	fs.Inode
+
+	scan          ScanFunc
+	storageFilter string
+	options       DeviceFsOptions
+
+	// devices holds the mounted devices by location.
+	devices map[string]*multiDevice
+	// tried holds the locations of attached devices that were
+	// scanned, mounted or not.
+	tried     map[string]bool
+	nextIndex int
+	lastScan  time.Time
+}
+
+type multiDevice struct {
+	name string
+	dev  *mtp.Device
+	root *rootNode
+}
+
+// NewMultiDeviceRoot returns a root that mounts all devices found by
+// scan, selecting storages with storageFilter.
+func NewMultiDeviceRoot(scan ScanFunc, storageFilter string, options DeviceFsOptions) *multiRootNode {
+	return &multiRootNode{
+		scan:          scan,
+		storageFilter: storageFilter,
+		options:       options,
+		devices:       map[string]*multiDevice{},
+		tried:         map[string]bool{},
+	}
+}
+
+var _ = (fs.NodeOnAdder)((*multiRootNode)(nil))
+
+func (n *multiRootNode) OnAdd(ctx context.Context) {
+	n.rescan(ctx)
+}
+
+// DeviceName returns a directory name for a device: "Manufacturer
+// Model Serial".
+func DeviceName(info *mtp.DeviceInfo) string {
+	var parts []string
+	for _, s := range []string{info.Manufacturer, info.Model, info.SerialNumber} {
+		if s = strings.TrimSpace(s); s != "" {
+			parts = append(parts, s)
+		}
+	}
+	name := strings.Replace(strings.Join(parts, " "), "/", "_", -1)
+	if name == "" {
+		name = "device"
+	}
+	return name
+}
+
+func (n *multiRootNode) rescan(ctx context.Context) {
+	if time.Now().Sub(n.lastScan) < scanInterval {
+		return
+	}
+	n.lastScan = time.Now()
+
+	present, added := n.scan(n.tried)
+	for loc := range n.tried {
+		if !present[loc] {
+			delete(n.tried, loc)
+		}
+	}
+	for loc, d := range n.devices {
+		if !present[loc] {
+			n.remove(loc, d)
+		}
+	}
+	for loc := range present {
+		n.tried[loc] = true
+	}
+	for _, dev := range added {
+		if err := n.add(ctx, dev); err != nil {
+			log.Printf("device at %s: %v", dev.Location(), err)
+			dev.Close()
+			dev.Done()
+		}
+	}
+}
+
+func (n *multiRootNode) add(ctx context.Context, dev *mtp.Device) error {
+	if n.nextIndex >= maxDeviceIndex {
+		return fmt.Errorf("too many devices")
+	}
+	var info mtp.DeviceInfo
+	if err := dev.GetDeviceInfo(&info); err != nil {
+		return err
+	}
+	sids, err := SelectStorages(dev, n.storageFilter)
+	if err != nil {
+		return err
+	}
+
+	// Indices are not reused, as the kernel may still know the
+	// inodes of a removed device.
+	n.nextIndex++
+	opts := n.options
+	opts.DeviceIndex = n.nextIndex
+	opts.StorageFilter = n.storageFilter
+	root, err := NewDeviceFSRoot(dev, sids, opts)
+	if err != nil {
+		return err
+	}
+
+	name := DeviceName(&info)
+	for i := 2; n.GetChild(name) != nil; i++ {
+		name = fmt.Sprintf("%s (%d)", DeviceName(&info), i)
+	}
+	n.AddChild(name, n.NewPersistentInode(ctx, root, fs.StableAttr{
+		Mode: syscall.S_IFDIR,
+		Ino:  root.fs.ino(0),
+	}), false)
+
+	loc := dev.Location()
+	n.devices[loc] = &multiDevice{name: name, dev: dev, root: root}
+	log.Printf("added device %q at %s", name, loc)
+	return nil
+}
+
+func (n *multiRootNode) remove(loc string, d *multiDevice) {
+	log.Printf("removed device %q at %s", d.name, loc)
+	n.RmChild(d.name)
+	d.root.OnUnmount()
+	d.dev.Close()
+	d.dev.Done()
+	delete(n.devices, loc)
+}
+
+// OnUnmount closes all devices.
+func (n *multiRootNode) OnUnmount() {
+	for _, d := range n.devices {
+		d.root.OnUnmount()
+		d.dev.Close()
+		d.dev.Done()
+	}
+	n.devices = map[string]*multiDevice{}
+}
+
+var _ = (fs.NodeReaddirer)((*multiRootNode)(nil))
+
+func (n *multiRootNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	n.rescan(ctx)
+	return readdirChildren(&n.Inode), 0
+}
+
+var _ = (fs.NodeLookuper)((*multiRootNode)(nil))
+
+func (n *multiRootNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	if n.GetChild(name) == nil {
+		n.rescan(ctx)
+	}
+	return lookupChild(ctx, &n.Inode, name, out)
+}
+
+var _ = (fs.NodeStatfser)((*multiRootNode)(nil))
+
+func (n *multiRootNode) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
+	*out = fuse.StatfsOut{Bsize: blockSize}
+	for _, d := range n.devices {
+		var s fuse.StatfsOut
+		if errno := d.root.Statfs(ctx, &s); errno == 0 {
+			out.Blocks += s.Blocks
+			out.Bfree += s.Bfree
+			out.Bavail += s.Bavail
+			out.Files += s.Files
+			out.Ffree += s.Ffree
+		}
+	}
+	return 0
+}
@@ -0,0 +1,35 @@
+package fs
+
+import (
+	"testing"
+
+	"github.com/hanwen/go-mtpfs/mtp"
+)
+
+func TestDeviceName(t *testing.T) {
+	for _, c := range []struct {
+		info mtp.DeviceInfo
+		want string
+	}{
+		{mtp.DeviceInfo{Manufacturer: "Google", Model: "Pixel 3", SerialNumber: "8ABX0Y"}, "Google Pixel 3 8ABX0Y"},
+		{mtp.DeviceInfo{Manufacturer: "ACME ", Model: "A/B"}, "ACME A_B"},
+		{mtp.DeviceInfo{}, "device"},
+	} {
+		if got := DeviceName(&c.info); got != c.want {
+			t.Errorf("DeviceName(%v): got %q, want %q", c.info, got, c.want)
+		}
+	}
+}
+
+func TestDeviceIno(t *testing.T) {
+	a := &deviceFS{options: &DeviceFsOptions{DeviceIndex: 1}}
+	b := &deviceFS{options: &DeviceFsOptions{DeviceIndex: 2}}
+	for _, n := range []uint64{0, 2, 1 << 33, servicesIno, serviceObjectIno(0xFFFFFFFF)} {
+		if a.ino(n) == b.ino(n) {
+			t.Errorf("ino(0x%x) is the same for both devices", n)
+		}
+		if a.ino(n)&(1<<63) != 0 {
+			t.Errorf("ino(0x%x) uses the automatic range", n)
+		}
+	}
+}
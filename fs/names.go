@@ -0,0 +1,49 @@
+package fs
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// File names as shown in the mount.
+
+// UniqueNames returns the names to show for the objects of a folder,
+// by handle. MTP allows several objects with the same name in a
+// folder; all but the one with the lowest handle get a number, as in
+// "IMG_0001 (2).JPG", avoiding the names of other objects.
+func UniqueNames(names map[uint32]string) map[uint32]string {
+	handles := make([]uint32, 0, len(names))
+	taken := map[string]bool{}
+	for h, name := range names {
+		handles = append(handles, h)
+		taken[name] = true
+	}
+	sort.Slice(handles, func(i, j int) bool { return handles[i] < handles[j] })
+
+	result := make(map[uint32]string, len(names))
+	seen := map[string]bool{}
+	for _, h := range handles {
+		name := names[h]
+		if !seen[name] {
+			seen[name] = true
+			result[h] = name
+			continue
+		}
+		ext := path.Ext(name)
+		stem := strings.TrimSuffix(name, ext)
+		if stem == "" {
+			stem, ext = name, ""
+		}
+		for i := 2; ; i++ {
+			alt := fmt.Sprintf("%s (%d)%s", stem, i, ext)
+			if !taken[alt] {
+				taken[alt] = true
+				result[h] = alt
+				break
+			}
+		}
+	}
+	return result
+}
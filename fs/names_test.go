@@ -0,0 +1,30 @@
+package fs
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestUniqueNames(t *testing.T) {
+	got := UniqueNames(map[uint32]string{
+		7: "IMG_0001.JPG",
+		3: "IMG_0001.JPG",
+		9: "IMG_0001.JPG",
+		4: "IMG_0001 (2).JPG",
+		5: ".nomedia",
+		6: ".nomedia",
+		8: "DCIM",
+	})
+	want := map[uint32]string{
+		3: "IMG_0001.JPG",
+		7: "IMG_0001 (3).JPG",
+		9: "IMG_0001 (4).JPG",
+		4: "IMG_0001 (2).JPG",
+		5: ".nomedia",
+		6: ".nomedia (2)",
+		8: "DCIM",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,371 @@
+package fs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-mtpfs/mtp"
+)
+
+// Abstract playlists have no data; their tracks are object
+// references. They are shown as .m3u8 files with paths relative to
+// the playlist's directory, and writing such a file sets the
+// references.
+
+const playlistExt = ".m3u8"
+
+func isPlaylist(format uint16) bool {
+	switch format {
+	case mtp.OFC_MTP_AbstractAudioVideoPlaylist,
+		mtp.OFC_MTP_AbstractAudioPlaylist,
+		mtp.OFC_MTP_AbstractVideoPlaylist:
+		return true
+	}
+	return false
+}
+
+// playlistName returns the name under which a device playlist is
+// shown in the mount.
+func playlistName(filename string) string {
+	return filename + playlistExt
+}
+
+// playlistDeviceName is the inverse of playlistName.
+func playlistDeviceName(name string) string {
+	return strings.TrimSuffix(name, playlistExt)
+}
+
+// playlistEntries returns the paths listed in an m3u8 playlist.
+func playlistEntries(data []byte) []string {
+	var r []string
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		l := strings.TrimSpace(s.Text())
+		l = strings.TrimPrefix(l, "\ufeff")
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		r = append(r, l)
+	}
+	return r
+}
+
+type playlistNode struct {
+	mtpNodeImpl
+
+	// Generated playlist contents, or nil if not generated yet.
+	// They are generated again on open, as tracks may have been
+	// renamed or removed since.
+	data []byte
+}
+
+var _ = mtpNode((*playlistNode)(nil))
+
+func (dfs *deviceFS) newPlaylist(obj mtp.ObjectInfo, h uint32) *playlistNode {
+	return &playlistNode{
+		mtpNodeImpl: mtpNodeImpl{
+			handle: h,
+			obj:    &obj,
+			fs:     dfs,
+		},
+	}
+}
+
+func (n *playlistNode) dir() *fs.Inode {
+	_, parent := n.Parent()
+	return parent
+}
+
+// generate fills n.data with the playlist read from the device.
+func (n *playlistNode) generate(ctx context.Context) syscall.Errno {
+	if n.data != nil || n.Handle() == 0 {
+		return 0
+	}
+	refs := mtp.Uint32Array{}
+	if err := n.fs.dev.GetObjectReferences(n.Handle(), &refs); err != nil {
+		log.Printf("GetObjectReferences 0x%x failed: %v", n.Handle(), err)
+		return n.ioError()
+	}
+
+	dirPath := n.dir().Path(n.Root())
+	buf := bytes.NewBufferString("#EXTM3U\n")
+	known := map[uint32]*fs.Inode{}
+	for _, ref := range refs.Values {
+		ch, err := n.fs.objectInode(ctx, ref, known)
+		if err != nil {
+			log.Printf("playlist %q: skipping reference 0x%x: %v", n.obj.Filename, ref, err)
+			continue
+		}
+		rel, err := filepath.Rel("/"+dirPath, "/"+ch.Path(n.Root()))
+		if err != nil {
+			log.Printf("playlist %q: %v", n.obj.Filename, err)
+			continue
+		}
+		fmt.Fprintf(buf, "%s\n", rel)
+	}
+	n.data = buf.Bytes()
+	n.Size = int64(len(n.data))
+	return 0
+}
+
+// save sets the references of the playlist from the m3u8 data,
+// creating the playlist on the device if needed.
+func (n *playlistNode) save(ctx context.Context, data []byte) syscall.Errno {
+	if n.obj.Filename == "" {
+		// Unlinked before it was saved.
+		return 0
+	}
+
+	refs := mtp.Uint32Array{Values: []uint32{}}
+	for _, p := range playlistEntries(data) {
+		ch, err := n.fs.resolvePath(ctx, n.dir(), p)
+		if err != nil {
+			log.Printf("playlist %q: skipping %q: %v", n.obj.Filename, p, err)
+			continue
+		}
+		if m, ok := ch.Operations().(mtpNode); ok && !ch.IsDir() && m.Handle() != 0 {
+			refs.Values = append(refs.Values, m.Handle())
+		} else {
+			log.Printf("playlist %q: skipping %q: not a file on the device", n.obj.Filename, p)
+		}
+	}
+
+	if n.Handle() == 0 {
+		_, _, handle, err := n.fs.dev.SendObjectInfo(n.StorageID(), n.obj.ParentObject, n.obj)
+		if err != nil {
+			return toErrno("SendObjectInfo", err)
+		}
+		if err := n.fs.dev.SendObject(&bytes.Buffer{}, 0); err != nil {
+			return toErrno("SendObject", err)
+		}
+		n.fs.storageChanged(n.StorageID())
+		n.handle = handle
+	}
+	if err := n.fs.dev.SetObjectReferences(n.Handle(), &refs); err != nil {
+		return toErrno("SetObjectReferences", err)
+	}
+
+	// Regenerate on next access, so paths are normalized.
+	n.data = nil
+	return n.generate(ctx)
+}
+
+var _ = (fs.NodeGetattrer)((*playlistNode)(nil))
+
+func (n *playlistNode) Getattr(ctx context.Context, file fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	if f, ok := file.(*playlistFile); ok && f.dirty {
+		n.Size = int64(len(f.data))
+	} else if errno := n.generate(ctx); errno != 0 {
+		return errno
+	}
+	return n.mtpNodeImpl.Getattr(ctx, file, out)
+}
+
+var _ = (fs.NodeOpener)((*playlistNode)(nil))
+
+func (n *playlistNode) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	f := &playlistFile{node: n}
+	if flags&syscall.O_TRUNC != 0 {
+		f.dirty = true
+		return f, fuse.FOPEN_DIRECT_IO, 0
+	}
+	n.data = nil
+	if errno := n.generate(ctx); errno != 0 {
+		return nil, 0, errno
+	}
+	f.data = append([]byte{}, n.data...)
+	return f, fuse.FOPEN_DIRECT_IO, 0
+}
+
+var _ = (fs.NodeSetattrer)((*playlistNode)(nil))
+
+func (n *playlistNode) Setattr(ctx context.Context, file fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	if sz, ok := in.GetSize(); ok {
+		if f, ok := file.(*playlistFile); ok {
+			f.truncate(int64(sz))
+		} else {
+			n.data = nil
+			if errno := n.generate(ctx); errno != 0 {
+				return errno
+			}
+			f := &playlistFile{node: n, data: n.data}
+			f.truncate(int64(sz))
+			if errno := n.save(ctx, f.data); errno != 0 {
+				return errno
+			}
+		}
+	}
+	if errno := n.mtpNodeImpl.Setattr(ctx, file, in, out); errno != 0 {
+		return errno
+	}
+	return n.Getattr(ctx, file, out)
+}
+
+// playlistFile buffers the playlist contents while it is open.
+type playlistFile struct {
+	node  *playlistNode
+	data  []byte
+	dirty bool
+}
+
+func (f *playlistFile) truncate(sz int64) {
+	if sz < int64(len(f.data)) {
+		f.data = f.data[:sz]
+	} else {
+		f.data = append(f.data, make([]byte, sz-int64(len(f.data)))...)
+	}
+	f.dirty = true
+}
+
+var _ = (fs.FileReader)((*playlistFile)(nil))
+
+func (f *playlistFile) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	if off > int64(len(f.data)) {
+		off = int64(len(f.data))
+	}
+	end := off + int64(len(dest))
+	if end > int64(len(f.data)) {
+		end = int64(len(f.data))
+	}
+	return fuse.ReadResultData(f.data[off:end]), 0
+}
+
+var _ = (fs.FileWriter)((*playlistFile)(nil))
+
+func (f *playlistFile) Write(ctx context.Context, data []byte, off int64) (uint32, syscall.Errno) {
+	if end := off + int64(len(data)); end > int64(len(f.data)) {
+		f.truncate(end)
+	}
+	copy(f.data[off:], data)
+	f.dirty = true
+	return uint32(len(data)), 0
+}
+
+var _ = (fs.FileFlusher)((*playlistFile)(nil))
+
+func (f *playlistFile) Flush(ctx context.Context) syscall.Errno {
+	if !f.dirty {
+		return 0
+	}
+	if errno := f.node.save(ctx, f.data); errno != 0 {
+		return errno
+	}
+	f.dirty = false
+	return 0
+}
+
+func (dfs *deviceFS) createPlaylist(obj mtp.ObjectInfo) (fs.FileHandle, fs.InodeEmbedder) {
+	obj.Filename = playlistDeviceName(obj.Filename)
+	obj.ObjectFormat = mtp.OFC_MTP_AbstractAudioVideoPlaylist
+	n := dfs.newPlaylist(obj, 0)
+	n.data = []byte{}
+	return &playlistFile{node: n, dirty: true}, n
+}
+
+// storageRoot returns the top level folder for a storage.
+func (dfs *deviceFS) storageRoot(sid uint32) *folderNode {
+	for _, ch := range dfs.root.Children() {
+		if f, ok := ch.Operations().(*folderNode); ok && f.StorageID() == sid {
+			return f
+		}
+	}
+	return nil
+}
+
+// childByHandle returns the child of dir holding the given handle.
+func childByHandle(dir *fs.Inode, handle uint32) *fs.Inode {
+	for _, ch := range dir.Children() {
+		if m, ok := ch.Operations().(mtpNode); ok && m.Handle() == handle {
+			return ch
+		}
+	}
+	return nil
+}
+
+// objectInode finds the inode for an object handle, fetching the
+// folders leading up to it. Known maps folder handles to inodes
+// found earlier, to save round trips.
+func (dfs *deviceFS) objectInode(ctx context.Context, handle uint32, known map[uint32]*fs.Inode) (*fs.Inode, error) {
+	var chain []uint32
+	var dir *fs.Inode
+	for h := handle; dir == nil; {
+		if ch, ok := known[h]; ok {
+			dir = ch
+			break
+		}
+		var info mtp.ObjectInfo
+		if err := dfs.dev.GetObjectInfo(h, &info); err != nil {
+			return nil, err
+		}
+		chain = append(chain, h)
+		if info.ParentObject == 0 || info.ParentObject == NOPARENT_ID {
+			root := dfs.storageRoot(info.StorageID)
+			if root == nil {
+				return nil, fmt.Errorf("storage 0x%x is not mounted", info.StorageID)
+			}
+			dir = &root.Inode
+		} else if len(chain) > 256 {
+			return nil, fmt.Errorf("parent loop at handle 0x%x", h)
+		}
+		h = info.ParentObject
+	}
+
+	if len(chain) == 0 {
+		return dir, nil
+	}
+	for i := len(chain) - 1; ; i-- {
+		folder, ok := dir.Operations().(*folderNode)
+		if !ok {
+			return nil, fmt.Errorf("handle 0x%x is not in a folder", chain[i])
+		}
+		if !folder.fetch(ctx) {
+			return nil, fmt.Errorf("fetching folder failed")
+		}
+		ch := childByHandle(dir, chain[i])
+		if ch == nil {
+			return nil, fmt.Errorf("handle 0x%x not found", chain[i])
+		}
+		if i == 0 {
+			return ch, nil
+		}
+		known[chain[i]] = ch
+		dir = ch
+	}
+}
+
+// resolvePath looks up a slash-separated path relative to dir. Paths
+// starting with a slash are relative to the mount root.
+func (dfs *deviceFS) resolvePath(ctx context.Context, dir *fs.Inode, p string) (*fs.Inode, error) {
+	p = filepath.ToSlash(p)
+	if strings.HasPrefix(p, "/") {
+		dir = &dfs.root.Inode
+	}
+	for _, c := range strings.Split(p, "/") {
+		switch c {
+		case "", ".":
+			continue
+		case "..":
+			if _, parent := dir.Parent(); parent != nil {
+				dir = parent
+			}
+			continue
+		}
+		if folder, ok := dir.Operations().(*folderNode); ok && !folder.fetch(ctx) {
+			return nil, fmt.Errorf("fetching folder failed")
+		}
+		ch := dir.GetChild(c)
+		if ch == nil {
+			return nil, fmt.Errorf("%q not found", c)
+		}
+		dir = ch
+	}
+	return dir, nil
+}
@@ -0,0 +1,21 @@
+package fs
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPlaylistEntries(t *testing.T) {
+	data := "\ufeff#EXTM3U\n#EXTINF:123,Artist - Title\nMusic/a.mp3\r\n\n  ../Podcasts/b.mp3  \n/Internal storage/c.mp3"
+	got := playlistEntries([]byte(data))
+	want := []string{"Music/a.mp3", "../Podcasts/b.mp3", "/Internal storage/c.mp3"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestPlaylistName(t *testing.T) {
+	if got := playlistDeviceName(playlistName("Road trip")); got != "Road trip" {
+		t.Errorf("roundtrip: got %q", got)
+	}
+}
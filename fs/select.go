@@ -25,13 +25,7 @@ func SelectStorages(dev *mtp.Device, pat string) ([]uint32, error) {
 			return nil, err
 		}
 
-		if !s.IsHierarchical() && !s.IsDCF() {
-			log.Printf("skipping non hierarchical or DCF storage %q", s.StorageDescription)
-			continue
-		}
-
-		if re.FindStringIndex(s.StorageDescription) == nil {
-			log.Printf("filtering out storage %q", s.StorageDescription)
+		if !storageSelected(&s, re) {
 			continue
 		}
 		filtered = append(filtered, id)
@@ -39,3 +33,17 @@ func SelectStorages(dev *mtp.Device, pat string) ([]uint32, error) {
 
 	return filtered, nil
 }
+
+// storageSelected returns whether a storage can be shown and matches
+// the filter.
+func storageSelected(s *mtp.StorageInfo, re *regexp.Regexp) bool {
+	if !s.IsHierarchical() && !s.IsDCF() {
+		log.Printf("skipping non hierarchical or DCF storage %q", s.StorageDescription)
+		return false
+	}
+	if re.FindStringIndex(s.StorageDescription) == nil {
+		log.Printf("filtering out storage %q", s.StorageDescription)
+		return false
+	}
+	return true
+}
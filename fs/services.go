@@ -0,0 +1,311 @@
+package fs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-mtpfs/mtp"
+)
+
+// The .services directory exposes MTP 1.1 device services read-only:
+// each service is a directory holding an info.txt description and
+// the service's objects.
+
+const servicesDirName = ".services"
+
+// Inode numbers for the services tree live above the ranges used for
+// storages and object handles.
+const servicesIno = 1 << 62
+
+func serviceIno(id uint32, kind uint64) uint64 {
+	return servicesIno | uint64(id)<<3 | kind
+}
+
+func serviceObjectIno(handle uint32) uint64 {
+	return servicesIno | 1<<61 | uint64(handle)<<1
+}
+
+func (dfs *deviceFS) addServices(ctx context.Context) {
+	if !dfs.devInfo.HasOperation(mtp.OC_MTP_GetServiceIDs) {
+		return
+	}
+	node := &servicesNode{fs: dfs}
+	dfs.root.AddChild(servicesDirName,
+		dfs.root.NewPersistentInode(ctx, node, fs.StableAttr{
+			Mode: syscall.S_IFDIR,
+			Ino:  dfs.ino(servicesIno),
+		}), false)
+}
+
+type servicesNode struct {
+	fs.Inode
+	fs      *deviceFS
+	fetched bool
+}
+
+var _ = (fs.NodeReaddirer)((*servicesNode)(nil))
+var _ = (fs.NodeLookuper)((*servicesNode)(nil))
+var _ = (fs.NodeGetattrer)((*servicesNode)(nil))
+
+func (n *servicesNode) fetch(ctx context.Context) bool {
+	if n.fetched {
+		return true
+	}
+
+	ids := mtp.Uint32Array{}
+	if err := n.fs.dev.GetServiceIDs(&ids); err != nil {
+		log.Printf("GetServiceIDs failed: %v", err)
+		return false
+	}
+	for _, id := range ids.Values {
+		info := &mtp.ServiceInfo{}
+		if err := n.fs.dev.GetServiceInfo(id, info); err != nil {
+			log.Printf("GetServiceInfo 0x%x failed: %v", id, err)
+			continue
+		}
+
+		name := info.ServiceName
+		if name == "" || n.GetChild(name) != nil {
+			name = fmt.Sprintf("%s-0x%x", name, id)
+		}
+		n.AddChild(name, n.NewPersistentInode(ctx,
+			&serviceNode{fs: n.fs, info: info},
+			fs.StableAttr{
+				Mode: syscall.S_IFDIR,
+				Ino:  n.fs.ino(serviceIno(id, 1)),
+			}), false)
+	}
+	n.fetched = true
+	return true
+}
+
+func (n *servicesNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	if !n.fetch(ctx) {
+		return nil, syscall.EIO
+	}
+	return readdirChildren(&n.Inode), 0
+}
+
+func (n *servicesNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	if !n.fetch(ctx) {
+		return nil, syscall.EIO
+	}
+	return lookupChild(ctx, &n.Inode, name, out)
+}
+
+func (n *servicesNode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = 0555
+	return 0
+}
+
+// serviceNode is the directory for a single service.
+type serviceNode struct {
+	fs.Inode
+	fs      *deviceFS
+	info    *mtp.ServiceInfo
+	fetched bool
+}
+
+var _ = (fs.NodeReaddirer)((*serviceNode)(nil))
+var _ = (fs.NodeLookuper)((*serviceNode)(nil))
+var _ = (fs.NodeGetattrer)((*serviceNode)(nil))
+
+func (n *serviceNode) fetch(ctx context.Context) bool {
+	if n.fetched {
+		return true
+	}
+
+	props, err := n.fs.dev.GetServicePropList(n.info.ServiceID, 0xFFFFFFFF)
+	if err != nil {
+		// Not fatal: the info file just lacks values.
+		log.Printf("GetServicePropList 0x%x failed: %v", n.info.ServiceID, err)
+	}
+	n.AddChild("info.txt", n.NewPersistentInode(ctx,
+		&fs.MemRegularFile{
+			Data: []byte(serviceInfoText(n.info, props)),
+			Attr: fuse.Attr{Mode: 0444},
+		},
+		fs.StableAttr{Ino: n.fs.ino(serviceIno(n.info.ServiceID, 2))}), false)
+
+	var handles []uint32
+	if err := n.fs.dev.WalkServiceObjects(n.info, func(h uint32) error {
+		handles = append(handles, h)
+		return nil
+	}); err != nil {
+		log.Printf("GetObjectHandles for service 0x%x failed: %v", n.info.ServiceID, err)
+		return false
+	}
+	for _, h := range handles {
+		obj := mtp.ObjectInfo{}
+		if err := n.fs.dev.GetObjectInfo(h, &obj); err != nil {
+			log.Printf("GetObjectInfo for handle 0x%x failed: %v", h, err)
+			continue
+		}
+		name := obj.Filename
+		if name == "" || name == "info.txt" || n.GetChild(name) != nil {
+			name = fmt.Sprintf("%s-0x%x", name, h)
+		}
+		n.AddChild(name, n.NewPersistentInode(ctx,
+			&serviceObjectNode{fs: n.fs, handle: h, obj: obj},
+			fs.StableAttr{
+				Mode: syscall.S_IFREG,
+				Ino:  n.fs.ino(serviceObjectIno(h)),
+			}), false)
+	}
+	n.fetched = true
+	return true
+}
+
+func (n *serviceNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	if !n.fetch(ctx) {
+		return nil, syscall.EIO
+	}
+	return readdirChildren(&n.Inode), 0
+}
+
+func (n *serviceNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	if !n.fetch(ctx) {
+		return nil, syscall.EIO
+	}
+	return lookupChild(ctx, &n.Inode, name, out)
+}
+
+func (n *serviceNode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = 0555
+	return 0
+}
+
+// serviceObjectNode is a read-only file backed by a service object,
+// which is fetched completely on open. Service objects (contacts,
+// calendar entries) are small.
+type serviceObjectNode struct {
+	fs.Inode
+	fs     *deviceFS
+	handle uint32
+	obj    mtp.ObjectInfo
+}
+
+var _ = (fs.NodeOpener)((*serviceObjectNode)(nil))
+var _ = (fs.NodeReader)((*serviceObjectNode)(nil))
+var _ = (fs.NodeGetattrer)((*serviceObjectNode)(nil))
+
+func (n *serviceObjectNode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = 0444
+	out.Size = uint64(n.obj.CompressedSize)
+	if f, ok := f.(*serviceObjectFile); ok {
+		out.Size = uint64(len(f.data))
+	}
+	t := n.obj.ModificationDate
+	out.SetTimes(&t, &t, &t)
+	return 0
+}
+
+type serviceObjectFile struct {
+	data []byte
+}
+
+func (n *serviceObjectNode) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR) != 0 {
+		return nil, 0, syscall.EROFS
+	}
+	var buf bytes.Buffer
+	if err := n.fs.dev.GetObject(n.handle, &buf); err != nil {
+		log.Printf("GetObject 0x%x failed: %v", n.handle, err)
+		return nil, 0, syscall.EIO
+	}
+	return &serviceObjectFile{buf.Bytes()}, fuse.FOPEN_DIRECT_IO, 0
+}
+
+func (n *serviceObjectNode) Read(ctx context.Context, f fs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	data := f.(*serviceObjectFile).data
+	if off > int64(len(data)) {
+		off = int64(len(data))
+	}
+	end := off + int64(len(dest))
+	if end > int64(len(data)) {
+		end = int64(len(data))
+	}
+	return fuse.ReadResultData(data[off:end]), 0
+}
+
+func formatGUID(g [16]byte) string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", g[0:4], g[4:6], g[6:8], g[8:10], g[10:16])
+}
+
+// serviceInfoText renders the service description and its property
+// values for info.txt.
+func serviceInfoText(info *mtp.ServiceInfo, props []mtp.ObjectPropValue) string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "ServiceID: 0x%x\n", info.ServiceID)
+	fmt.Fprintf(&b, "Name: %s\n", info.ServiceName)
+	fmt.Fprintf(&b, "GUID: %s\n", formatGUID(info.ServiceGUID))
+	fmt.Fprintf(&b, "PersistentGUID: %s\n", formatGUID(info.ServicePGUID))
+	fmt.Fprintf(&b, "Version: 0x%x\n", info.ServiceVersion)
+	fmt.Fprintf(&b, "Type: %d\n", info.ServiceType)
+	fmt.Fprintf(&b, "Storage: 0x%x\n", info.ServiceStorageID)
+
+	values := map[uint16]interface{}{}
+	for _, p := range props {
+		values[p.PropertyCode] = p.Value
+	}
+	if len(info.Properties) > 0 {
+		fmt.Fprintf(&b, "Properties:\n")
+	}
+	for _, p := range info.Properties {
+		fmt.Fprintf(&b, "  %s (0x%x)", p.Name, p.PropertyCode)
+		if v, ok := values[p.PropertyCode]; ok {
+			fmt.Fprintf(&b, " = %v", v)
+		}
+		fmt.Fprintf(&b, "\n")
+	}
+	if len(info.Formats) > 0 {
+		fmt.Fprintf(&b, "Formats:\n")
+	}
+	for _, f := range info.Formats {
+		fmt.Fprintf(&b, "  %s (0x%x) %s\n", f.Name, f.FormatCode, f.MIMEType)
+	}
+	if len(info.Methods) > 0 {
+		fmt.Fprintf(&b, "Methods:\n")
+	}
+	for _, m := range info.Methods {
+		fmt.Fprintf(&b, "  %s (0x%x)\n", m.Name, m.MethodCode)
+	}
+	if len(info.Events) > 0 {
+		fmt.Fprintf(&b, "Events:\n")
+	}
+	for _, e := range info.Events {
+		fmt.Fprintf(&b, "  %s (0x%x)\n", e.Name, e.EventCode)
+	}
+	return b.String()
+}
+
+func readdirChildren(n *fs.Inode) fs.DirStream {
+	r := []fuse.DirEntry{}
+	for k, ch := range n.Children() {
+		r = append(r, fuse.DirEntry{
+			Mode: ch.Mode(),
+			Name: k,
+			Ino:  ch.StableAttr().Ino,
+		})
+	}
+	return fs.NewListDirStream(r)
+}
+
+func lookupChild(ctx context.Context, n *fs.Inode, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	ch := n.GetChild(name)
+	if ch == nil {
+		return nil, syscall.ENOENT
+	}
+	var code syscall.Errno
+	if ga, ok := ch.Operations().(fs.NodeGetattrer); ok {
+		var attr fuse.AttrOut
+		code = ga.Getattr(ctx, nil, &attr)
+		out.Attr = attr.Attr
+	}
+	return ch, code
+}
@@ -0,0 +1,91 @@
+package fs
+
+import (
+	"log"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-mtpfs/mtp"
+)
+
+// Free space of storages. File managers call statfs constantly, so
+// the StorageInfo is cached. It is fetched again after the device
+// reports a change, after writes, and once it is statfsTTL old, as
+// many devices do not report changes made on the device.
+
+const statfsTTL = time.Minute
+
+// noObjects marks an unknown object count.
+const noObjects = 0xFFFFFFFF
+
+type storageStat struct {
+	info mtp.StorageInfo
+	// objects is the number of objects in the storage, or
+	// noObjects.
+	objects uint32
+	fetched time.Time
+	// stale is set after a write to the storage.
+	stale bool
+}
+
+// fill sets the statfs numbers for the storage. If the device does
+// not count free objects, every free block counts as one.
+func (s *storageStat) fill(out *fuse.StatfsOut) {
+	free := s.info.FreeSpaceInBytes / blockSize
+	ffree := uint64(s.info.FreeSpaceInImages)
+	if s.info.FreeSpaceInImages == 0xFFFFFFFF {
+		ffree = free
+	}
+	files := ffree
+	if s.objects != noObjects {
+		files += uint64(s.objects)
+	}
+	*out = fuse.StatfsOut{
+		Bsize:  blockSize,
+		Blocks: s.info.MaxCapability / blockSize,
+		Bavail: free,
+		Bfree:  free,
+		Files:  files,
+		Ffree:  ffree,
+	}
+}
+
+// storageChanged marks the cached StorageInfo as stale after a
+// write. It is kept in case fetching it again fails.
+func (fs *deviceFS) storageChanged(sid uint32) {
+	if s := fs.stats[sid]; s != nil {
+		s.stale = true
+	}
+}
+
+// storageStat returns the statfs state of a storage. If the device
+// fails, it returns the last known state, if any.
+func (fs *deviceFS) storageStat(sid uint32) (*storageStat, error) {
+	s := fs.stats[sid]
+	if fs.takeStale(sid) || s != nil && (s.stale || time.Since(s.fetched) > statfsTTL) {
+		s = nil
+	}
+	if s != nil {
+		return s, nil
+	}
+
+	s = &storageStat{objects: noObjects, fetched: time.Now()}
+	if err := fs.dev.GetStorageInfo(sid, &s.info); err != nil {
+		if old := fs.stats[sid]; old != nil {
+			log.Printf("GetStorageInfo %x: %v; using cached numbers", sid, err)
+			return old, nil
+		}
+		return nil, err
+	}
+	if fs.devInfo.HasOperation(mtp.OC_GetNumObjects) {
+		// Handle 0 counts all objects of the storage.
+		n, err := fs.dev.GetNumObjects(sid, 0, 0)
+		if err != nil {
+			log.Printf("GetNumObjects %x: %v", sid, err)
+		} else {
+			s.objects = n
+		}
+	}
+	fs.stats[sid] = s
+	return s, nil
+}
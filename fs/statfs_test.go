@@ -0,0 +1,67 @@
+package fs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-mtpfs/mtp"
+)
+
+func TestStatfsFill(t *testing.T) {
+	s := storageStat{
+		info: mtp.StorageInfo{
+			MaxCapability:     1 << 30,
+			FreeSpaceInBytes:  1 << 20,
+			FreeSpaceInImages: 100,
+		},
+		objects: 50,
+	}
+	var out fuse.StatfsOut
+	s.fill(&out)
+	want := fuse.StatfsOut{
+		Bsize:  blockSize,
+		Blocks: 1 << 30 / blockSize,
+		Bfree:  1 << 20 / blockSize,
+		Bavail: 1 << 20 / blockSize,
+		Files:  150,
+		Ffree:  100,
+	}
+	if out != want {
+		t.Errorf("got %+v, want %+v", out, want)
+	}
+
+	s.info.FreeSpaceInImages = 0xFFFFFFFF
+	s.objects = noObjects
+	s.fill(&out)
+	if out.Ffree != out.Bfree || out.Files != out.Ffree {
+		t.Errorf("without counts: got %+v", out)
+	}
+}
+
+func TestStatfsEvents(t *testing.T) {
+	fs := &deviceFS{
+		dev:      &mtp.Device{},
+		storages: []uint32{1, 2},
+		stats: map[uint32]*storageStat{
+			1: {fetched: time.Now()},
+			2: {fetched: time.Now()},
+		},
+	}
+	fs.events.staleInfo = map[uint32]bool{}
+
+	fs.handleEvent(&mtp.Event{Code: mtp.EC_StorageInfoChanged, Param: []uint32{2}})
+	if fs.takeStale(1) || !fs.takeStale(2) || fs.takeStale(2) {
+		t.Errorf("StorageInfoChanged for 2: got %v", fs.events.staleInfo)
+	}
+
+	fs.handleEvent(&mtp.Event{Code: mtp.EC_ObjectAdded, Param: []uint32{0x1234}})
+	if !fs.takeStale(1) || !fs.takeStale(2) {
+		t.Errorf("ObjectAdded did not mark all storages")
+	}
+
+	fs.storageChanged(1)
+	if fs.stats[1] == nil || !fs.stats[1].stale || fs.stats[2].stale {
+		t.Errorf("storageChanged(1): got %v", fs.stats)
+	}
+}
@@ -0,0 +1,134 @@
+package fs
+
+import (
+	"context"
+	"log"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-mtpfs/mtp"
+)
+
+// Storages come and go while mounted, as SD cards are inserted and
+// ejected. The event reader records EC_StoreAdded and
+// EC_StoreRemoved, and the root applies them when it is next listed
+// or looked up.
+
+// storeChange is a storage added or removed.
+type storeChange struct {
+	sid   uint32
+	added bool
+}
+
+// setupStorage sets the per-storage options.
+func (fs *deviceFS) setupStorage(sid uint32, info *mtp.StorageInfo) {
+	fs.mungeVfat[sid] = info.IsRemovable() && fs.options.RemovableVFat
+	if m, ok := fs.options.StorageMasks[info.StorageDescription]; ok {
+		fs.storageMasks[sid] = m
+	} else {
+		delete(fs.storageMasks, sid)
+	}
+}
+
+// addStorage adds the directory for a storage to the root.
+func (dfs *deviceFS) addStorage(ctx context.Context, sid uint32, info *mtp.StorageInfo) {
+	obj := mtp.ObjectInfo{
+		ParentObject: NOPARENT_ID,
+		StorageID:    sid,
+		Filename:     info.StorageDescription,
+	}
+	folder := dfs.newFolder(obj, NOPARENT_ID)
+	// Numbers are not reused, as the kernel may still know the
+	// inodes of a removed storage.
+	dfs.storageCount++
+	stable := fs.StableAttr{
+		Mode: syscall.S_IFDIR,
+		Ino:  dfs.ino(dfs.storageCount << 33),
+	}
+	dfs.root.Inode.AddChild(info.StorageDescription,
+		dfs.root.Inode.NewPersistentInode(ctx, folder, stable),
+		false)
+}
+
+// storageIndex returns the index of a storage in fs.storages, or -1.
+func (fs *deviceFS) storageIndex(sid uint32) int {
+	for i, s := range fs.storages {
+		if s == sid {
+			return i
+		}
+	}
+	return -1
+}
+
+func (fs *deviceFS) storageAdded(ctx context.Context, sid uint32) {
+	if fs.storageIndex(sid) >= 0 {
+		return
+	}
+	var info mtp.StorageInfo
+	if err := fs.dev.GetStorageInfo(sid, &info); err != nil {
+		log.Printf("GetStorageInfo %x: %v", sid, err)
+		return
+	}
+	if !storageSelected(&info, fs.storageFilter) {
+		return
+	}
+	log.Printf("storage %q added", info.StorageDescription)
+	fs.storages = append(fs.storages, sid)
+	fs.setupStorage(sid, &info)
+	fs.addStorage(ctx, sid, &info)
+}
+
+func (fs *deviceFS) storageRemoved(sid uint32) {
+	i := fs.storageIndex(sid)
+	if i < 0 {
+		return
+	}
+	fs.storages = append(fs.storages[:i], fs.storages[i+1:]...)
+	delete(fs.mungeVfat, sid)
+	delete(fs.storageMasks, sid)
+	delete(fs.stats, sid)
+	for name, ch := range fs.root.Children() {
+		if f, ok := ch.Operations().(*folderNode); ok && f.StorageID() == sid && f.Handle() == NOPARENT_ID {
+			log.Printf("storage %q removed", name)
+			fs.root.RmChild(name)
+		}
+	}
+}
+
+// applyStoreChanges adds and removes storages as the device reported.
+func (fs *deviceFS) applyStoreChanges(ctx context.Context) {
+	fs.events.mu.Lock()
+	changes := fs.events.stores
+	fs.events.stores = nil
+	fs.events.mu.Unlock()
+
+	for _, c := range changes {
+		if c.added {
+			fs.storageAdded(ctx, c.sid)
+		} else {
+			fs.storageRemoved(c.sid)
+		}
+	}
+}
+
+// storageGone returns whether a storage was removed, even if the
+// root has not caught up yet.
+func (fs *deviceFS) storageGone(sid uint32) bool {
+	fs.events.mu.Lock()
+	defer fs.events.mu.Unlock()
+	for _, c := range fs.events.stores {
+		if c.sid == sid && !c.added {
+			return true
+		}
+	}
+	return fs.storageIndex(sid) < 0
+}
+
+// ioError returns the error for a failed device operation on the
+// node: ENODEV if its storage was removed, and EIO otherwise.
+func (n *mtpNodeImpl) ioError() syscall.Errno {
+	if n.fs.storageGone(n.StorageID()) {
+		return syscall.ENODEV
+	}
+	return syscall.EIO
+}
@@ -0,0 +1,46 @@
+package fs
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-mtpfs/mtp"
+)
+
+func TestStorageGone(t *testing.T) {
+	fs := &deviceFS{
+		dev:      &mtp.Device{},
+		storages: []uint32{0x10001, 0x20001},
+	}
+	fs.events.staleInfo = map[uint32]bool{}
+
+	fs.handleEvent(&mtp.Event{Code: mtp.EC_StoreRemoved, Param: []uint32{0x20001}})
+	fs.handleEvent(&mtp.Event{Code: mtp.EC_StoreAdded, Param: []uint32{0x20001}})
+	if fs.storageGone(0x10001) {
+		t.Errorf("storage 0x10001 gone")
+	}
+	// Until the root catches up, nodes belong to the removed
+	// storage.
+	if !fs.storageGone(0x20001) {
+		t.Errorf("removed storage 0x20001 not gone")
+	}
+	if !fs.storageGone(0x30001) {
+		t.Errorf("unknown storage 0x30001 not gone")
+	}
+	want := []storeChange{{0x20001, false}, {0x20001, true}}
+	if len(fs.events.stores) != 2 || fs.events.stores[0] != want[0] || fs.events.stores[1] != want[1] {
+		t.Errorf("got changes %v, want %v", fs.events.stores, want)
+	}
+}
+
+func TestToErrnoStorage(t *testing.T) {
+	for err, want := range map[error]syscall.Errno{
+		mtp.RCError(mtp.RC_StoreNotAvailable): syscall.ENODEV,
+		mtp.RCError(mtp.RC_InvalidStorageId):  syscall.ENODEV,
+		mtp.RCError(mtp.RC_GeneralError):      syscall.EIO,
+	} {
+		if got := toErrno("op", err); got != want {
+			t.Errorf("toErrno(%v) = %v, want %v", err, got, want)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package fs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/hanwen/go-mtpfs/mtp"
+)
+
+// Verification of transfers. Flaky USB hubs can truncate transfers
+// without either side noticing, so sent files can be read back, and
+// their hashes kept for later checks.
+
+// VerifyMode selects how transfers are checked.
+type VerifyMode int
+
+const (
+	// VerifyOff trusts the transfers.
+	VerifyOff VerifyMode = iota
+	// VerifySample reads back a few ranges of sent files, and
+	// checks the size of fetched files.
+	VerifySample
+	// VerifyFull also reads back sent files completely, and
+	// compares their hashes.
+	VerifyFull
+)
+
+var verifyModeNames = []string{"off", "sample", "full"}
+
+func (m VerifyMode) String() string {
+	if int(m) < len(verifyModeNames) {
+		return verifyModeNames[m]
+	}
+	return fmt.Sprintf("VerifyMode(%d)", int(m))
+}
+
+func ParseVerifyMode(s string) (VerifyMode, error) {
+	for i, n := range verifyModeNames {
+		if s == n {
+			return VerifyMode(i), nil
+		}
+	}
+	return VerifyOff, fmt.Errorf("unknown verify mode %q; want one of %s", s, strings.Join(verifyModeNames, ", "))
+}
+
+// HashEntry records the contents of a file.
+type HashEntry struct {
+	Size int64
+	// Hash is the hex SHA-1 of the contents.
+	Hash string
+	// Verified is when the contents were last read back from the
+	// device completely. It is zero for files that were only
+	// sampled.
+	Verified time.Time
+}
+
+// HashDB holds the hashes of the files on a device, keyed by their
+// path in the mount, STORAGE/dir/file. It is not safe for concurrent
+// use.
+type HashDB struct {
+	Device  string
+	Entries map[string]*HashEntry
+
+	name string
+}
+
+var unsafeChars = regexp.MustCompile("[^a-zA-Z0-9_.-]+")
+
+// HashDBName returns the file for the hashes of a device, given its
+// ID, in dir.
+func HashDBName(dir, device string) string {
+	return filepath.Join(dir, "hashes-"+unsafeChars.ReplaceAllString(device, "_")+".json")
+}
+
+// LoadHashDB reads the hashes from a file. A missing file gives an
+// empty HashDB.
+func LoadHashDB(name, device string) (*HashDB, error) {
+	db := &HashDB{name: name}
+	data, err := ioutil.ReadFile(name)
+	if err == nil {
+		err = json.Unmarshal(data, db)
+		if err == nil && db.Device != device {
+			err = fmt.Errorf("hashes are for device %q", db.Device)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	db.Device = device
+	if db.Entries == nil {
+		db.Entries = map[string]*HashEntry{}
+	}
+	return db, nil
+}
+
+func (db *HashDB) Save() error {
+	data, err := json.MarshalIndent(db, "", " ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(db.name), 0755); err != nil {
+		return err
+	}
+	tmp := db.name + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, db.name)
+}
+
+func (db *HashDB) Set(p string, e *HashEntry) {
+	db.Entries[p] = e
+}
+
+// under returns whether q is p or below it.
+func under(q, p string) bool {
+	return q == p || strings.HasPrefix(q, p+"/")
+}
+
+// Remove drops p and everything below it.
+func (db *HashDB) Remove(p string) {
+	for q := range db.Entries {
+		if under(q, p) {
+			delete(db.Entries, q)
+		}
+	}
+}
+
+// Rename moves the entries for p and everything below it to newPath.
+func (db *HashDB) Rename(p, newPath string) {
+	for q, e := range db.Entries {
+		if under(q, p) {
+			delete(db.Entries, q)
+			db.Entries[newPath+q[len(p):]] = e
+		}
+	}
+}
+
+// sampleSize is the size of the ranges read back by VerifySample.
+const sampleSize = 64 << 10
+
+type sampleRange struct {
+	off, n int64
+}
+
+// sampleRanges returns the ranges to read back from a file: the
+// start, the end, and two in between. Small files are read whole.
+func sampleRanges(size int64) []sampleRange {
+	if size <= 4*sampleSize {
+		return []sampleRange{{0, size}}
+	}
+	last := size - sampleSize
+	return []sampleRange{{0, sampleSize}, {last / 3, sampleSize}, {2 * last / 3, sampleSize}, {last, sampleSize}}
+}
+
+// verifySample compares ranges of a sent object with the local file.
+func (fs *deviceFS) verifySample(handle uint32, local *os.File, size int64) error {
+	return CompareSample(fs.dev, handle, local, size, fs.androidExt)
+}
+
+// CompareSample compares a few ranges of an object with a local copy
+// of size bytes, as VerifySample does. Android is set if the device
+// has the Android extensions, which reach beyond 4 GiB.
+func CompareSample(dev *mtp.Device, handle uint32, local io.ReaderAt, size int64, android bool) error {
+	for _, r := range sampleRanges(size) {
+		want := make([]byte, r.n)
+		if _, err := local.ReadAt(want, r.off); err != nil {
+			return err
+		}
+		var got bytes.Buffer
+		var err error
+		if r.off+r.n <= 0xFFFFFFFF {
+			err = dev.GetPartialObject(handle, &got, uint32(r.off), uint32(r.n))
+		} else if android {
+			err = dev.AndroidGetPartialObject64(handle, &got, r.off, uint32(r.n))
+		} else {
+			// Out of reach for GetPartialObject.
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("reading back at %d: %v", r.off, err)
+		}
+		if !bytes.Equal(got.Bytes(), want) {
+			return fmt.Errorf("%d bytes at %d differ from the local copy", r.n, r.off)
+		}
+	}
+	return nil
+}
+
+// recordHash stores the hash of a sent file. Verified is set if the
+// file was read back completely.
+func (fs *deviceFS) recordHash(p string, size int64, sum string, verified bool) {
+	if fs.hashes == nil {
+		return
+	}
+	e := &HashEntry{Size: size, Hash: sum}
+	if verified {
+		e.Verified = time.Now()
+	}
+	fs.hashes.Set(p, e)
+	fs.saveHashes()
+}
+
+func (fs *deviceFS) saveHashes() {
+	if err := fs.hashes.Save(); err != nil {
+		log.Printf("saving hashes: %v", err)
+	}
+}
@@ -0,0 +1,67 @@
+package fs
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseVerifyMode(t *testing.T) {
+	for _, m := range []VerifyMode{VerifyOff, VerifySample, VerifyFull} {
+		if got, err := ParseVerifyMode(m.String()); got != m || err != nil {
+			t.Errorf("ParseVerifyMode(%q) = %v, %v", m.String(), got, err)
+		}
+	}
+	if _, err := ParseVerifyMode("yes"); err == nil {
+		t.Error("unknown mode accepted")
+	}
+}
+
+func TestHashDB(t *testing.T) {
+	name := HashDBName(t.TempDir(), "Google/Pixel 3/8ABX0Y")
+	if got := filepath.Base(name); got != "hashes-Google_Pixel_3_8ABX0Y.json" {
+		t.Errorf("HashDBName: got %q", got)
+	}
+	db, err := LoadHashDB(name, "dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Set("Phone/Music/a.mp3", &HashEntry{Size: 1, Hash: "a"})
+	db.Set("Phone/Music/b.mp3", &HashEntry{Size: 2, Hash: "b"})
+	db.Set("Phone/Musical.txt", &HashEntry{Size: 3, Hash: "c"})
+	db.Rename("Phone/Music", "Phone/Songs")
+	db.Remove("Phone/Songs/b.mp3")
+	if err := db.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = LoadHashDB(name, "dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for p := range db.Entries {
+		got = append(got, p)
+	}
+	if len(got) != 2 || db.Entries["Phone/Songs/a.mp3"] == nil || db.Entries["Phone/Musical.txt"] == nil {
+		t.Errorf("got entries %v", got)
+	}
+	if _, err := LoadHashDB(name, "other"); err == nil {
+		t.Error("hashes of another device accepted")
+	}
+}
+
+func TestSampleRanges(t *testing.T) {
+	if got, want := sampleRanges(1000), []sampleRange{{0, 1000}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("small file: got %v, want %v", got, want)
+	}
+	size := int64(1 << 20)
+	got := sampleRanges(size)
+	if len(got) != 4 || got[0].off != 0 {
+		t.Fatalf("got %v", got)
+	}
+	last := got[len(got)-1]
+	if last.off+last.n != size {
+		t.Errorf("last range %v does not end at %d", last, size)
+	}
+}
@@ -0,0 +1,241 @@
+package fs
+
+import (
+	"strings"
+	"syscall"
+)
+
+// Names on removable storages, which are assumed to be VFAT. VFAT
+// forbids some characters, trailing dots and spaces, and device names
+// such as CON; it also compares names without regard to case.
+//
+// Names are mapped reversibly. Forbidden characters become their
+// fullwidth forms (":" is "："), as do trailing dots and spaces, and
+// the last letter of a device name ("CON.txt" is "COＮ.txt"). Where
+// the original name has such characters, they are quoted with "‛".
+
+const vfatQuote = '‛'
+
+// vfatForbidden are the characters VFAT does not allow, besides
+// control characters.
+const vfatForbidden = "\\:*?\"<>|"
+
+var vfatReserved = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// Substitutes for trailing characters.
+const (
+	vfatDot   = '．'
+	vfatSpace = '　'
+)
+
+// fullwidth returns the fullwidth form of a printable ASCII character.
+func fullwidth(r rune) rune {
+	return r + 0xFEE0
+}
+
+func narrow(r rune) rune {
+	return r - 0xFEE0
+}
+
+func isFullwidth(r rune) bool {
+	return r >= fullwidth('!') && r <= fullwidth('~')
+}
+
+// vfatSubstitute returns the substitute for a forbidden character.
+// Control characters become control pictures.
+func vfatSubstitute(r rune) (rune, bool) {
+	if r < 0x20 {
+		return 0x2400 + r, true
+	}
+	if strings.ContainsRune(vfatForbidden, r) {
+		return fullwidth(r), true
+	}
+	return r, false
+}
+
+// vfatOriginal is the inverse of vfatSubstitute.
+func vfatOriginal(r rune) (rune, bool) {
+	if r >= 0x2400 && r < 0x2420 {
+		return r - 0x2400, true
+	}
+	if isFullwidth(r) && strings.ContainsRune(vfatForbidden, narrow(r)) {
+		return narrow(r), true
+	}
+	return r, false
+}
+
+// trailingStart returns where the trailing dots and spaces start,
+// counting their substitutes.
+func trailingStart(rs []rune) int {
+	i := len(rs)
+	for i > 0 && strings.ContainsRune(". "+string(vfatDot)+string(vfatSpace), rs[i-1]) {
+		i--
+	}
+	return i
+}
+
+// stemEnd returns the length of the name before the first dot.
+func stemEnd(rs []rune) int {
+	for i, r := range rs {
+		if r == '.' {
+			return i
+		}
+	}
+	return len(rs)
+}
+
+// vfatEncode returns the device name for a name in the mount.
+func vfatEncode(name string) string {
+	rs := []rune(name)
+	trail := trailingStart(rs)
+	stem := stemEnd(rs)
+	// reservedAt is the index of a last letter to substitute, or
+	// to quote if it is fullwidth already.
+	reservedAt := -1
+	if stem > 0 {
+		s := strings.ToUpper(string(rs[:stem]))
+		if vfatReserved[s] {
+			reservedAt = stem - 1
+		} else if last := rs[stem-1]; isFullwidth(last) &&
+			vfatReserved[strings.ToUpper(string(rs[:stem-1])+string(narrow(last)))] {
+			reservedAt = stem - 1
+		}
+	}
+
+	var b strings.Builder
+	for i, r := range rs {
+		switch {
+		case r == vfatQuote:
+			b.WriteRune(vfatQuote)
+		case i == reservedAt && isFullwidth(r):
+			b.WriteRune(vfatQuote)
+		case i == reservedAt:
+			r = fullwidth(r)
+		case i >= trail && r == '.':
+			r = vfatDot
+		case i >= trail && r == ' ':
+			r = vfatSpace
+		case i >= trail && (r == vfatDot || r == vfatSpace):
+			b.WriteRune(vfatQuote)
+		default:
+			if s, ok := vfatSubstitute(r); ok {
+				r = s
+			} else if _, ok := vfatOriginal(r); ok {
+				b.WriteRune(vfatQuote)
+			}
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// vfatDecode returns the name in the mount for a device name. It is
+// the inverse of vfatEncode.
+func vfatDecode(name string) string {
+	var rs []rune
+	var quoted []bool
+	q := false
+	for _, r := range name {
+		if r == vfatQuote && !q {
+			q = true
+			continue
+		}
+		rs = append(rs, r)
+		quoted = append(quoted, q)
+		q = false
+	}
+
+	for i := trailingStart(rs); i < len(rs); i++ {
+		if quoted[i] {
+			continue
+		}
+		switch rs[i] {
+		case vfatDot:
+			rs[i] = '.'
+		case vfatSpace:
+			rs[i] = ' '
+		}
+	}
+	for i, r := range rs {
+		if o, ok := vfatOriginal(r); ok && !quoted[i] {
+			rs[i] = o
+		}
+	}
+	if stem := stemEnd(rs); stem > 0 && !quoted[stem-1] && isFullwidth(rs[stem-1]) {
+		s := string(rs[:stem-1]) + string(narrow(rs[stem-1]))
+		if vfatReserved[strings.ToUpper(s)] {
+			rs[stem-1] = narrow(rs[stem-1])
+		}
+	}
+	return string(rs)
+}
+
+// deviceName returns the name on the device for a name in the mount
+// of a storage.
+func (fs *deviceFS) deviceName(sid uint32, name string) (string, syscall.Errno) {
+	if fs.mungeVfat[sid] {
+		name = vfatEncode(name)
+	}
+	return name, checkName(name)
+}
+
+// VfatName returns the name the mount shows for a device name on a
+// VFAT storage.
+func VfatName(name string) string {
+	return vfatDecode(name)
+}
+
+// mountName returns the name in the mount for a device name.
+func (fs *deviceFS) mountName(sid uint32, name string) string {
+	if fs.mungeVfat[sid] {
+		return vfatDecode(name)
+	}
+	return name
+}
+
+// vfatCollision returns EEXIST if the folder has a child whose name
+// differs from name only in case, other than the child called skip.
+// VFAT would take them for the same file.
+func (n *folderNode) vfatCollision(name, skip string) syscall.Errno {
+	if !n.fs.mungeVfat[n.StorageID()] {
+		return 0
+	}
+	for k := range n.Children() {
+		if k != name && k != skip && !n.aliases[k] && strings.EqualFold(k, name) {
+			return syscall.EEXIST
+		}
+	}
+	return 0
+}
+
+// foldName returns the name of the child that VFAT takes name for:
+// name itself if it exists, or a name that differs only in case.
+// Elsewhere, or if there is none, it returns name.
+func (n *folderNode) foldName(name string) string {
+	if !n.fs.mungeVfat[n.StorageID()] || n.GetChild(name) != nil && !n.aliases[name] {
+		return name
+	}
+	for k := range n.Children() {
+		if !n.aliases[k] && strings.EqualFold(k, name) {
+			return k
+		}
+	}
+	return name
+}
+
+// dropAliases removes the names that lookups added for other
+// spellings of a child, except keep.
+func (n *folderNode) dropAliases(keep string) {
+	for a := range n.aliases {
+		if a != keep {
+			n.RmChild(a)
+		}
+	}
+	n.aliases = nil
+}
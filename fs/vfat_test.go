@@ -0,0 +1,90 @@
+package fs
+
+import (
+	"context"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-mtpfs/mtp"
+)
+
+func TestVfatEncode(t *testing.T) {
+	for in, want := range map[string]string{
+		"song.mp3":     "song.mp3",
+		"a:b?.txt":     "a：b？.txt",
+		"trailing. .":  "trailing．　．",
+		"CON":          "COＮ",
+		"nul.tar.gz":   "nuｌ.tar.gz",
+		"console.txt":  "console.txt",
+		"x：y.txt":      "x‛：y.txt",
+		"it‛s":         "it‛‛s",
+		"COＮ.txt":      "CO‛Ｎ.txt",
+		"dots..middle": "dots..middle",
+	} {
+		if got := vfatEncode(in); got != want {
+			t.Errorf("vfatEncode(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestVfatRoundtrip(t *testing.T) {
+	for _, name := range []string{
+		"song.mp3", "a:b?.txt", "trailing. .", "CON", "con.", "Lpt9.log",
+		"x：y.txt", "it‛s", "‛", "‛‛.", "COＮ.txt", "end．", "end‛．", "tab\there",
+		"␉", ".hidden", "...", " ", "日本　語", "x\\y|z\"<>*",
+	} {
+		enc := vfatEncode(name)
+		if got := vfatDecode(enc); got != name {
+			t.Errorf("vfatDecode(vfatEncode(%q)) = %q via %q", name, got, enc)
+		}
+		if strings.ContainsAny(enc, vfatForbidden+"\t") {
+			t.Errorf("vfatEncode(%q) = %q has forbidden characters", name, enc)
+		}
+		if strings.HasSuffix(enc, ".") || strings.HasSuffix(enc, " ") {
+			t.Errorf("vfatEncode(%q) = %q has trailing dot or space", name, enc)
+		}
+		stem := strings.ToUpper(strings.SplitN(enc, ".", 2)[0])
+		if vfatReserved[stem] {
+			t.Errorf("vfatEncode(%q) = %q is reserved", name, enc)
+		}
+	}
+}
+
+func TestFoldName(t *testing.T) {
+	dfs := &deviceFS{mungeVfat: map[uint32]bool{0x20001: true}}
+	n := dfs.newFolder(mtp.ObjectInfo{StorageID: 0x20001}, 5)
+	fs.NewNodeFS(n, &fs.Options{})
+	ctx := context.Background()
+	for _, name := range []string{"README.txt", "Music"} {
+		ch := dfs.newFolder(mtp.ObjectInfo{StorageID: 0x20001, Filename: name}, 6)
+		n.AddChild(name, n.NewPersistentInode(ctx, ch, fs.StableAttr{Mode: syscall.S_IFDIR}), true)
+	}
+	n.aliases = map[string]bool{"music": true}
+	n.AddChild("music", n.GetChild("Music"), true)
+
+	for in, want := range map[string]string{
+		"README.txt": "README.txt",
+		"readme.TXT": "README.txt",
+		"music":      "Music",
+		"other":      "other",
+	} {
+		if got := n.foldName(in); got != want {
+			t.Errorf("foldName(%q) = %q, want %q", in, got, want)
+		}
+	}
+	if errno := n.vfatCollision("MUSIC", "Music"); errno != 0 {
+		t.Errorf("vfatCollision counts aliases: %v", errno)
+	}
+
+	n.dropAliases("")
+	if n.GetChild("music") != nil || n.GetChild("Music") == nil {
+		t.Errorf("dropAliases: got children %v", n.Children())
+	}
+
+	dfs.mungeVfat = nil
+	if got := n.foldName("readme.txt"); got != "readme.txt" {
+		t.Errorf("foldName folds case on MTP storage: %q", got)
+	}
+}
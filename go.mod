@@ -1,11 +1,18 @@
 module github.com/hanwen/go-mtpfs
 
-go 1.12
+go 1.18
 
 require (
 	github.com/hanwen/go-fuse v1.0.0
 	github.com/hanwen/go-fuse/v2 v2.0.2
 	github.com/hanwen/usb v0.0.0-20141217151552-69aee4530ac7
+	github.com/pkg/sftp v1.13.6
+	golang.org/x/crypto v0.14.0
+	golang.org/x/net v0.17.0
+)
+
+require (
+	github.com/kr/fs v0.1.0 // indirect
 	github.com/kylelemons/godebug v1.1.0 // indirect
-	golang.org/x/sys v0.0.0-20190826190057-c7b8b68b1456 // indirect
+	golang.org/x/sys v0.13.0 // indirect
 )
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hanwen/go-mtpfs/fs"
+	"github.com/hanwen/go-mtpfs/mtp"
+)
+
+// Camera-style import of photos from the DCIM folders of a device.
+
+const dcimFolder = "DCIM"
+
+// importDB records the objects that were imported, so they are
+// skipped next time, even if the files were moved or deleted locally.
+type importDB struct {
+	// Imported maps object keys to the local path, relative to the
+	// destination.
+	Imported map[string]string
+}
+
+func loadImportDB(name string) (*importDB, error) {
+	db := &importDB{}
+	data, err := ioutil.ReadFile(name)
+	if err == nil {
+		if err := json.Unmarshal(data, db); err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if db.Imported == nil {
+		db.Imported = map[string]string{}
+	}
+	return db, nil
+}
+
+func (db *importDB) save(name string) error {
+	data, err := json.MarshalIndent(db, "", " ")
+	if err != nil {
+		return err
+	}
+	tmp := name + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// importKey identifies an object across sessions. Handles are not
+// stable on all devices, so it uses the persistent unique ID if the
+// device has one, and the name, size and date otherwise.
+func importKey(serial string, uid []byte, info *mtp.ObjectInfo, size int64) string {
+	if uid != nil {
+		return serial + "/uid:" + hex.EncodeToString(uid)
+	}
+	date := info.CaptureDate
+	if date.IsZero() {
+		date = info.ModificationDate
+	}
+	return fmt.Sprintf("%s/%s/%d/%s", serial, info.Filename, size, date.Format("20060102T150405"))
+}
+
+// expandTemplate fills in YYYY, MM, DD, hh and mm in the template.
+func expandTemplate(tmpl string, t time.Time) string {
+	return strings.NewReplacer(
+		"YYYY", t.Format("2006"),
+		"MM", t.Format("01"),
+		"DD", t.Format("02"),
+		"hh", t.Format("15"),
+		"mm", t.Format("04"),
+	).Replace(tmpl)
+}
+
+// freeName returns a name in dir that does not exist yet, based on
+// name.
+func freeName(dir, name string) string {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(filepath.Join(dir, name)); os.IsNotExist(err) {
+			return name
+		}
+		name = fmt.Sprintf("%s_%d%s", base, i, ext)
+	}
+}
+
+type importer struct {
+	r        *remote
+	dest     string
+	template string
+	dryRun   bool
+	delete   bool
+	quiet    bool
+
+	serial string
+	// partial and android tell how ranges of objects can be read.
+	partial bool
+	android bool
+	db      *importDB
+	dbName  string
+}
+
+// uid returns the persistent unique ID of an object, or nil. It is
+// asked for each object, so the key of an object does not depend on
+// failures for others.
+func (im *importer) uid(o *remoteObject) []byte {
+	var val mtp.Uint128Value
+	if err := im.r.dev.GetObjectPropValue(o.Handle, mtp.OPC_PersistantUniqueObjectIdentifier, &val); err != nil {
+		return nil
+	}
+	return val.Value[:]
+}
+
+func (im *importer) walk(dir *remoteObject) error {
+	chs, err := im.r.children(dir)
+	if err != nil {
+		return err
+	}
+	for _, ch := range chs {
+		if strings.HasPrefix(ch.Info.Filename, ".") {
+			// Thumbnail caches and the like.
+			continue
+		}
+		if ch.IsDir() {
+			err = im.walk(ch)
+		} else {
+			err = im.importFile(ch)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (im *importer) importFile(o *remoteObject) error {
+	key := importKey(im.serial, im.uid(o), &o.Info, o.Size)
+	if _, ok := im.db.Imported[key]; ok {
+		return nil
+	}
+
+	date := o.Info.CaptureDate
+	if date.IsZero() {
+		date = o.Info.ModificationDate
+	}
+	dir := "undated"
+	if !date.IsZero() {
+		dir = expandTemplate(im.template, date)
+	}
+	localDir := filepath.Join(im.dest, filepath.FromSlash(dir))
+	name := freeName(localDir, o.Info.Filename)
+	rel := path.Join(dir, name)
+	fmt.Printf("import %s %s\n", o.Path, rel)
+	if im.dryRun {
+		return nil
+	}
+
+	if err := os.MkdirAll(localDir, 0755); err != nil {
+		return err
+	}
+	local := filepath.Join(localDir, name)
+	sum, err := im.copy(o, local)
+	if err != nil {
+		return err
+	}
+	// Save as we go, so an interrupted import is not repeated.
+	im.db.Imported[key] = rel
+	if err := im.db.save(im.dbName); err != nil {
+		return err
+	}
+
+	if im.delete {
+		if err := im.checkCopy(o, local, sum); err != nil {
+			return fmt.Errorf("%v; not deleting %s", err, o.Path)
+		}
+		if err := im.r.deleteObject(o.Handle, o.Path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkCopy compares the copy of o with the device before o is
+// deleted. The copy must read back with the SHA-1 of the data
+// received, and ranges read again from the device must match it. A
+// device without partial reads sends the whole object again.
+func (im *importer) checkCopy(o *remoteObject, local, sum string) error {
+	if got, err := hashFile(local); err != nil {
+		return err
+	} else if got != sum {
+		return fmt.Errorf("%s: SHA-1 %s, received %s", local, got, sum)
+	}
+	if !im.partial {
+		h := sha1.New()
+		if err := im.r.dev.GetObject(o.Handle, h); err != nil {
+			return fmt.Errorf("reading back %s: %v", o.Path, err)
+		}
+		if got := hex.EncodeToString(h.Sum(nil)); got != sum {
+			return fmt.Errorf("%s: read back SHA-1 %s, received %s", o.Path, got, sum)
+		}
+		return nil
+	}
+	f, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := fs.CompareSample(im.r.dev, o.Handle, f, o.Size, im.android); err != nil {
+		return fmt.Errorf("reading back %s: %v", o.Path, err)
+	}
+	return nil
+}
+
+// copy fetches o into a new file, and checks that all data arrived
+// before giving it its final name. It returns the SHA-1 of the data.
+func (im *importer) copy(o *remoteObject, dest string) (string, error) {
+	tmp := dest + ".part"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return "", err
+	}
+	h := sha1.New()
+	p := newProgress(o.Path, o.Size, im.quiet)
+	err = im.r.dev.GetObject(o.Handle, &progressWriter{io.MultiWriter(f, h), p})
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && p.done != o.Size {
+		err = fmt.Errorf("got %d bytes, want %d", p.done, o.Size)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", fmt.Errorf("GetObject %s: %v", o.Path, err)
+	}
+	p.finish()
+
+	os.Chtimes(tmp, o.Info.ModificationDate, o.Info.ModificationDate)
+	return hex.EncodeToString(h.Sum(nil)), os.Rename(tmp, dest)
+}
+
+func cmdImport(c *deviceConfig, args []string) error {
+	fl := flag.NewFlagSet("import", flag.ContinueOnError)
+	im := &importer{}
+	fl.StringVar(&im.template, "template", "YYYY/MM/DD", "directory layout by capture date; YYYY, MM, DD, hh and mm are replaced")
+	fl.BoolVar(&im.dryRun, "n", false, "only print what would be imported")
+	fl.BoolVar(&im.delete, "delete", false, "delete objects from the device once their copy is complete and matches the device")
+	fl.BoolVar(&im.quiet, "q", false, "do not report progress")
+	fl.StringVar(&im.dbName, "db", "", "database of imported objects; default is .go-mtpfs-import.json in DEST-DIR")
+	args, err := parseFlags(fl, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	im.dest = args[0]
+	if im.dbName == "" {
+		im.dbName = filepath.Join(im.dest, ".go-mtpfs-import.json")
+	}
+	if !im.dryRun {
+		if err := os.MkdirAll(im.dest, 0755); err != nil {
+			return err
+		}
+	}
+	if im.db, err = loadImportDB(im.dbName); err != nil {
+		return err
+	}
+
+	return c.withRemote(func(r *remote) error {
+		im.r = r
+		var info mtp.DeviceInfo
+		err := r.dev.GetDeviceInfo(&info)
+		if err != nil {
+			return err
+		}
+		im.serial = info.SerialNumber
+		if im.serial == "" {
+			im.serial = info.Manufacturer + " " + info.Model
+		}
+		im.partial = info.HasOperation(mtp.OC_GetPartialObject)
+		im.android = info.HasOperation(mtp.OC_ANDROID_GET_PARTIAL_OBJECT64) && strings.Contains(info.MTPExtension, "android.com")
+
+		found := false
+		for _, s := range r.storages {
+			var dcim *remoteObject
+			dcim, err = r.child(s, dcimFolder)
+			if _, ok := err.(notFoundError); ok {
+				err = nil
+				continue
+			} else if err != nil {
+				break
+			}
+			found = true
+			if err = im.walk(dcim); err != nil {
+				break
+			}
+		}
+		if err == nil && !found {
+			err = notFoundError(dcimFolder)
+		}
+		return err
+	})
+}
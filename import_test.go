@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-mtpfs/mtp"
+)
+
+func TestExpandTemplate(t *testing.T) {
+	tm := time.Date(2019, 3, 7, 8, 9, 10, 0, time.UTC)
+	if got, want := expandTemplate("YYYY/MM/DD", tm), "2019/03/07"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := expandTemplate("YYYY-MM/DD_hhmm", tm), "2019-03/07_0809"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestImportKey(t *testing.T) {
+	info := mtp.ObjectInfo{
+		Filename:         "IMG_0001.JPG",
+		ModificationDate: time.Date(2019, 3, 7, 8, 9, 10, 0, time.UTC),
+	}
+	if got, want := importKey("123", nil, &info, 42), "123/IMG_0001.JPG/42/20190307T080910"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := importKey("123", []byte{1, 0xab}, &info, 42), "123/uid:01ab"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
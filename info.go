@@ -0,0 +1,365 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/hanwen/go-mtpfs/mtp"
+)
+
+// The info command describes everything a device says about itself.
+
+// codeName is an MTP code with its symbolic name, if known.
+type codeName struct {
+	Code uint16
+	Name string `json:",omitempty"`
+}
+
+func codeNames(codes []uint16, names map[int]string) []codeName {
+	r := make([]codeName, 0, len(codes))
+	for _, c := range codes {
+		r = append(r, codeName{c, names[int(c)]})
+	}
+	return r
+}
+
+func (c codeName) String() string {
+	if c.Name == "" {
+		return fmt.Sprintf("0x%04x", c.Code)
+	}
+	return fmt.Sprintf("%s (0x%04x)", c.Name, c.Code)
+}
+
+type deviceReport struct {
+	Manufacturer     string
+	Model            string
+	DeviceVersion    string
+	SerialNumber     string
+	StandardVersion  uint16
+	VendorExtension  uint32
+	MTPVersion       uint16
+	MTPExtension     string
+	FunctionalMode   uint16
+	Operations       []codeName
+	Events           []codeName
+	DeviceProperties []codeName
+	CaptureFormats   []codeName
+	PlaybackFormats  []codeName
+
+	Storages      []storageReport
+	PropertyDescs []propReport
+	ObjectProps   []formatReport
+}
+
+type storageReport struct {
+	ID          uint32
+	Type        codeName
+	Filesystem  codeName
+	Access      codeName
+	Capacity    uint64
+	Free        uint64
+	Description string
+	VolumeLabel string `json:",omitempty"`
+	Error       string `json:",omitempty"`
+}
+
+// propReport describes a device or object property.
+type propReport struct {
+	Property codeName
+	DataType *codeName `json:",omitempty"`
+	Writable bool
+	Default  interface{}   `json:",omitempty"`
+	Current  interface{}   `json:",omitempty"`
+	Group    uint32        `json:",omitempty"`
+	Range    *rangeReport  `json:",omitempty"`
+	Enum     []interface{} `json:",omitempty"`
+	Error    string        `json:",omitempty"`
+}
+
+type rangeReport struct {
+	Min, Max, Step interface{}
+}
+
+// formatReport lists the object properties supported for a format.
+type formatReport struct {
+	Format     codeName
+	Properties []propReport `json:",omitempty"`
+	Error      string       `json:",omitempty"`
+}
+
+// hexValue is a 128-bit integer, printed in hex.
+type hexValue string
+
+// jsonValue makes a property value presentable: 128-bit integers
+// become hex strings.
+func jsonValue(v interface{}) interface{} {
+	if b, ok := v.([16]byte); ok {
+		return hexValue("0x" + hex.EncodeToString(b[:]))
+	}
+	return v
+}
+
+func formatValue(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return fmt.Sprintf("%q", s)
+	}
+	return fmt.Sprint(v)
+}
+
+func (p *propReport) setType(t mtp.DataTypeSelector) {
+	p.DataType = &codeName{uint16(t), mtp.DTC_names[int(t)]}
+}
+
+func (p *propReport) setForm(form interface{}) {
+	switch f := form.(type) {
+	case *mtp.PropDescRangeForm:
+		p.Range = &rangeReport{jsonValue(f.MinimumValue), jsonValue(f.MaximumValue), jsonValue(f.StepSize)}
+	case *mtp.PropDescEnumForm:
+		p.Enum = make([]interface{}, 0, len(f.Values))
+		for _, v := range f.Values {
+			p.Enum = append(p.Enum, jsonValue(v))
+		}
+	}
+}
+
+// inspect queries the device. Failures for single storages or
+// properties are recorded in the report, as devices often implement
+// only part of what they announce.
+func inspect(dev *mtp.Device) (*deviceReport, error) {
+	var info mtp.DeviceInfo
+	if err := dev.GetDeviceInfo(&info); err != nil {
+		return nil, err
+	}
+	r := &deviceReport{
+		Manufacturer:     info.Manufacturer,
+		Model:            info.Model,
+		DeviceVersion:    info.DeviceVersion,
+		SerialNumber:     info.SerialNumber,
+		StandardVersion:  info.StandardVersion,
+		VendorExtension:  info.MTPVendorExtensionID,
+		MTPVersion:       info.MTPVersion,
+		MTPExtension:     info.MTPExtension,
+		FunctionalMode:   info.FunctionalMode,
+		Operations:       codeNames(info.OperationsSupported, mtp.OC_names),
+		Events:           codeNames(info.EventsSupported, mtp.EC_names),
+		DeviceProperties: codeNames(info.DevicePropertiesSupported, mtp.DPC_names),
+		CaptureFormats:   codeNames(info.CaptureFormats, mtp.OFC_names),
+		PlaybackFormats:  codeNames(info.PlaybackFormats, mtp.OFC_names),
+	}
+
+	var sids mtp.Uint32Array
+	if err := dev.GetStorageIDs(&sids); err != nil {
+		return nil, err
+	}
+	for _, sid := range sids.Values {
+		s := storageReport{ID: sid}
+		var si mtp.StorageInfo
+		if err := dev.GetStorageInfo(sid, &si); err != nil {
+			s.Error = err.Error()
+		} else {
+			s.Type = codeName{si.StorageType, mtp.ST_names[int(si.StorageType)]}
+			s.Filesystem = codeName{si.FilesystemType, mtp.FST_names[int(si.FilesystemType)]}
+			s.Access = codeName{si.AccessCapability, mtp.AC_names[int(si.AccessCapability)]}
+			s.Capacity = si.MaxCapability
+			s.Free = si.FreeSpaceInBytes
+			s.Description = si.StorageDescription
+			s.VolumeLabel = si.VolumeLabel
+		}
+		r.Storages = append(r.Storages, s)
+	}
+
+	if info.HasOperation(mtp.OC_GetDevicePropDesc) {
+		for _, code := range info.DevicePropertiesSupported {
+			r.PropertyDescs = append(r.PropertyDescs, devicePropReport(dev, code))
+		}
+	}
+
+	if info.HasOperation(mtp.OC_MTP_GetObjectPropsSupported) {
+		for _, format := range allFormats(&info) {
+			r.ObjectProps = append(r.ObjectProps, inspectFormat(dev, &info, format))
+		}
+	}
+	return r, nil
+}
+
+func devicePropReport(dev *mtp.Device, code uint16) propReport {
+	p := propReport{Property: devicePropName(code)}
+	var desc mtp.DevicePropDesc
+	if err := dev.GetDevicePropDesc(code, &desc); err != nil {
+		p.Error = err.Error()
+		return p
+	}
+	p.setType(desc.DataType)
+	p.Writable = desc.GetSet == mtp.DPGS_GetSet
+	p.Default = jsonValue(desc.FactoryDefaultValue)
+	p.Current = jsonValue(desc.CurrentValue)
+	p.setForm(desc.Form)
+	return p
+}
+
+// allFormats returns the playback and capture formats, sorted.
+func allFormats(info *mtp.DeviceInfo) []uint16 {
+	seen := map[uint16]bool{}
+	var r []uint16
+	for _, f := range append(append([]uint16{}, info.PlaybackFormats...), info.CaptureFormats...) {
+		if !seen[f] {
+			seen[f] = true
+			r = append(r, f)
+		}
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i] < r[j] })
+	return r
+}
+
+func inspectFormat(dev *mtp.Device, info *mtp.DeviceInfo, format uint16) formatReport {
+	f := formatReport{Format: codeName{format, mtp.OFC_names[int(format)]}}
+	var props mtp.Uint16Array
+	if err := dev.GetObjectPropsSupported(format, &props); err != nil {
+		f.Error = err.Error()
+		return f
+	}
+	withDesc := info.HasOperation(mtp.OC_MTP_GetObjectPropDesc)
+	for _, code := range props.Values {
+		p := propReport{Property: codeName{code, mtp.OPC_names[int(code)]}}
+		if withDesc {
+			var desc mtp.ObjectPropDesc
+			if err := dev.GetObjectPropDesc(code, format, &desc); err != nil {
+				p.Error = err.Error()
+			} else {
+				p.setType(desc.DataType)
+				p.Writable = desc.GetSet == mtp.DPGS_GetSet
+				p.Default = jsonValue(desc.FactoryDefaultValue)
+				p.Group = desc.GroupCode
+				p.setForm(desc.Form)
+			}
+		}
+		f.Properties = append(f.Properties, p)
+	}
+	return f
+}
+
+func joinCodes(cs []codeName) string {
+	var s []string
+	for _, c := range cs {
+		s = append(s, c.String())
+	}
+	return strings.Join(s, ", ")
+}
+
+func (p *propReport) print(w io.Writer, indent string) {
+	fmt.Fprintf(w, "%s%s", indent, p.Property)
+	if p.Error != "" {
+		fmt.Fprintf(w, ": error: %s\n", p.Error)
+		return
+	}
+	if p.DataType == nil {
+		fmt.Fprintln(w)
+		return
+	}
+	access := "ro"
+	if p.Writable {
+		access = "rw"
+	}
+	fmt.Fprintf(w, ": %s %s", p.DataType.Name, access)
+	if p.Current != nil {
+		fmt.Fprintf(w, " current=%s", formatValue(p.Current))
+	}
+	if p.Default != nil {
+		fmt.Fprintf(w, " default=%s", formatValue(p.Default))
+	}
+	if p.Range != nil {
+		fmt.Fprintf(w, " range=[%s..%s step %s]", formatValue(p.Range.Min), formatValue(p.Range.Max), formatValue(p.Range.Step))
+	}
+	if p.Enum != nil {
+		var vals []string
+		for _, v := range p.Enum {
+			vals = append(vals, formatValue(v))
+		}
+		fmt.Fprintf(w, " values={%s}", strings.Join(vals, ", "))
+	}
+	fmt.Fprintln(w)
+}
+
+func (r *deviceReport) print(w io.Writer) {
+	fmt.Fprintf(w, "Manufacturer: %s\n", r.Manufacturer)
+	fmt.Fprintf(w, "Model: %s\n", r.Model)
+	fmt.Fprintf(w, "Version: %s\n", r.DeviceVersion)
+	fmt.Fprintf(w, "Serial: %s\n", r.SerialNumber)
+	fmt.Fprintf(w, "Standard version: %d\n", r.StandardVersion)
+	fmt.Fprintf(w, "Vendor extension: 0x%x (%s), version %d: %s\n", r.VendorExtension,
+		mtp.VENDOR_names[int(r.VendorExtension)], r.MTPVersion, r.MTPExtension)
+	fmt.Fprintf(w, "Functional mode: 0x%x\n", r.FunctionalMode)
+	fmt.Fprintf(w, "Operations: %s\n", joinCodes(r.Operations))
+	fmt.Fprintf(w, "Events: %s\n", joinCodes(r.Events))
+	fmt.Fprintf(w, "Capture formats: %s\n", joinCodes(r.CaptureFormats))
+	fmt.Fprintf(w, "Playback formats: %s\n", joinCodes(r.PlaybackFormats))
+
+	for _, s := range r.Storages {
+		fmt.Fprintf(w, "\nStorage 0x%08x:", s.ID)
+		if s.Error != "" {
+			fmt.Fprintf(w, " error: %s\n", s.Error)
+			continue
+		}
+		fmt.Fprintf(w, " %q\n", s.Description)
+		if s.VolumeLabel != "" {
+			fmt.Fprintf(w, "  Label: %q\n", s.VolumeLabel)
+		}
+		fmt.Fprintf(w, "  Type: %s\n  Filesystem: %s\n  Access: %s\n", s.Type, s.Filesystem, s.Access)
+		fmt.Fprintf(w, "  Capacity: %d\n  Free: %d\n", s.Capacity, s.Free)
+	}
+
+	if len(r.PropertyDescs) > 0 {
+		fmt.Fprintf(w, "\nDevice properties:\n")
+		for i := range r.PropertyDescs {
+			r.PropertyDescs[i].print(w, "  ")
+		}
+	} else if len(r.DeviceProperties) > 0 {
+		fmt.Fprintf(w, "\nDevice properties: %s\n", joinCodes(r.DeviceProperties))
+	}
+
+	for _, f := range r.ObjectProps {
+		fmt.Fprintf(w, "\nObject properties for %s:", f.Format)
+		if f.Error != "" {
+			fmt.Fprintf(w, " error: %s\n", f.Error)
+			continue
+		}
+		fmt.Fprintln(w)
+		for i := range f.Properties {
+			f.Properties[i].print(w, "  ")
+		}
+	}
+}
+
+func cmdInfo(c *deviceConfig, args []string) error {
+	fl := flag.NewFlagSet("info", flag.ContinueOnError)
+	asJSON := fl.Bool("json", false, "print JSON")
+	if _, err := parseFlags(fl, args, 0, 0); err != nil {
+		return err
+	}
+	dev, err := c.open()
+	if err != nil {
+		return err
+	}
+	defer dev.Close()
+
+	r, err := inspect(dev)
+	if err != nil {
+		return err
+	}
+	if !*asJSON {
+		r.print(os.Stdout)
+		return nil
+	}
+	data, err := json.MarshalIndent(r, "", " ")
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(append(data, '\n'))
+	return err
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/hanwen/go-mtpfs/mtp"
+)
+
+func TestAllFormats(t *testing.T) {
+	info := mtp.DeviceInfo{
+		PlaybackFormats: []uint16{mtp.OFC_MP3, mtp.OFC_Undefined},
+		CaptureFormats:  []uint16{mtp.OFC_EXIF_JPEG, mtp.OFC_MP3},
+	}
+	got := allFormats(&info)
+	want := []uint16{mtp.OFC_Undefined, mtp.OFC_MP3, mtp.OFC_EXIF_JPEG}
+	if len(got) != len(want) {
+		t.Fatalf("got %x, want %x", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("got %x, want %x", got, want)
+		}
+	}
+}
+
+func TestPropReport(t *testing.T) {
+	p := propReport{Property: codeName{mtp.DPC_BatteryLevel, "BatteryLevel"}}
+	p.setType(mtp.DTC_UINT8)
+	p.Current = uint8(80)
+	p.Default = jsonValue([16]byte{15: 1})
+	p.setForm(&mtp.PropDescRangeForm{MinimumValue: uint8(0), MaximumValue: uint8(100), StepSize: uint8(1)})
+
+	var buf bytes.Buffer
+	p.print(&buf, "")
+	want := "BatteryLevel (0x5001): UINT8 ro current=80 default=0x00000000000000000000000000000001 range=[0..100 step 1]\n"
+	if buf.String() != want {
+		t.Errorf("got %q, want %q", buf.String(), want)
+	}
+
+	data, err := json.Marshal(&p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := string(data); !strings.Contains(s, `"Range":{"Min":0,"Max":100,"Step":1}`) || strings.Contains(s, "Enum") {
+		t.Errorf("got %s", s)
+	}
+}
@@ -0,0 +1,117 @@
+package iofs
+
+// This test requires an unlocked MTP device plugged in, with at least
+// one file in the top two levels of its first storage. It is skipped
+// if no device is found.
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"testing"
+
+	"github.com/hanwen/go-mtpfs/mtp"
+)
+
+// selectDevice is mtp.SelectDevice, but returns an error if the USB
+// library panics, as it does when there are no USB devices at all.
+func selectDevice() (dev *mtp.Device, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	return mtp.SelectDevice("")
+}
+
+func openFS(t *testing.T) (*FS, func()) {
+	dev, err := selectDevice()
+	if err != nil {
+		t.Skipf("no device: %v", err)
+	}
+	if err := dev.Configure(); err != nil {
+		dev.Close()
+		t.Fatalf("Configure failed: %v", err)
+	}
+	var sids mtp.Uint32Array
+	if err := dev.GetStorageIDs(&sids); err != nil || len(sids.Values) == 0 {
+		dev.Close()
+		t.Fatalf("no storages (%v). Unlock device?", err)
+	}
+	fsys, err := New(dev, sids.Values[0])
+	if err != nil {
+		dev.Close()
+		t.Fatalf("New: %v", err)
+	}
+	return fsys, func() { dev.Close() }
+}
+
+// findFile returns a non-empty file near the root.
+func findFile(t *testing.T, fsys fs.FS) string {
+	var found string
+	fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || found != "" {
+			return fs.SkipDir
+		}
+		if d.IsDir() && p != "." && path.Dir(p) != "." {
+			return fs.SkipDir
+		}
+		if info, err := d.Info(); err == nil && !d.IsDir() && info.Size() > 0 {
+			found = p
+		}
+		return nil
+	})
+	if found == "" {
+		t.Skip("no file found")
+	}
+	return found
+}
+
+func TestDeviceFS(t *testing.T) {
+	fsys, cleanup := openFS(t)
+	defer cleanup()
+
+	if fi, err := fsys.Stat("."); err != nil || !fi.IsDir() {
+		t.Fatalf("Stat(.) = %v, %v", fi, err)
+	}
+	if _, err := fsys.Stat("no such file"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat of missing file: got %v", err)
+	}
+
+	name := findFile(t, fsys)
+	content, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		t.Fatalf("ReadFile(%q): %v", name, err)
+	}
+	fi, err := fs.Stat(fsys, name)
+	if err != nil {
+		t.Fatalf("Stat(%q): %v", name, err)
+	}
+	if fi.Size() != int64(len(content)) {
+		t.Errorf("%q: size %d, read %d bytes", name, fi.Size(), len(content))
+	}
+	if _, ok := fi.Sys().(*mtp.ObjectInfo); !ok {
+		t.Errorf("Sys() is %T", fi.Sys())
+	}
+
+	f, err := fsys.Open(name)
+	if err != nil {
+		t.Fatalf("Open(%q): %v", name, err)
+	}
+	defer f.Close()
+	seeker := f.(io.ReadSeeker)
+	off := int64(len(content) / 2)
+	if _, err := seeker.Seek(off, io.SeekStart); err != nil {
+		t.Fatalf("Seek: %v", err)
+	}
+	rest, err := io.ReadAll(seeker)
+	if err != nil {
+		t.Fatalf("Read after Seek: %v", err)
+	}
+	if !bytes.Equal(rest, content[off:]) {
+		t.Errorf("read %d bytes from offset %d, differing from ReadFile", len(rest), off)
+	}
+}
@@ -0,0 +1,459 @@
+// Package iofs gives read-only access to a storage of an MTP device
+// through the io/fs interfaces, for use with fs.WalkDir,
+// http.FS, template.ParseFS and the like.
+package iofs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	mtpfs "github.com/hanwen/go-mtpfs/fs"
+	"github.com/hanwen/go-mtpfs/mtp"
+)
+
+// noParent is the parent handle of objects in the storage root.
+const noParent = 0xFFFFFFFF
+
+// FS is an fs.FS for one storage of a device. It may be used from
+// several goroutines; device access is serialized. Objects are found
+// by their handles, which are remembered by path, so changes made on
+// the device while the FS is used are noticed only when a cached
+// handle goes stale.
+type FS struct {
+	dev       Device
+	storageID uint32
+
+	// ops holds the partial reads of the device.
+	ops ReadOps
+	// propList is set if folders are listed with GetObjPropList.
+	propList bool
+
+	mu sync.Mutex
+	// handles holds known object handles by path.
+	handles map[string]uint32
+}
+
+var (
+	_ fs.FS         = (*FS)(nil)
+	_ fs.ReadDirFS  = (*FS)(nil)
+	_ fs.StatFS     = (*FS)(nil)
+	_ fs.ReadFileFS = (*FS)(nil)
+)
+
+// Device is the part of *mtp.Device used by an FS.
+type Device interface {
+	GetDeviceInfo(info *mtp.DeviceInfo) error
+	GetStorageInfo(ID uint32, info *mtp.StorageInfo) error
+	GetObjectInfo(handle uint32, info *mtp.ObjectInfo) error
+	GetObjectPropValue(objHandle uint32, objPropCode uint16, value interface{}) error
+	WalkFolder(storageID, parent uint32, propList bool, fn func(handle uint32, info *mtp.ObjectInfo, size int64) error) error
+	GetObject(handle uint32, w io.Writer) error
+	GetPartialObject(handle uint32, w io.Writer, offset uint32, size uint32) error
+	AndroidGetPartialObject64(handle uint32, w io.Writer, offset int64, size uint32) error
+}
+
+var _ = (Device)((*mtp.Device)(nil))
+
+// New returns an FS for the storage of a configured device. The
+// device must not be used otherwise while the FS is in use.
+func New(dev Device, storageID uint32) (*FS, error) {
+	var info mtp.DeviceInfo
+	if err := dev.GetDeviceInfo(&info); err != nil {
+		return nil, err
+	}
+	var sinfo mtp.StorageInfo
+	if err := dev.GetStorageInfo(storageID, &sinfo); err != nil {
+		return nil, fmt.Errorf("storage 0x%x: %v", storageID, err)
+	}
+	if !sinfo.IsHierarchical() {
+		return nil, fmt.Errorf("storage 0x%x is not hierarchical", storageID)
+	}
+
+	fsys := &FS{
+		dev:       dev,
+		storageID: storageID,
+		handles:   map[string]uint32{},
+	}
+	fsys.ops = DeviceReadOps(&info)
+	fsys.propList = info.HasOperation(mtp.OC_MTP_GetObjPropList)
+	return fsys, nil
+}
+
+// object is a looked up object.
+type object struct {
+	name   string
+	handle uint32
+	info   mtp.ObjectInfo
+	size   int64
+}
+
+func (o *object) isDir() bool {
+	return o.info.ObjectFormat == mtp.OFC_Association
+}
+
+// root returns the object for the storage root.
+func (fsys *FS) root() *object {
+	o := &object{name: ".", handle: noParent}
+	o.info.StorageID = fsys.storageID
+	o.info.ObjectFormat = mtp.OFC_Association
+	return o
+}
+
+// object fetches the info for a handle.
+func (fsys *FS) object(name string, handle uint32) (*object, error) {
+	o := &object{name: name, handle: handle}
+	if err := fsys.dev.GetObjectInfo(handle, &o.info); err != nil {
+		return nil, err
+	}
+	o.size = int64(o.info.CompressedSize)
+	if o.info.CompressedSize == 0xFFFFFFFF {
+		var val mtp.Uint64Value
+		if err := fsys.dev.GetObjectPropValue(handle, mtp.OPC_ObjectSize, &val); err != nil {
+			return nil, err
+		}
+		o.size = int64(val.Value)
+	}
+	return o, nil
+}
+
+// children lists a directory, sorted by name, and remembers the
+// handles of its entries. Duplicate names get numbers, as in the
+// mount.
+func (fsys *FS) children(dir *object) ([]*object, error) {
+	var r []*object
+	names := map[uint32]string{}
+	err := fsys.dev.WalkFolder(fsys.storageID, dir.handle, fsys.propList, func(h uint32, info *mtp.ObjectInfo, size int64) error {
+		// Names with "/" cannot be addressed.
+		if info.Filename == "" || strings.Contains(info.Filename, "/") {
+			return nil
+		}
+		r = append(r, &object{handle: h, info: *info, size: size})
+		names[h] = info.Filename
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	unique := mtpfs.UniqueNames(names)
+	for _, o := range r {
+		o.name = path.Join(dir.name, unique[o.handle])
+		fsys.handles[o.name] = o.handle
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].name < r[j].name })
+	return r, nil
+}
+
+// sameParent returns whether an object lies in dir.
+func sameParent(o, dir *object) bool {
+	p := o.info.ParentObject
+	if dir.handle == noParent {
+		return p == 0 || p == noParent
+	}
+	return p == dir.handle
+}
+
+// lookup finds the object for a valid path. A remembered handle is
+// checked to still have the right name and parent.
+func (fsys *FS) lookup(name string) (*object, error) {
+	if name == "." {
+		return fsys.root(), nil
+	}
+	dir, err := fsys.lookup(path.Dir(name))
+	if err != nil {
+		return nil, err
+	}
+	if !dir.isDir() {
+		return nil, fs.ErrNotExist
+	}
+
+	if h, ok := fsys.handles[name]; ok {
+		o, err := fsys.object(name, h)
+		if err == nil && o.info.Filename == path.Base(name) && sameParent(o, dir) {
+			return o, nil
+		}
+		delete(fsys.handles, name)
+	}
+
+	chs, err := fsys.children(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, ch := range chs {
+		if ch.name == name {
+			return ch, nil
+		}
+	}
+	return nil, fs.ErrNotExist
+}
+
+// Open opens a file or directory.
+func (fsys *FS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	o, err := fsys.lookup(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	if o.isDir() {
+		return &dir{fsys: fsys, obj: o}, nil
+	}
+	return &file{fsys: fsys, obj: o, r: NewObjectReader(fsys.dev, fsys.ops, o.handle, o.size)}, nil
+}
+
+// Stat returns the FileInfo for a path.
+func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	o, err := fsys.lookup(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return fileInfo{o}, nil
+}
+
+// ReadDir lists a directory, sorted by name.
+func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	entries, err := fsys.readDir(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	return entries, nil
+}
+
+func (fsys *FS) readDir(name string) ([]fs.DirEntry, error) {
+	o, err := fsys.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if !o.isDir() {
+		return nil, errNotDir
+	}
+	chs, err := fsys.children(o)
+	if err != nil {
+		return nil, err
+	}
+	r := make([]fs.DirEntry, 0, len(chs))
+	for _, ch := range chs {
+		r = append(r, fileInfo{ch})
+	}
+	return r, nil
+}
+
+// ReadFile reads a whole file.
+func (fsys *FS) ReadFile(name string) ([]byte, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: fs.ErrInvalid}
+	}
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	o, err := fsys.lookup(name)
+	if err == nil && o.isDir() {
+		err = errIsDir
+	}
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+	}
+	var buf bytes.Buffer
+	buf.Grow(int(o.size))
+	if err := fsys.dev.GetObject(o.handle, &buf); err != nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+	}
+	return buf.Bytes(), nil
+}
+
+var (
+	errIsDir  = errors.New("is a directory")
+	errNotDir = errors.New("not a directory")
+)
+
+// fileInfo is the fs.FileInfo and fs.DirEntry for an object. Sys
+// returns its *mtp.ObjectInfo.
+type fileInfo struct {
+	obj *object
+}
+
+func (fi fileInfo) Name() string {
+	return path.Base(fi.obj.name)
+}
+
+func (fi fileInfo) Size() int64 {
+	return fi.obj.size
+}
+
+func (fi fileInfo) Mode() fs.FileMode {
+	if fi.obj.isDir() {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
+
+func (fi fileInfo) ModTime() time.Time {
+	return fi.obj.info.ModificationDate
+}
+
+func (fi fileInfo) IsDir() bool {
+	return fi.obj.isDir()
+}
+
+func (fi fileInfo) Sys() interface{} {
+	return &fi.obj.info
+}
+
+func (fi fileInfo) Type() fs.FileMode {
+	return fi.Mode().Type()
+}
+
+func (fi fileInfo) Info() (fs.FileInfo, error) {
+	return fi, nil
+}
+
+// file is an open regular file. It implements io.Seeker and
+// io.ReaderAt.
+type file struct {
+	fsys   *FS
+	obj    *object
+	off    int64
+	closed bool
+
+	r *ObjectReader
+}
+
+func (f *file) Stat() (fs.FileInfo, error) {
+	return fileInfo{f.obj}, nil
+}
+
+func (f *file) Close() error {
+	if f.closed {
+		return &fs.PathError{Op: "close", Path: f.obj.name, Err: fs.ErrClosed}
+	}
+	f.closed = true
+	f.r = nil
+	return nil
+}
+
+func (f *file) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.off)
+	f.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	if f.closed {
+		return 0, &fs.PathError{Op: "seek", Path: f.obj.name, Err: fs.ErrClosed}
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += f.obj.size
+	default:
+		return 0, &fs.PathError{Op: "seek", Path: f.obj.name, Err: fs.ErrInvalid}
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.obj.name, Err: fs.ErrInvalid}
+	}
+	f.off = offset
+	return offset, nil
+}
+
+func (f *file) ReadAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, &fs.PathError{Op: "read", Path: f.obj.name, Err: fs.ErrClosed}
+	}
+	if off < 0 {
+		return 0, &fs.PathError{Op: "read", Path: f.obj.name, Err: fs.ErrInvalid}
+	}
+
+	f.fsys.mu.Lock()
+	defer f.fsys.mu.Unlock()
+	n, err := f.r.ReadAt(p, off)
+	if err != nil && err != io.EOF {
+		err = &fs.PathError{Op: "read", Path: f.obj.name, Err: err}
+	}
+	return n, err
+}
+
+// dir is an open directory.
+type dir struct {
+	fsys    *FS
+	obj     *object
+	entries []fs.DirEntry
+	// read is set once the entries were fetched.
+	read   bool
+	closed bool
+}
+
+func (d *dir) Stat() (fs.FileInfo, error) {
+	return fileInfo{d.obj}, nil
+}
+
+func (d *dir) Read(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.obj.name, Err: errIsDir}
+}
+
+func (d *dir) Close() error {
+	if d.closed {
+		return &fs.PathError{Op: "close", Path: d.obj.name, Err: fs.ErrClosed}
+	}
+	d.closed = true
+	return nil
+}
+
+// ReadDir returns the next n entries, or all remaining entries if
+// n <= 0, as described for fs.ReadDirFile.
+func (d *dir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if d.closed {
+		return nil, &fs.PathError{Op: "readdir", Path: d.obj.name, Err: fs.ErrClosed}
+	}
+	if !d.read {
+		d.fsys.mu.Lock()
+		chs, err := d.fsys.children(d.obj)
+		d.fsys.mu.Unlock()
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: d.obj.name, Err: err}
+		}
+		for _, ch := range chs {
+			d.entries = append(d.entries, fileInfo{ch})
+		}
+		d.read = true
+	}
+
+	if n <= 0 {
+		r := d.entries
+		d.entries = nil
+		return r, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(d.entries) {
+		n = len(d.entries)
+	}
+	r := d.entries[:n]
+	d.entries = d.entries[n:]
+	return r, nil
+}
@@ -0,0 +1,209 @@
+package iofs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/hanwen/go-mtpfs/mtp"
+)
+
+// fakeDevice is a Device holding objects in memory.
+type fakeDevice struct {
+	ops     []uint16
+	objects map[uint32]*fakeObject
+	next    uint32
+}
+
+type fakeObject struct {
+	info mtp.ObjectInfo
+	data []byte
+}
+
+const fakeStorage = 0x10001
+
+func newFakeDevice(ops ...uint16) *fakeDevice {
+	return &fakeDevice{ops: ops, objects: map[uint32]*fakeObject{}, next: 1}
+}
+
+// add adds an object to the folder parent, and returns its handle.
+func (d *fakeDevice) add(parent uint32, name string, data []byte, dir bool) uint32 {
+	h := d.next
+	d.next++
+	o := &fakeObject{data: data}
+	o.info = mtp.ObjectInfo{
+		StorageID:        fakeStorage,
+		ObjectFormat:     mtp.OFC_Undefined,
+		CompressedSize:   uint32(len(data)),
+		ParentObject:     parent,
+		Filename:         name,
+		ModificationDate: time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+	if dir {
+		o.info.ObjectFormat = mtp.OFC_Association
+	}
+	d.objects[h] = o
+	return h
+}
+
+func (d *fakeDevice) object(h uint32) (*fakeObject, error) {
+	o, ok := d.objects[h]
+	if !ok {
+		return nil, fmt.Errorf("no object 0x%x", h)
+	}
+	return o, nil
+}
+
+func (d *fakeDevice) GetDeviceInfo(info *mtp.DeviceInfo) error {
+	info.OperationsSupported = d.ops
+	return nil
+}
+
+func (d *fakeDevice) GetStorageInfo(ID uint32, info *mtp.StorageInfo) error {
+	if ID != fakeStorage {
+		return fmt.Errorf("no storage 0x%x", ID)
+	}
+	info.FilesystemType = mtp.FST_GenericHierarchical
+	return nil
+}
+
+func (d *fakeDevice) GetObjectInfo(handle uint32, info *mtp.ObjectInfo) error {
+	o, err := d.object(handle)
+	if err != nil {
+		return err
+	}
+	*info = o.info
+	return nil
+}
+
+func (d *fakeDevice) GetObjectPropValue(objHandle uint32, objPropCode uint16, value interface{}) error {
+	o, err := d.object(objHandle)
+	if err != nil {
+		return err
+	}
+	if objPropCode != mtp.OPC_ObjectSize {
+		return fmt.Errorf("unsupported property 0x%x", objPropCode)
+	}
+	value.(*mtp.Uint64Value).Value = uint64(len(o.data))
+	return nil
+}
+
+func (d *fakeDevice) WalkFolder(storageID, parent uint32, propList bool, fn func(handle uint32, info *mtp.ObjectInfo, size int64) error) error {
+	var handles []uint32
+	for h, o := range d.objects {
+		if o.info.StorageID == storageID && o.info.ParentObject == parent {
+			handles = append(handles, h)
+		}
+	}
+	sort.Slice(handles, func(i, j int) bool { return handles[i] < handles[j] })
+	for _, h := range handles {
+		o := d.objects[h]
+		info := o.info
+		if err := fn(h, &info, int64(len(o.data))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *fakeDevice) GetObject(handle uint32, w io.Writer) error {
+	o, err := d.object(handle)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(o.data)
+	return err
+}
+
+func (d *fakeDevice) GetPartialObject(handle uint32, w io.Writer, offset uint32, size uint32) error {
+	return d.AndroidGetPartialObject64(handle, w, int64(offset), size)
+}
+
+func (d *fakeDevice) AndroidGetPartialObject64(handle uint32, w io.Writer, offset int64, size uint32) error {
+	o, err := d.object(handle)
+	if err != nil {
+		return err
+	}
+	if offset > int64(len(o.data)) {
+		return fmt.Errorf("offset %d past end", offset)
+	}
+	end := offset + int64(size)
+	if end > int64(len(o.data)) {
+		end = int64(len(o.data))
+	}
+	_, err = w.Write(o.data[offset:end])
+	return err
+}
+
+// fakeTree fills a device with a small tree, and returns the files
+// expected in it.
+func fakeTree(d *fakeDevice) []string {
+	big := bytes.Repeat([]byte("0123456789abcdef"), readChunk/16+100)
+	d.add(noParent, "hello.txt", []byte("hello world\n"), false)
+	d.add(noParent, "empty", nil, true)
+	dir := d.add(noParent, "DCIM", nil, true)
+	d.add(dir, "a.jpg", []byte("first"), false)
+	d.add(dir, "a.jpg", []byte("second"), false)
+	d.add(dir, "no/slash", []byte("x"), false)
+	d.add(dir, "", []byte("x"), false)
+	sub := d.add(dir, "Camera", nil, true)
+	d.add(sub, "big.bin", big, false)
+	return []string{"hello.txt", "empty", "DCIM/a.jpg", "DCIM/a (2).jpg", "DCIM/Camera/big.bin"}
+}
+
+func TestFS(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		ops  []uint16
+	}{
+		{"whole", nil},
+		{"partial", []uint16{mtp.OC_GetPartialObject}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			d := newFakeDevice(tc.ops...)
+			want := fakeTree(d)
+			fsys, err := New(d, fakeStorage)
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+			if err := fstest.TestFS(fsys, want...); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestFSDuplicateNames(t *testing.T) {
+	d := newFakeDevice()
+	fakeTree(d)
+	fsys, err := New(d, fakeStorage)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	entries, err := fs.ReadDir(fsys, "DCIM")
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if got, want := fmt.Sprint(names), "[Camera a (2).jpg a.jpg]"; got != want {
+		t.Errorf("names %s, want %s", got, want)
+	}
+	for name, content := range map[string]string{
+		"DCIM/a.jpg":     "first",
+		"DCIM/a (2).jpg": "second",
+	} {
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil || string(data) != content {
+			t.Errorf("ReadFile(%q) = %q, %v, want %q", name, data, err, content)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package iofs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/hanwen/go-mtpfs/mtp"
+)
+
+// readChunk is the largest read sent to the device at once.
+const readChunk = 1 << 20
+
+// ReadOps holds the partial reads a device supports.
+type ReadOps struct {
+	// android is set if the device supports 64-bit partial reads.
+	android bool
+	// partial is set if the device supports GetPartialObject.
+	partial bool
+}
+
+// DeviceReadOps returns the partial reads of a device.
+func DeviceReadOps(info *mtp.DeviceInfo) ReadOps {
+	return ReadOps{
+		android: info.HasOperation(mtp.OC_ANDROID_GET_PARTIAL_OBJECT64) &&
+			strings.Contains(info.MTPExtension, "android.com"),
+		partial: info.HasOperation(mtp.OC_GetPartialObject),
+	}
+}
+
+// ObjectReader reads an object at any offset, using the partial reads
+// the device supports. On devices without them, the object is fetched
+// whole on the first read, and kept. It does not serialize device
+// access; callers do.
+type ObjectReader struct {
+	dev    Device
+	ops    ReadOps
+	handle uint32
+	size   int64
+
+	// data holds the contents, if they had to be fetched whole.
+	data []byte
+}
+
+var _ = (io.ReaderAt)((*ObjectReader)(nil))
+
+// NewObjectReader returns a reader for an object of size bytes.
+func NewObjectReader(dev Device, ops ReadOps, handle uint32, size int64) *ObjectReader {
+	return &ObjectReader{dev: dev, ops: ops, handle: handle, size: size}
+}
+
+var errNegativeOffset = errors.New("negative offset")
+
+// ReadAt reads len(p) bytes at off, as io.ReaderAt. Large reads are
+// split into several device reads.
+func (r *ObjectReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errNegativeOffset
+	}
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	want := len(p)
+	if rest := r.size - off; int64(want) > rest {
+		want = int(rest)
+	}
+	n := 0
+	for n < want {
+		m, err := r.readChunk(p[n:want], off+int64(n))
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// readChunk reads the start of p from the device. It returns an
+// error if nothing could be read.
+func (r *ObjectReader) readChunk(p []byte, off int64) (int, error) {
+	if len(p) > readChunk {
+		p = p[:readChunk]
+	}
+	var buf bytes.Buffer
+	buf.Grow(len(p))
+	var err error
+	switch {
+	case r.ops.android:
+		err = r.dev.AndroidGetPartialObject64(r.handle, &buf, off, uint32(len(p)))
+	case r.ops.partial && off+int64(len(p)) <= 0xFFFFFFFF:
+		err = r.dev.GetPartialObject(r.handle, &buf, uint32(off), uint32(len(p)))
+	default:
+		if r.data == nil {
+			buf.Grow(int(r.size))
+			if err := r.dev.GetObject(r.handle, &buf); err != nil {
+				return 0, err
+			}
+			r.data = buf.Bytes()
+		}
+		if off >= int64(len(r.data)) {
+			return 0, io.ErrUnexpectedEOF
+		}
+		return copy(p, r.data[off:]), nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if buf.Len() == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return copy(p, buf.Bytes()), nil
+}
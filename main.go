@@ -6,8 +6,10 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
 	"os"
+	"sort"
 	"strings"
 	"syscall"
 	"time"
@@ -18,6 +20,138 @@ import (
 	"github.com/hanwen/go-mtpfs/mtp"
 )
 
+// deviceConfig holds the flags for selecting and talking to a
+// device, and for mounting it. They are shared between mounting and
+// the commands.
+type deviceConfig struct {
+	filter        string
+	storageFilter string
+	timeout       int
+	debugs        map[string]bool
+	// syncTime sets the device clock from the host on connecting.
+	syncTime bool
+
+	fsOptions  fs.DeviceFsOptions
+	allowOther bool
+	readOnly   bool
+	uid, gid   uint32
+	// Further options for the FUSE mount.
+	fuseOptions []string
+}
+
+func (c *deviceConfig) setDebug(dev *mtp.Device) {
+	dev.MTPDebug = c.debugs["mtp"]
+	dev.DataDebug = c.debugs["data"]
+	dev.USBDebug = c.debugs["usb"]
+	dev.Timeout = c.timeout
+}
+
+// open selects the device and opens a session.
+func (c *deviceConfig) open() (*mtp.Device, error) {
+	dev, err := mtp.SelectDevice(c.filter)
+	if err != nil {
+		return nil, fmt.Errorf("detect failed: %v", err)
+	}
+	if err = c.configure(dev); err != nil {
+		dev.Close()
+		return nil, err
+	}
+	return dev, nil
+}
+
+// configure opens a session with a newly found device.
+func (c *deviceConfig) configure(dev *mtp.Device) error {
+	c.setDebug(dev)
+	if err := dev.Configure(); err != nil {
+		return fmt.Errorf("Configure failed: %v", err)
+	}
+	if c.syncTime {
+		syncTime(dev)
+	}
+	return nil
+}
+
+// syncTime sets the device clock to the host time, and logs how far
+// off it was. Failure is not fatal.
+func syncTime(dev *mtp.Device) {
+	var info mtp.DeviceInfo
+	if err := dev.GetDeviceInfo(&info); err != nil {
+		log.Printf("setting device time: %v", err)
+		return
+	}
+	if !info.HasDeviceProperty(mtp.DPC_DateTime) {
+		log.Printf("%s does not support setting the time", fs.DeviceName(&info))
+		return
+	}
+
+	now := time.Now()
+	old, err := dev.SetDateTime(now)
+	if err != nil {
+		log.Printf("setting time of %s: %v", fs.DeviceName(&info), err)
+	} else if old.IsZero() {
+		log.Printf("set time of %s; it had no valid time", fs.DeviceName(&info))
+	} else {
+		log.Printf("set time of %s; it was off by %v", fs.DeviceName(&info), old.Sub(now).Round(time.Second))
+	}
+}
+
+func (c *deviceConfig) mountOptions() *fusefs.Options {
+	sec := time.Second
+	opts := &fusefs.Options{
+		MountOptions: fuse.MountOptions{
+			SingleThreaded: true,
+			AllowOther:     c.allowOther,
+			Debug:          c.debugs["fuse"] || c.debugs["fs"],
+			Options:        c.fuseOptions,
+		},
+		UID:          c.uid,
+		GID:          c.gid,
+		AttrTimeout:  &sec,
+		EntryTimeout: &sec,
+	}
+	if c.readOnly {
+		opts.MountOptions.Options = append(opts.MountOptions.Options, "ro")
+	}
+	return opts
+}
+
+// scan opens and configures the devices that are not known yet. It
+// is a fs.ScanFunc.
+func (c *deviceConfig) scan(known map[string]bool) (map[string]bool, []*mtp.Device) {
+	present, devs, err := mtp.ScanDevices(c.filter, known)
+	if err != nil {
+		log.Printf("scanning devices: %v", err)
+	}
+	var ok []*mtp.Device
+	for _, dev := range devs {
+		if err := c.configure(dev); err != nil {
+			log.Printf("device at %s: %v", dev.Location(), err)
+			dev.Close()
+			dev.Done()
+			continue
+		}
+		ok = append(ok, dev)
+	}
+	return present, ok
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [options] MOUNT-POINT\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s [options] COMMAND [args]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s SOURCE MOUNT-POINT -o OPTIONS   (as mount helper)\n\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Commands (use ./NAME to mount on a directory called like a command):\n")
+	var names []string
+	for n := range commands {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", n, commands[n].help)
+	}
+	fmt.Fprintf(os.Stderr, "\nOptions:\n")
+	flag.PrintDefaults()
+}
+
 func main() {
 	debug := flag.String("debug", "", "comma-separated list of debugging options: usb, data, mtp, fuse")
 	usbTimeout := flag.Int("usb-timeout", 5000, "timeout in milliseconds")
@@ -28,63 +162,150 @@ func main() {
 			"which are composed of manufacturer/product/serial.")
 	storageFilter := flag.String("storage", "", "regular expression to filter storage areas.")
 	android := flag.Bool("android", true, "use android extensions if available")
+	all := flag.Bool("all", false, "mount all devices matching -dev, each in a directory named after the device. Devices may come and go while mounted.")
+	playlists := flag.Bool("playlists", false, "show device playlists as .m3u8 files, and turn .m3u8 files written to the mount into device playlists.")
+	readOnly := flag.Bool("ro", false, "mount read-only")
+	uid := flag.Int("uid", syscall.Getuid(), "owner of the files")
+	gid := flag.Int("gid", syscall.Getgid(), "group of the files")
+	umask := octalValue{value: 022}
+	flag.Var(&umask, "umask", "octal permission bits to clear from files and directories")
+	fmask := octalValue{}
+	flag.Var(&fmask, "fmask", "octal permission bits to clear from files; default is -umask")
+	dmask := octalValue{}
+	flag.Var(&dmask, "dmask", "octal permission bits to clear from directories; default is -umask")
+	storageUmasks := storageMasks{}
+	flag.Var(storageUmasks, "storage-umask", "NAME=MASK: use MASK as umask for the storage NAME (repeatable)")
+	mountOpts := flag.String("o", "", "comma-separated mount options, as in fstab. Options named like flags set them "+
+		"(eg. dev=REGEX,storage=REGEX,ro,allow_other,usb_timeout=MS,android=0,uid=N,gid=N,umask=022); "+
+		"others are passed to FUSE.")
+	syncTime := flag.Bool("sync-time", false, "set the device clock to the host time after connecting")
+	verify := flag.String("verify", "off", "check files sent to the device by reading them back: off, sample (some ranges) or full. "+
+		"Verified files are recorded for the verify command. Android devices need -android=false.")
+	foreground := flag.Bool("foreground", false, "as mount helper, stay in the foreground")
+	flag.Usage = usage
 	flag.Parse()
 
-	if len(flag.Args()) != 1 {
-		log.Fatalf("Usage: %s [options] MOUNT-POINT\n", os.Args[0])
+	// Mount helpers get SOURCE MOUNTPOINT -o OPTIONS.
+	helper := isHelper(os.Args[0], flag.Args()) && commands[flag.Arg(0)] == nil
+	args := flag.Args()
+	if helper {
+		mountpoint, opts, fake, err := parseHelperArgs(args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			usage()
+			os.Exit(2)
+		}
+		if fake {
+			os.Exit(0)
+		}
+		if *mountOpts != "" {
+			opts = *mountOpts + "," + opts
+		}
+		*mountOpts = opts
+		args = []string{mountpoint}
+	}
+	var fuseOpts []string
+	if *mountOpts != "" {
+		var err error
+		if fuseOpts, err = applyMountOptions(flag.CommandLine, *mountOpts); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(2)
+		}
 	}
-	mountpoint := flag.Arg(0)
 
-	dev, err := mtp.SelectDevice(*deviceFilter)
+	verifyMode, err := fs.ParseVerifyMode(*verify)
 	if err != nil {
-		log.Fatalf("detect failed: %v", err)
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(2)
 	}
-	defer dev.Close()
-	debugs := map[string]bool{}
-	for _, s := range strings.Split(*debug, ",") {
-		debugs[s] = true
+	hashDir := ""
+	if verifyMode != fs.VerifyOff {
+		if hashDir, err = defaultHashDir(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	config := &deviceConfig{
+		filter:        *deviceFilter,
+		storageFilter: *storageFilter,
+		timeout:       *usbTimeout,
+		debugs:        map[string]bool{},
+		syncTime:      *syncTime,
+		fsOptions: fs.DeviceFsOptions{
+			RemovableVFat: *vfat,
+			Android:       *android,
+			Playlists:     *playlists,
+			FileMask:      umask.value,
+			DirMask:       umask.value,
+			StorageMasks:  storageUmasks,
+			Verify:        verifyMode,
+			HashDir:       hashDir,
+			StorageFilter: *storageFilter,
+		},
+		allowOther:  *other,
+		readOnly:    *readOnly,
+		uid:         uint32(*uid),
+		gid:         uint32(*gid),
+		fuseOptions: fuseOpts,
 	}
-	dev.MTPDebug = debugs["mtp"]
-	dev.DataDebug = debugs["data"]
-	dev.USBDebug = debugs["usb"]
-	dev.Timeout = *usbTimeout
-	if err = dev.Configure(); err != nil {
-		log.Fatalf("Configure failed: %v", err)
+	if fmask.set {
+		config.fsOptions.FileMask = fmask.value
+	}
+	if dmask.set {
+		config.fsOptions.DirMask = dmask.value
+	}
+	for _, s := range strings.Split(*debug, ",") {
+		config.debugs[s] = true
 	}
 
-	sids, err := fs.SelectStorages(dev, *storageFilter)
-	if err != nil {
-		log.Fatalf("selectStorages failed: %v", err)
+	if flag.NArg() > 0 {
+		if cmd, ok := commands[flag.Arg(0)]; ok {
+			os.Exit(runCommand(config, cmd, flag.Args()[1:]))
+		}
 	}
 
-	opts := fs.DeviceFsOptions{
-		RemovableVFat: *vfat,
-		Android:       *android,
+	if len(args) != 1 {
+		usage()
+		os.Exit(2)
 	}
-	root, err := fs.NewDeviceFSRoot(dev, sids, opts)
-	if err != nil {
-		log.Fatalf("NewDeviceFs failed: %v", err)
+	mountpoint := args[0]
+	if helper && !*foreground {
+		spawnBackground()
 	}
 
-	sec := time.Second
-	mountOpts := &fusefs.Options{
-		MountOptions: fuse.MountOptions{
-			SingleThreaded: true,
-			AllowOther:     *other,
-			Debug:          debugs["fuse"] || debugs["fs"],
-		},
-		UID:          uint32(syscall.Getuid()),
-		GID:          uint32(syscall.Getgid()),
-		AttrTimeout:  &sec,
-		EntryTimeout: &sec,
+	opts := config.fsOptions
+	var root interface {
+		fusefs.InodeEmbedder
+		OnUnmount()
 	}
-	server, err := fusefs.Mount(mountpoint, root, mountOpts)
+	if *all {
+		root = fs.NewMultiDeviceRoot(config.scan, *storageFilter, opts)
+	} else {
+		dev, err := config.open()
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer dev.Close()
+
+		sids, err := fs.SelectStorages(dev, *storageFilter)
+		if err != nil {
+			log.Fatalf("selectStorages failed: %v", err)
+		}
+
+		root, err = fs.NewDeviceFSRoot(dev, sids, opts)
+		if err != nil {
+			log.Fatalf("NewDeviceFs failed: %v", err)
+		}
+	}
+
+	server, err := fusefs.Mount(mountpoint, root, config.mountOptions())
 	if err != nil {
 		log.Fatalf("mount failed: %v", err)
 	}
 
 	server.WaitMount()
 	log.Printf("FUSE mounted")
+	notifyReady()
 	server.Wait()
 	root.OnUnmount()
 }
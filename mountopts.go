@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"log/syslog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Support for running as a mount(8) helper, eg. from /etc/fstab:
+//
+//   mtp  /media/phone  fuse.go-mtpfs  noauto,user,dev=Pixel,allow_other  0  0
+//
+// mount.fuse then runs "go-mtpfs mtp /media/phone -o OPTIONS".
+
+// mountOnlyOptions are interpreted by mount(8) itself.
+var mountOnlyOptions = map[string]bool{
+	"defaults": true,
+	"auto":     true,
+	"noauto":   true,
+	"user":     true,
+	"nouser":   true,
+	"users":    true,
+	"owner":    true,
+	"group":    true,
+	"nofail":   true,
+	"_netdev":  true,
+	"rw":       true,
+}
+
+// applyMountOptions sets the flags named in a comma separated list
+// of mount options. Underscores in names stand for dashes, and a
+// boolean flag without value is set to true. Other options are
+// returned, to be passed on to FUSE.
+func applyMountOptions(fl *flag.FlagSet, opts string) ([]string, error) {
+	var fuseOpts []string
+	for _, o := range strings.Split(opts, ",") {
+		if o == "" || mountOnlyOptions[o] || strings.HasPrefix(o, "x-") || strings.HasPrefix(o, "comment=") {
+			continue
+		}
+		key, val := o, ""
+		hasVal := false
+		if i := strings.Index(o, "="); i >= 0 {
+			key, val, hasVal = o[:i], o[i+1:], true
+		}
+		name := strings.Replace(key, "_", "-", -1)
+
+		f := fl.Lookup(name)
+		if f != nil && !hasVal {
+			if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+				val, hasVal = "true", true
+			}
+		}
+		if f == nil || name == "o" || !hasVal {
+			// Eg. "nosuid", or "dev", which is not "dev=REGEX".
+			fuseOpts = append(fuseOpts, o)
+			continue
+		}
+		if err := fl.Set(name, val); err != nil {
+			return nil, fmt.Errorf("option %s: %v", key, err)
+		}
+	}
+	return fuseOpts, nil
+}
+
+// isHelper returns whether the arguments are those of a mount helper:
+// the program is called as mount.NAME, or mount.fuse runs it as
+// "go-mtpfs SOURCE MOUNTPOINT -o OPTIONS". Other arguments, such as a
+// mistyped command, are not taken for a mount.
+func isHelper(argv0 string, args []string) bool {
+	if len(args) < 2 {
+		return false
+	}
+	if strings.HasPrefix(filepath.Base(argv0), "mount.") {
+		return true
+	}
+	for _, a := range args[2:] {
+		if a == "-o" || strings.HasPrefix(a, "-o=") {
+			return true
+		}
+	}
+	return false
+}
+
+// parseHelperArgs parses the arguments mount(8) gives a helper:
+// SOURCE MOUNTPOINT [-n] [-s] [-f] [-v] [-o OPTIONS]. The source is
+// not used. It returns the mount point, the options, and whether
+// this is a fake mount (-f).
+func parseHelperArgs(args []string) (mountpoint string, opts string, fake bool, err error) {
+	if len(args) < 2 {
+		return "", "", false, fmt.Errorf("need SOURCE MOUNTPOINT")
+	}
+	fl := flag.NewFlagSet("mount helper", flag.ContinueOnError)
+	fl.SetOutput(ioutil.Discard)
+	o := fl.String("o", "", "")
+	f := fl.Bool("f", false, "")
+	fl.Bool("n", false, "")
+	fl.Bool("s", false, "")
+	fl.Bool("v", false, "")
+	if err := fl.Parse(args[2:]); err != nil {
+		return "", "", false, err
+	}
+	if fl.NArg() > 0 {
+		return "", "", false, fmt.Errorf("unexpected arguments %q", fl.Args())
+	}
+	return args[1], *o, *f, nil
+}
+
+// octalValue is a flag holding an octal number, such as a umask.
+type octalValue struct {
+	value uint32
+	// set is true if the flag was given.
+	set bool
+}
+
+func (v *octalValue) String() string {
+	return fmt.Sprintf("%03o", v.value)
+}
+
+func parseOctal(s string) (uint32, error) {
+	n, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || n > 0777 {
+		return 0, fmt.Errorf("bad permission bits %q", s)
+	}
+	return uint32(n), nil
+}
+
+func (v *octalValue) Set(s string) error {
+	n, err := parseOctal(s)
+	if err != nil {
+		return err
+	}
+	v.value, v.set = n, true
+	return nil
+}
+
+// storageMasks is a repeatable flag of NAME=MASK, giving a umask for
+// the storage with description NAME.
+type storageMasks map[string]uint32
+
+func (m storageMasks) String() string {
+	var r []string
+	for k, v := range m {
+		r = append(r, fmt.Sprintf("%s=%03o", k, v))
+	}
+	sort.Strings(r)
+	return strings.Join(r, ",")
+}
+
+func (m storageMasks) Set(s string) error {
+	i := strings.LastIndex(s, "=")
+	if i <= 0 {
+		return fmt.Errorf("want STORAGE=MASK, got %q", s)
+	}
+	n, err := parseOctal(s[i+1:])
+	if err != nil {
+		return err
+	}
+	m[s[:i]] = n
+	return nil
+}
+
+// readyFDEnv names the file descriptor on which a backgrounded
+// mount logs until it is ready, and then reports readyMsg.
+const readyFDEnv = "GO_MTPFS_READY_FD"
+
+// readyMsg ends the log of a background process once it is ready.
+const readyMsg = "\x00ready"
+
+// readyPipe is the pipe to the parent of a background process.
+var readyPipe *os.File
+
+// spawnBackground runs the program again in the background, and
+// exits once the mount is ready, or with the background process's
+// status if mounting fails. It returns if this is the background
+// process. The background process has no stderr, as nobody reads it
+// once the parent exits; until then, it logs through the parent.
+func spawnBackground() {
+	if fd, err := strconv.Atoi(os.Getenv(readyFDEnv)); err == nil {
+		readyPipe = os.NewFile(uintptr(fd), "ready")
+		os.Unsetenv(readyFDEnv)
+		log.SetOutput(readyPipe)
+		return
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		log.Fatalf("cannot find executable: %v", err)
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	cmd := exec.Command(exe)
+	cmd.Args = os.Args
+	cmd.Env = append(os.Environ(), readyFDEnv+"=3")
+	cmd.ExtraFiles = []*os.File{w}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		log.Fatalf("starting background process: %v", err)
+	}
+	w.Close()
+
+	lines := bufio.NewScanner(r)
+	for lines.Scan() {
+		if lines.Text() == readyMsg {
+			os.Exit(0)
+		}
+		fmt.Fprintln(os.Stderr, lines.Text())
+	}
+	if err := cmd.Wait(); err != nil {
+		if exit, ok := err.(*exec.ExitError); ok && exit.ExitCode() > 0 {
+			os.Exit(exit.ExitCode())
+		}
+		log.Printf("background process: %v", err)
+	}
+	os.Exit(1)
+}
+
+// notifyReady tells the parent of a background process that the
+// mount is ready. From then on, messages go to syslog, if it is
+// available.
+func notifyReady() {
+	if readyPipe == nil {
+		return
+	}
+	fmt.Fprintf(readyPipe, "%s\n", readyMsg)
+	readyPipe.Close()
+	readyPipe = nil
+
+	if w, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, "go-mtpfs"); err == nil {
+		log.SetOutput(w)
+		log.SetFlags(0)
+	} else {
+		log.SetOutput(ioutil.Discard)
+	}
+}
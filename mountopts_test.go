@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"reflect"
+	"testing"
+)
+
+func TestApplyMountOptions(t *testing.T) {
+	fl := flag.NewFlagSet("test", flag.ContinueOnError)
+	dev := fl.String("dev", "", "")
+	timeout := fl.Int("usb-timeout", 5000, "")
+	android := fl.Bool("android", true, "")
+	ro := fl.Bool("ro", false, "")
+	umask := octalValue{}
+	fl.Var(&umask, "umask", "")
+	masks := storageMasks{}
+	fl.Var(masks, "storage-umask", "")
+
+	got, err := applyMountOptions(fl, "defaults,noauto,user,dev=Pixel|Nexus,usb_timeout=100,android=0,ro,umask=027,storage_umask=SD card=002,storage_umask=Internal=077,nosuid,dev,x-systemd.automount")
+	if err != nil {
+		t.Fatalf("applyMountOptions: %v", err)
+	}
+	if want := []string{"nosuid", "dev"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("FUSE options: got %q, want %q", got, want)
+	}
+	if *dev != "Pixel|Nexus" || *timeout != 100 || *android || !*ro || umask.value != 027 || !umask.set {
+		t.Errorf("got dev=%q usb-timeout=%d android=%v ro=%v umask=%v", *dev, *timeout, *android, *ro, umask)
+	}
+	if want := (storageMasks{"SD card": 002, "Internal": 077}); !reflect.DeepEqual(masks, want) {
+		t.Errorf("storage masks: got %v, want %v", masks, want)
+	}
+
+	if _, err := applyMountOptions(fl, "usb_timeout=soon"); err == nil {
+		t.Errorf("want error for bad value")
+	}
+}
+
+func TestParseHelperArgs(t *testing.T) {
+	mnt, opts, fake, err := parseHelperArgs([]string{"mtp", "/media/phone", "-n", "-o", "ro,dev=x"})
+	if err != nil {
+		t.Fatalf("parseHelperArgs: %v", err)
+	}
+	if mnt != "/media/phone" || opts != "ro,dev=x" || fake {
+		t.Errorf("got %q %q %v", mnt, opts, fake)
+	}
+	if _, _, _, err := parseHelperArgs([]string{"mtp", "/media/phone", "extra"}); err == nil {
+		t.Errorf("want error for extra arguments")
+	}
+}
+
+func TestIsHelper(t *testing.T) {
+	for _, c := range []struct {
+		argv0 string
+		args  []string
+		want  bool
+	}{
+		{"go-mtpfs", []string{"mtp", "/media/phone", "-o", "rw,dev=x"}, true},
+		{"go-mtpfs", []string{"mtp", "/media/phone", "-n", "-o=rw"}, true},
+		{"/sbin/mount.mtpfs", []string{"mtp", "/media/phone"}, true},
+		{"go-mtpfs", []string{"lss", "Internal storage"}, false},
+		{"go-mtpfs", []string{"mtp", "/media/phone", "extra"}, false},
+		{"mount.mtpfs", []string{"/media/phone"}, false},
+	} {
+		if got := isHelper(c.argv0, c.args); got != c.want {
+			t.Errorf("isHelper(%q, %q) = %v, want %v", c.argv0, c.args, got, c.want)
+		}
+	}
+}
@@ -7,40 +7,49 @@ import (
 	"reflect"
 	"strings"
 	"time"
-	"unicode/utf8"
+	"unicode/utf16"
 )
 
 var byteOrder = binary.LittleEndian
 
+// maxStrLen is the maximum number of UTF-16 code units in an MTP
+// string, including the terminating NUL.
+const maxStrLen = 255
+
+// StringTooLongError is returned when encoding a string that does not
+// fit in an MTP string.
+type StringTooLongError string
+
+func (s StringTooLongError) Error() string {
+	return fmt.Sprintf("mtp: string %q is longer than %d UTF-16 code units", string(s), maxStrLen-1)
+}
+
+// StringFits returns whether s can be encoded as an MTP string.
+func StringFits(s string) bool {
+	return len(utf16.Encode([]rune(s))) < maxStrLen
+}
+
 func decodeStr(r io.Reader) (string, error) {
 	var szSlice [1]byte
-	_, err := r.Read(szSlice[:])
-	if err != nil {
+	if _, err := io.ReadFull(r, szSlice[:]); err != nil {
 		return "", err
 	}
 	sz := int(szSlice[0])
 	if sz == 0 {
 		return "", nil
 	}
-	utfStr := make([]byte, 4*sz)
 	data := make([]byte, 2*sz)
-	n, err := r.Read(data)
-	if err != nil {
+	if _, err := io.ReadFull(r, data); err != nil {
 		return "", err
 	}
-	if n < len(data) {
-		return "", fmt.Errorf("underflow")
-	}
-	w := 0
-	for i := 0; i < int(2*sz); i += 2 {
-		cp := byteOrder.Uint16(data[i:])
-		w += utf8.EncodeRune(utfStr[w:], rune(cp))
+	units := make([]uint16, sz)
+	for i := range units {
+		units[i] = byteOrder.Uint16(data[2*i:])
 	}
-	if utfStr[w-1] == 0 {
-		w--
+	if units[sz-1] == 0 {
+		units = units[:sz-1]
 	}
-	s := string(utfStr[:w])
-	return s, nil
+	return string(utf16.Decode(units)), nil
 }
 
 func encodeStr(buf []byte, s string) ([]byte, error) {
@@ -49,22 +58,18 @@ func encodeStr(buf []byte, s string) ([]byte, error) {
 		return buf[:1], nil
 	}
 
-	codepoints := 0
-	buf = append(buf[:0], 0)
+	units := utf16.Encode([]rune(s))
+	if len(units)+1 > maxStrLen {
+		return nil, StringTooLongError(s)
+	}
 
-	var rune [2]byte
-	for _, r := range s {
-		byteOrder.PutUint16(rune[:], uint16(r))
-		buf = append(buf, rune[0], rune[1])
-		codepoints++
+	buf = append(buf[:0], byte(len(units)+1))
+	var unit [2]byte
+	for _, u := range units {
+		byteOrder.PutUint16(unit[:], u)
+		buf = append(buf, unit[0], unit[1])
 	}
 	buf = append(buf, 0, 0)
-	codepoints++
-	if codepoints > 254 {
-		return nil, fmt.Errorf("string too long")
-	}
-
-	buf[0] = byte(codepoints)
 	return buf, nil
 }
 
@@ -78,6 +83,8 @@ func encodeStrField(w io.Writer, f reflect.Value) error {
 	return err
 }
 
+// kindSize returns the encoded size of an integer kind, or 0 if the
+// kind cannot be encoded as an array element.
 func kindSize(k reflect.Kind) int {
 	switch k {
 	case reflect.Int8:
@@ -94,46 +101,128 @@ func kindSize(k reflect.Kind) int {
 		return 2
 	case reflect.Uint32:
 		return 4
+	case reflect.Uint64:
+		return 8
 	default:
-		panic(fmt.Sprintf("unknown kind %v", k))
+		return 0
 	}
 }
 
 var nullValue reflect.Value
 
+// arrayChunk is the number of array elements read in one go. The
+// element count comes from the device, so we grow the array as data
+// arrives rather than trusting the count for a single allocation.
+const arrayChunk = 4096
+
 func decodeArray(r io.Reader, t reflect.Type) (reflect.Value, error) {
 	var sz uint32
 	if err := binary.Read(r, byteOrder, &sz); err != nil {
 		return nullValue, err
 	}
 
-	ksz := int(kindSize(t.Elem().Kind()))
+	kind := t.Elem().Kind()
+	if kind == reflect.Struct || kind == reflect.Array {
+		return decodeDatasetArray(r, t, sz)
+	}
+	ksz := kindSize(kind)
+	if ksz == 0 {
+		return nullValue, fmt.Errorf("cannot decode array of %v", t.Elem())
+	}
 
-	data := make([]byte, int(sz)*ksz)
-	_, err := r.Read(data)
-	if err != nil {
-		return nullValue, err
+	chunk := int(sz)
+	if chunk > arrayChunk {
+		chunk = arrayChunk
 	}
-	slice := reflect.MakeSlice(t, int(sz), int(sz))
-	for i := 0; i < int(sz); i++ {
-		from := data[i*ksz:]
-		var val uint64
-		switch ksz {
-		case 1:
-			val = uint64(from[0])
-		case 2:
-			val = uint64(byteOrder.Uint16(from[0:]))
-		case 4:
-			val = uint64(byteOrder.Uint32(from[0:]))
-		default:
-			panic("unimp")
+	data := make([]byte, chunk*ksz)
+	slice := reflect.MakeSlice(t, 0, chunk)
+	for todo := int(sz); todo > 0; {
+		n := todo
+		if n > chunk {
+			n = chunk
 		}
+		todo -= n
+
+		if _, err := io.ReadFull(r, data[:n*ksz]); err != nil {
+			return nullValue, err
+		}
+
+		start := slice.Len()
+		slice = reflect.AppendSlice(slice, reflect.MakeSlice(t, n, n))
+		for i := 0; i < n; i++ {
+			from := data[i*ksz:]
+			var val uint64
+			switch ksz {
+			case 1:
+				val = uint64(from[0])
+			case 2:
+				val = uint64(byteOrder.Uint16(from))
+			case 4:
+				val = uint64(byteOrder.Uint32(from))
+			case 8:
+				val = byteOrder.Uint64(from)
+			}
 
-		slice.Index(i).SetUint(val)
+			elt := slice.Index(start + i)
+			switch kind {
+			case reflect.Int8:
+				elt.SetInt(int64(int8(val)))
+			case reflect.Int16:
+				elt.SetInt(int64(int16(val)))
+			case reflect.Int32:
+				elt.SetInt(int64(int32(val)))
+			case reflect.Int64:
+				elt.SetInt(int64(val))
+			default:
+				elt.SetUint(val)
+			}
+		}
+	}
+	return slice, nil
+}
+
+// decodeDatasetArray decodes an array of datasets or 128-bit values
+// following the element count. Elements are decoded one by one, so a
+// bogus count runs into the end of the data rather than into a huge
+// allocation.
+func decodeDatasetArray(r io.Reader, t reflect.Type, sz uint32) (reflect.Value, error) {
+	slice := reflect.MakeSlice(t, 0, 0)
+	for i := uint32(0); i < sz; i++ {
+		elt := reflect.New(t.Elem())
+		var err error
+		if t.Elem().Kind() == reflect.Struct {
+			err = Decode(r, elt.Interface())
+		} else {
+			err = decodeField(r, elt.Elem(), 0)
+		}
+		if err != nil {
+			return nullValue, err
+		}
+		slice = reflect.Append(slice, elt.Elem())
 	}
 	return slice, nil
 }
 
+// decodeUint32Stream decodes an array of uint32, calling fn for each
+// element as it is read.
+func decodeUint32Stream(r io.Reader, fn func(uint32) error) error {
+	var sz uint32
+	if err := binary.Read(r, byteOrder, &sz); err != nil {
+		return err
+	}
+
+	var data [4]byte
+	for i := uint32(0); i < sz; i++ {
+		if _, err := io.ReadFull(r, data[:]); err != nil {
+			return err
+		}
+		if err := fn(byteOrder.Uint32(data[:])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func encodeArray(w io.Writer, val reflect.Value) error {
 	sz := uint32(val.Len())
 	if err := binary.Write(w, byteOrder, &sz); err != nil {
@@ -141,15 +230,40 @@ func encodeArray(w io.Writer, val reflect.Value) error {
 	}
 
 	kind := val.Type().Elem().Kind()
+	if kind == reflect.Struct || kind == reflect.Array {
+		for i := 0; i < int(sz); i++ {
+			elt := val.Index(i)
+			var err error
+			if kind == reflect.Struct {
+				err = Encode(w, elt.Addr().Interface())
+			} else {
+				err = encodeField(w, elt)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
 	ksz := 0
 	if kind == reflect.Interface {
-		ksz = int(kindSize(val.Index(0).Elem().Kind()))
+		if sz > 0 {
+			kind = val.Index(0).Elem().Kind()
+		}
+		ksz = kindSize(kind)
 	} else {
-		ksz = int(kindSize(kind))
+		ksz = kindSize(kind)
+	}
+	if ksz == 0 && sz > 0 {
+		return fmt.Errorf("cannot encode array of %v", val.Type().Elem())
 	}
 	data := make([]byte, int(sz)*ksz)
 	for i := 0; i < int(sz); i++ {
 		elt := val.Index(i)
+		if elt.Kind() == reflect.Interface {
+			elt = elt.Elem()
+		}
 		to := data[i*ksz:]
 
 		switch kind {
@@ -185,12 +299,41 @@ const timeFormatNumTZ = "20060102T150405-0700"
 
 var zeroTime = time.Time{}
 
-func encodeTime(w io.Writer, f reflect.Value) error {
-	tptr := f.Addr().Interface().(*time.Time)
-	s := ""
-	if !tptr.Equal(zeroTime) {
-		s = tptr.Format(timeFormat)
+// FormatTime returns t as MTP DateTime string, in t's time zone. The
+// zero time gives the empty string.
+func FormatTime(t time.Time) string {
+	if t.Equal(zeroTime) {
+		return ""
 	}
+	return t.Format(timeFormat)
+}
+
+// ParseTime parses an MTP DateTime string. Times without zone are
+// taken to be in loc; a trailing "Z" means UTC. The empty string gives
+// the zero time.
+func ParseTime(s string, loc *time.Location) (time.Time, error) {
+	if s == "" {
+		return zeroTime, nil
+	}
+	// Samsung has trailing dots.
+	s = strings.TrimRight(s, ".")
+
+	// Jolla Sailfish has trailing "Z".
+	if strings.HasSuffix(s, "Z") {
+		s = strings.TrimSuffix(s, "Z")
+		loc = time.UTC
+	}
+
+	t, err := time.ParseInLocation(timeFormat, s, loc)
+	if err != nil {
+		// Nokia lumia has numTZ
+		t, err = time.Parse(timeFormatNumTZ, s)
+	}
+	return t, err
+}
+
+func encodeTime(w io.Writer, f reflect.Value) error {
+	s := FormatTime(*f.Addr().Interface().(*time.Time))
 
 	out := make([]byte, 2*len(s)+3)
 	enc, err := encodeStr(out, s)
@@ -206,22 +349,9 @@ func decodeTime(r io.Reader, f reflect.Value) error {
 	if err != nil {
 		return err
 	}
-	var t time.Time
-	if s != "" {
-		// Samsung has trailing dots.
-		s = strings.TrimRight(s, ".")
-
-		// Jolla Sailfish has trailing "Z".
-		s = strings.TrimRight(s, "Z")
-
-		t, err = time.Parse(timeFormat, s)
-		if err != nil {
-			// Nokia lumia has numTZ
-			t, err = time.Parse(timeFormatNumTZ, s)
-			if err != nil {
-				return err
-			}
-		}
+	t, err := ParseTime(s, time.UTC)
+	if err != nil {
+		return err
 	}
 	f.Set(reflect.ValueOf(t))
 	return nil
@@ -265,12 +395,23 @@ func decodeField(r io.Reader, f reflect.Value, typeSelector DataTypeSelector) er
 			return err
 		}
 		f.Set(sl)
+	case reflect.Array:
+		if f.Type().Elem().Kind() != reflect.Uint8 {
+			return fmt.Errorf("cannot decode %v", f.Type())
+		}
+		_, err := io.ReadFull(r, f.Slice(0, f.Len()).Bytes())
+		return err
 	case reflect.Interface:
-		val := InstantiateType(typeSelector)
-		decodeField(r, val, typeSelector)
+		val, err := instantiateType(typeSelector)
+		if err != nil {
+			return err
+		}
+		if err := decodeField(r, val, typeSelector); err != nil {
+			return err
+		}
 		f.Set(val)
 	default:
-		panic(fmt.Sprintf("unimplemented kind %v", f))
+		return fmt.Errorf("cannot decode kind %v", f.Kind())
 	}
 	return nil
 }
@@ -301,6 +442,14 @@ func encodeField(w io.Writer, f reflect.Value) error {
 		return encodeStrField(w, f)
 	case reflect.Slice:
 		return encodeArray(w, f)
+	case reflect.Array:
+		if f.Type().Elem().Kind() != reflect.Uint8 {
+			return fmt.Errorf("cannot encode %v", f.Type())
+		}
+		b := make([]byte, f.Len())
+		reflect.Copy(reflect.ValueOf(b), f)
+		_, err := w.Write(b)
+		return err
 	case reflect.Interface:
 		return encodeField(w, f.Elem())
 	default:
@@ -326,6 +475,9 @@ func decodeWithSelector(r io.Reader, iface interface{}, typeSel DataTypeSelector
 	}
 	val = val.Elem()
 	t := val.Type()
+	if t.Kind() != reflect.Struct {
+		return fmt.Errorf("need struct argument: %T", iface)
+	}
 
 	for i := 0; i < t.NumField(); i++ {
 		if err := decodeField(r, val.Field(i), typeSel); err != nil {
@@ -364,15 +516,27 @@ func Encode(w io.Writer, iface interface{}) error {
 
 }
 
-// Instantiates an object of wanted type as addressable value.
+// Instantiates an object of wanted type as addressable value. It
+// panics for unknown types.
 func InstantiateType(t DataTypeSelector) reflect.Value {
+	val, err := instantiateType(t)
+	if err != nil {
+		panic(err)
+	}
+	return val
+}
+
+// instantiateType is like InstantiateType, but returns an error for
+// type codes we can't handle, which may come from a misbehaving
+// device.
+func instantiateType(t DataTypeSelector) (reflect.Value, error) {
 	var val interface{}
 	switch t {
 	case DTC_INT8:
 		v := int8(0)
 		val = &v
 	case DTC_UINT8:
-		v := int8(0)
+		v := uint8(0)
 		val = &v
 	case DTC_INT16:
 		v := int16(0)
@@ -402,10 +566,10 @@ func InstantiateType(t DataTypeSelector) reflect.Value {
 		s := ""
 		val = &s
 	default:
-		panic(fmt.Sprintf("type not known 0x%x", t))
+		return nullValue, fmt.Errorf("type not known 0x%x", uint16(t))
 	}
 
-	return reflect.ValueOf(val).Elem()
+	return reflect.ValueOf(val).Elem(), nil
 }
 
 func decodePropDescForm(r io.Reader, selector DataTypeSelector, formFlag uint8) (DataDependentType, error) {
@@ -416,13 +580,47 @@ func decodePropDescForm(r io.Reader, selector DataTypeSelector, formFlag uint8)
 		return &f, err
 	} else if formFlag == DPFF_Enumeration {
 		f := PropDescEnumForm{}
-		err := decodeWithSelector(r, reflect.ValueOf(&f).Interface(),
-			selector)
+		err := f.decode(r, selector)
 		return &f, err
 	}
 	return nil, nil
 }
 
+// The enumeration form has a 16-bit count, unlike normal arrays, and
+// its elements are typed by the DataType of the descriptor.
+func (f *PropDescEnumForm) decode(r io.Reader, selector DataTypeSelector) error {
+	var n uint16
+	if err := binary.Read(r, byteOrder, &n); err != nil {
+		return err
+	}
+
+	f.Values = nil
+	for i := 0; i < int(n); i++ {
+		val, err := instantiateType(selector)
+		if err != nil {
+			return err
+		}
+		if err := decodeField(r, val, selector); err != nil {
+			return err
+		}
+		f.Values = append(f.Values, val.Interface())
+	}
+	return nil
+}
+
+func (f *PropDescEnumForm) Encode(w io.Writer) error {
+	n := uint16(len(f.Values))
+	if err := binary.Write(w, byteOrder, n); err != nil {
+		return err
+	}
+	for _, v := range f.Values {
+		if err := encodeField(w, reflect.ValueOf(&v).Elem()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (pd *ObjectPropDesc) Decode(r io.Reader) error {
 	if err := Decode(r, &pd.ObjectPropDescFixed); err != nil {
 		return err
@@ -445,7 +643,9 @@ func (pd *DevicePropDesc) Encode(w io.Writer) error {
 	if err := Encode(w, &pd.DevicePropDescFixed); err != nil {
 		return err
 	}
-
+	if pd.Form == nil {
+		return nil
+	}
 	return Encode(w, pd.Form)
 }
 
@@ -453,5 +653,33 @@ func (pd *ObjectPropDesc) Encode(w io.Writer) error {
 	if err := Encode(w, &pd.ObjectPropDescFixed); err != nil {
 		return err
 	}
+	if pd.Form == nil {
+		return nil
+	}
 	return Encode(w, pd.Form)
 }
+
+// Decode reads a value of type v.DataType. The type itself is not
+// part of the data.
+func (v *DataValue) Decode(r io.Reader) error {
+	val, err := instantiateType(v.DataType)
+	if err != nil {
+		return err
+	}
+	if err := decodeField(r, val, v.DataType); err != nil {
+		return err
+	}
+	v.Value = val.Interface()
+	return nil
+}
+
+func (v *DataValue) Encode(w io.Writer) error {
+	val, err := instantiateType(v.DataType)
+	if err != nil {
+		return err
+	}
+	if v.Value == nil || reflect.TypeOf(v.Value) != val.Type() {
+		return fmt.Errorf("value %#v does not have type %s", v.Value, DTC_names[int(v.DataType)])
+	}
+	return encodeField(w, reflect.ValueOf(v.Value))
+}
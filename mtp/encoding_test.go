@@ -173,6 +173,26 @@ func TestDecodeTime(t *testing.T) {
 	}
 }
 
+func TestDecodeTimeZone(t *testing.T) {
+	loc := time.FixedZone("test", 2*3600)
+	for in, want := range map[string]time.Time{
+		"20120101T010022":      time.Date(2012, 1, 1, 1, 0, 22, 0, loc),
+		"20120101T010022Z":     time.Date(2012, 1, 1, 1, 0, 22, 0, time.UTC),
+		"20120101T010022-0100": time.Date(2012, 1, 1, 2, 0, 22, 0, time.UTC),
+		"":                     {},
+	} {
+		got, err := ParseTime(in, loc)
+		if err != nil || !got.Equal(want) {
+			t.Errorf("ParseTime(%q) = %v, %v, want %v", in, got, err, want)
+		}
+	}
+
+	now := time.Date(2024, 1, 31, 23, 59, 58, 0, loc)
+	if got, want := FormatTime(now), "20240131T235958"; got != want {
+		t.Errorf("FormatTime: got %q want %q", got, want)
+	}
+}
+
 func TestVariantDPD(t *testing.T) {
 	uint16range := PropDescRangeForm{
 		MinimumValue: uint16(1),
@@ -208,7 +228,7 @@ func TestVariantDPD(t *testing.T) {
 	}
 }
 
-func DisabledTestVariantOPD(t *testing.T) {
+func TestVariantOPD(t *testing.T) {
 	uint16enum := PropDescEnumForm{
 		Values: []DataDependentType{uint16(1), uint16(11), uint16(2)},
 	}
@@ -268,3 +288,215 @@ func TestEncodeStr(t *testing.T) {
 		t.Fatalf("got %q, want %q", out, mtpStr)
 	}
 }
+
+func TestStrSurrogates(t *testing.T) {
+	test := "IMG 😀 𝄞.jpg"
+	out, err := encodeStr(nil, test)
+	if err != nil {
+		t.Fatalf("encodeStr: %v", err)
+	}
+
+	// 9 BMP characters + 2 surrogate pairs + NUL.
+	if want := 9 + 2*2 + 1; int(out[0]) != want {
+		t.Errorf("got length %d, want %d", out[0], want)
+	}
+	if want := []byte{0x3d, 0xd8, 0x00, 0xde}; bytes.Compare(out[9:13], want) != 0 {
+		t.Errorf("got %x for emoji, want %x", out[9:13], want)
+	}
+
+	roundtrip, err := decodeStr(bytes.NewBuffer(out))
+	if err != nil {
+		t.Fatalf("decodeStr: %v", err)
+	}
+	if roundtrip != test {
+		t.Fatalf("got %q, want %q", roundtrip, test)
+	}
+}
+
+func TestEncodeStrTooLong(t *testing.T) {
+	fits := strings.Repeat("x", 254)
+	if _, err := encodeStr(nil, fits); err != nil {
+		t.Errorf("encodeStr(254 chars): %v", err)
+	}
+	if !StringFits(fits) {
+		t.Errorf("StringFits(254 chars) = false")
+	}
+
+	long := strings.Repeat("😀", 128)
+	if _, err := encodeStr(nil, long); err == nil {
+		t.Errorf("encodeStr(128 emoji) succeeded")
+	} else if _, ok := err.(StringTooLongError); !ok {
+		t.Errorf("got error %T, want StringTooLongError", err)
+	}
+	if StringFits(long) {
+		t.Errorf("StringFits(128 emoji) = true")
+	}
+}
+
+func TestDecodeUint32Stream(t *testing.T) {
+	buf := &bytes.Buffer{}
+	want := []uint32{1, 0x10002, 0xffffffff}
+	if err := Encode(buf, &Uint32Array{want}); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	var got []uint32
+	if err := decodeUint32Stream(buf, func(v uint32) error {
+		got = append(got, v)
+		return nil
+	}); err != nil {
+		t.Fatalf("decodeUint32Stream: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// A count larger than the data must fail rather than block or
+	// allocate.
+	short := bytes.NewBuffer([]byte{0xff, 0xff, 0xff, 0xff, 1, 0, 0, 0})
+	got = nil
+	if err := decodeUint32Stream(short, func(v uint32) error {
+		got = append(got, v)
+		return nil
+	}); err == nil {
+		t.Errorf("decodeUint32Stream succeeded on short data")
+	}
+	if len(got) != 1 {
+		t.Errorf("got %d values before error, want 1", len(got))
+	}
+}
+
+func TestDecodeObjectPropValue(t *testing.T) {
+	vals := []ObjectPropValue{
+		{1, OPC_ObjectFileName, DTC_STR, "a.mp3"},
+		{1, OPC_ObjectSize, DTC_UINT64, uint64(1 << 33)},
+	}
+	buf := &bytes.Buffer{}
+	for i := range vals {
+		if err := Encode(buf, &vals[i]); err != nil {
+			t.Fatalf("encode: %v", err)
+		}
+	}
+	for _, want := range vals {
+		var got ObjectPropValue
+		if err := Decode(buf, &got); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %#v, want %#v", got, want)
+		}
+	}
+}
+
+func TestServiceInfoRoundtrip(t *testing.T) {
+	info := ServiceInfo{
+		ServiceID:        1,
+		ServiceStorageID: 0x20001,
+		ServiceGUID:      [16]byte{1, 2, 3},
+		ServiceName:      "Contacts",
+		UsesServiceGUIDs: [][16]byte{{4, 5, 6}},
+		Properties: []ServiceProperty{
+			{PropertyCode: 0xd001, PKeyID: 2, Name: "Version"},
+		},
+		Formats: []ServiceFormat{
+			{FormatCode: 0xbb81, Name: "Contact", MIMEType: "text/x-vcard"},
+		},
+		Methods:   []ServiceMethod{},
+		Events:    []ServiceEvent{},
+		DataBlock: []uint8{1, 2},
+	}
+
+	buf := &bytes.Buffer{}
+	if err := Encode(buf, &info); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	back := ServiceInfo{}
+	if err := Decode(buf, &back); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if !reflect.DeepEqual(back, info) {
+		t.Errorf("got %#v, want %#v", back, info)
+	}
+}
+
+func TestServiceCapabilitiesRoundtrip(t *testing.T) {
+	caps := ServiceCapabilities{
+		Formats: []ServiceFormatCapability{{
+			FormatCode: 0xbb81,
+			Props: []ObjectPropDesc{{
+				ObjectPropDescFixed{
+					ObjectPropertyCode:  OPC_ObjectFileName,
+					DataType:            DTC_STR,
+					GetSet:              DPGS_GetSet,
+					FactoryDefaultValue: "",
+				},
+				nil,
+			}},
+		}},
+	}
+
+	buf := &bytes.Buffer{}
+	if err := Encode(buf, &caps); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	back := ServiceCapabilities{}
+	if err := Decode(buf, &back); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if !reflect.DeepEqual(back, caps) {
+		t.Errorf("got %#v, want %#v", back, caps)
+	}
+}
+
+func TestDataValueRoundtrip(t *testing.T) {
+	for _, v := range []DataValue{
+		{DTC_UINT8, uint8(200)},
+		{DTC_INT32, int32(-5)},
+		{DTC_UINT128, [16]byte{0: 1, 15: 2}},
+		{DTC_STR, "phone"},
+	} {
+		buf := &bytes.Buffer{}
+		if err := Encode(buf, &v); err != nil {
+			t.Fatalf("Encode(%v): %v", v, err)
+		}
+		back := DataValue{DataType: v.DataType}
+		if err := Decode(buf, &back); err != nil {
+			t.Fatalf("Decode(%v): %v", v, err)
+		}
+		if !reflect.DeepEqual(back, v) {
+			t.Errorf("got %#v, want %#v", back, v)
+		}
+		if buf.Len() != 0 {
+			t.Errorf("%d bytes left over for %v", buf.Len(), v)
+		}
+	}
+
+	if err := Encode(&bytes.Buffer{}, &DataValue{DTC_UINT16, uint32(1)}); err == nil {
+		t.Error("Encode with mismatched type succeeded")
+	}
+}
+
+func TestDecodeEvent(t *testing.T) {
+	data := []byte{
+		0x10, 0, 0, 0, // length
+		4, 0, // event
+		0x0c, 0x40, // StorageInfoChanged
+		7, 0, 0, 0, // transaction
+		1, 0, 1, 0, // storage
+	}
+	e, err := decodeEvent(data)
+	if err != nil {
+		t.Fatalf("decodeEvent: %v", err)
+	}
+	if e.Code != EC_StorageInfoChanged || e.TransactionID != 7 || !reflect.DeepEqual(e.Param, []uint32{0x10001}) {
+		t.Errorf("got %+v", e)
+	}
+
+	data[4] = USB_CONTAINER_RESPONSE
+	if _, err := decodeEvent(data); err == nil {
+		t.Errorf("decodeEvent accepted a response")
+	}
+	if _, err := decodeEvent(data[:8]); err == nil {
+		t.Errorf("decodeEvent accepted a short packet")
+	}
+}
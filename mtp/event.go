@@ -0,0 +1,67 @@
+package mtp
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/hanwen/usb"
+)
+
+// Event is a notification from the device, such as EC_ObjectAdded.
+type Event struct {
+	Code          uint16
+	TransactionID uint32
+	Param         []uint32
+}
+
+func (e *Event) String() string {
+	return fmt.Sprintf("%s %x", EC_names[int(e.Code)], e.Param)
+}
+
+// decodeEvent decodes an event container from the interrupt endpoint.
+func decodeEvent(data []byte) (*Event, error) {
+	if len(data) < usbHdrLen {
+		return nil, fmt.Errorf("short event packet of 0x%x bytes", len(data))
+	}
+	n := int(byteOrder.Uint32(data))
+	typ := byteOrder.Uint16(data[4:])
+	if typ != USB_CONTAINER_EVENT {
+		return nil, fmt.Errorf("got type %d (%s) in event, want CONTAINER_EVENT", typ, USB_names[int(typ)])
+	}
+	if n < usbHdrLen || n > len(data) {
+		return nil, fmt.Errorf("event header specified 0x%x bytes, have 0x%x", n, len(data))
+	}
+	e := &Event{
+		Code:          byteOrder.Uint16(data[6:]),
+		TransactionID: byteOrder.Uint32(data[8:]),
+	}
+	for i := usbHdrLen; i+4 <= n; i += 4 {
+		e.Param = append(e.Param, byteOrder.Uint32(data[i:]))
+	}
+	return e, nil
+}
+
+// ErrClosed is returned by ReadEvent once the device is closed.
+var ErrClosed = errors.New("mtp: device is closed")
+
+// ReadEvent waits up to timeout milliseconds for an event. It returns
+// nil if none arrived. It uses only the interrupt endpoint, so it may
+// run concurrently with transactions. Close, which transactions call
+// on protocol errors, waits for it.
+func (d *Device) ReadEvent(timeout int) (*Event, error) {
+	d.eventMu.Lock()
+	defer d.eventMu.Unlock()
+	if d.h == nil {
+		return nil, ErrClosed
+	}
+	var buf [usbBulkLen]byte
+	n, err := d.h.InterruptTransfer(d.eventEP, buf[:], timeout)
+	if err == usb.ERROR_TIMEOUT {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	d.dataPrint(d.eventEP, buf[:n])
+	return decodeEvent(buf[:n])
+}
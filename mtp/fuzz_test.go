@@ -0,0 +1,82 @@
+package mtp
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Data from the device is untrusted; decoding must fail cleanly
+// rather than panic or allocate unbounded memory.
+
+func fuzzDecode(f *testing.F, newVal func() interface{}, seeds ...interface{}) {
+	for _, s := range seeds {
+		var buf bytes.Buffer
+		if err := Encode(&buf, s); err != nil {
+			f.Fatalf("encode seed %T: %v", s, err)
+		}
+		f.Add(buf.Bytes())
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		Decode(bytes.NewBuffer(data), newVal())
+	})
+}
+
+func FuzzDecodeDeviceInfo(f *testing.F) {
+	f.Add(parseHex(deviceInfoStr))
+	fuzzDecode(f, func() interface{} { return &DeviceInfo{} },
+		&DeviceInfo{Manufacturer: "manu", OperationsSupported: []uint16{OC_GetDeviceInfo}})
+}
+
+func FuzzDecodeObjectInfo(f *testing.F) {
+	f.Add(parseHex(objInfoStr))
+	fuzzDecode(f, func() interface{} { return &ObjectInfo{} },
+		&ObjectInfo{Filename: "file.txt"})
+}
+
+func FuzzDecodeStorageInfo(f *testing.F) {
+	fuzzDecode(f, func() interface{} { return &StorageInfo{} },
+		&StorageInfo{StorageDescription: "Internal storage", VolumeLabel: "label"})
+}
+
+func FuzzDecodeDevicePropDesc(f *testing.F) {
+	fuzzDecode(f, func() interface{} { return &DevicePropDesc{} },
+		&DevicePropDesc{
+			DevicePropDescFixed{
+				DevicePropertyCode:  DPC_BatteryLevel,
+				DataType:            DTC_UINT8,
+				FactoryDefaultValue: uint8(0),
+				CurrentValue:        uint8(50),
+				FormFlag:            DPFF_Range,
+			},
+			&PropDescRangeForm{uint8(0), uint8(100), uint8(1)},
+		},
+		&DevicePropDesc{
+			DevicePropDescFixed{
+				DevicePropertyCode:  DPC_MTP_DeviceFriendlyName,
+				DataType:            DTC_STR,
+				GetSet:              DPGS_GetSet,
+				FactoryDefaultValue: "",
+				CurrentValue:        "phone",
+				FormFlag:            DPFF_Enumeration,
+			},
+			&PropDescEnumForm{[]DataDependentType{"phone", "tablet"}},
+		})
+}
+
+func FuzzDecodeObjectPropDesc(f *testing.F) {
+	fuzzDecode(f, func() interface{} { return &ObjectPropDesc{} },
+		&ObjectPropDesc{
+			ObjectPropDescFixed{
+				ObjectPropertyCode:  OPC_ObjectSize,
+				DataType:            DTC_UINT64,
+				FactoryDefaultValue: uint64(0),
+				FormFlag:            DPFF_None,
+			},
+			nil,
+		})
+}
+
+func FuzzDecodeServiceInfo(f *testing.F) {
+	fuzzDecode(f, func() interface{} { return &ServiceInfo{} },
+		&ServiceInfo{ServiceName: "Status", Properties: []ServiceProperty{{Name: "Battery"}}})
+}
@@ -8,6 +8,7 @@ import (
 	"log"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/hanwen/usb"
@@ -44,6 +45,10 @@ type Device struct {
 	SeparateHeader bool
 
 	session *sessionData
+
+	// eventMu is held by ReadEvent, so Close does not close the
+	// handle under it.
+	eventMu sync.Mutex
 }
 
 type sessionData struct {
@@ -70,8 +75,11 @@ func (d *Device) sendMaxPacketSize() int {
 	return d.dev.GetMaxPacketSize(d.sendEP)
 }
 
-// Close releases the interface, and closes the device.
+// Close releases the interface, and closes the device. It waits for
+// a running ReadEvent to return.
 func (d *Device) Close() error {
+	d.eventMu.Lock()
+	defer d.eventMu.Unlock()
 	if d.h == nil {
 		return nil // or error?
 	}
@@ -239,7 +247,7 @@ func (d *Device) fetchPacket(dest []byte, header *usbBulkHeader) (rest []byte, e
 
 	buf := bytes.NewBuffer(dest[:n])
 	if err = binary.Read(buf, binary.LittleEndian, header); err != nil {
-		return nil, err
+		return nil, SyncError(fmt.Sprintf("short packet of 0x%x bytes", n))
 	}
 	return buf.Bytes(), nil
 }
@@ -252,6 +260,9 @@ func (d *Device) decodeRep(h *usbBulkHeader, rest []byte, rep *Container) error
 	rep.Code = h.Code
 	rep.TransactionID = h.TransactionID
 
+	if h.Length < usbHdrLen {
+		return SyncError(fmt.Sprintf("response header specified 0x%x bytes, shorter than the header", h.Length))
+	}
 	restLen := int(h.Length) - usbHdrLen
 	if restLen > len(rest) {
 		return fmt.Errorf("header specified 0x%x bytes, but have 0x%x",
@@ -308,6 +319,9 @@ func (d *Device) RunTransaction(req *Container, rep *Container,
 // before and after the call.
 func (d *Device) runTransaction(req *Container, rep *Container,
 	dest io.Writer, src io.Reader, writeSize int64) error {
+	if d.h == nil {
+		return fmt.Errorf("mtp: %s: device not open", OC_names[int(req.Code)])
+	}
 	var finalPacket []byte
 	if d.session != nil {
 		req.SessionID = d.session.sid
@@ -375,9 +389,11 @@ func (d *Device) runTransaction(req *Container, rep *Container,
 			if d.MTPDebug {
 				log.Printf("Reusing final packet")
 			}
-			rest = finalPacket
-			finalBuf := bytes.NewBuffer(finalPacket[:len(finalPacket)])
-			err = binary.Read(finalBuf, binary.LittleEndian, h)
+			finalBuf := bytes.NewBuffer(finalPacket)
+			if err := binary.Read(finalBuf, binary.LittleEndian, h); err != nil {
+				return SyncError(fmt.Sprintf("short final packet of 0x%x bytes", len(finalPacket)))
+			}
+			rest = finalBuf.Bytes()
 		} else {
 			rest, err = d.fetchPacket(data[:], h)
 		}
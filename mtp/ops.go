@@ -2,8 +2,10 @@ package mtp
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"math/rand"
 	"time"
@@ -50,18 +52,234 @@ func (d *Device) CloseSession() error {
 }
 
 func (d *Device) GetData(req *Container, info interface{}) error {
-	var buf bytes.Buffer
-	var rep Container
-	if err := d.RunTransaction(req, &rep, &buf, nil, 0); err != nil {
-		return err
-	}
-	err := Decode(&buf, info)
+	err := d.GetDataStream(req, func(r io.Reader) error {
+		return Decode(r, info)
+	})
 	if d.MTPDebug && err == nil {
 		log.Printf("MTP decoded %#v", info)
 	}
 	return err
 }
 
+// GetDataStream runs a transaction with a data phase, and calls
+// decode with a reader that yields the data as it arrives from the
+// device. Decode runs while the transaction is in progress, so it
+// must not issue other requests on the device. Data not consumed by
+// decode is discarded.
+func (d *Device) GetDataStream(req *Container, decode func(r io.Reader) error) error {
+	pr, pw := io.Pipe()
+	decodeErr := make(chan error, 1)
+	go func() {
+		err := decode(pr)
+		io.Copy(ioutil.Discard, pr)
+		decodeErr <- err
+	}()
+
+	var rep Container
+	err := d.RunTransaction(req, &rep, pw, nil, 0)
+	pw.CloseWithError(err)
+	if dErr := <-decodeErr; err == nil {
+		err = dErr
+	}
+	return err
+}
+
+// WalkObjectHandles is like GetObjectHandles, but calls fn for each
+// handle as it is received, rather than buffering the complete
+// list. See GetDataStream for restrictions on fn: as it cannot fetch
+// the object info, listings that need it should use WalkFolder.
+func (d *Device) WalkObjectHandles(storageID, objFormatCode, parent uint32, fn func(handle uint32) error) error {
+	var req Container
+	req.Code = OC_GetObjectHandles
+	req.Param = []uint32{storageID, objFormatCode, parent}
+	return d.GetDataStream(&req, func(r io.Reader) error {
+		return decodeUint32Stream(r, fn)
+	})
+}
+
+// WalkObjPropList runs GetObjPropList, and calls fn for each property
+// value as it is received. See GetDataStream for restrictions on fn.
+func (d *Device) WalkObjPropList(handle, objFormatCode, objPropCode, groupCode, depth uint32, fn func(val *ObjectPropValue) error) error {
+	var req Container
+	req.Code = OC_MTP_GetObjPropList
+	req.Param = []uint32{handle, objFormatCode, objPropCode, groupCode, depth}
+	return d.GetDataStream(&req, func(r io.Reader) error {
+		return decodePropList(r, fn)
+	})
+}
+
+// noParent is the parent of objects in the storage root.
+const noParent = 0xFFFFFFFF
+
+// WalkFolder lists a folder, calling fn for each object with its
+// info and size. With propList, the listing is one GetObjPropList of
+// depth 1, and fn runs as the properties of each object arrive; see
+// GetDataStream for restrictions on fn. The info then only has the
+// storage, format, parent, name, size and dates. Without propList,
+// it takes GetObjectHandles and a GetObjectInfo per object. Parent
+// is 0xFFFFFFFF for the storage root.
+func (d *Device) WalkFolder(storageID, parent uint32, propList bool, fn func(handle uint32, info *ObjectInfo, size int64) error) error {
+	if !propList {
+		return d.walkFolderInfo(storageID, parent, fn)
+	}
+
+	// GetObjPropList takes 0 for the root, and 0xFFFFFFFF for all
+	// objects.
+	req := parent
+	if parent == noParent {
+		req = 0
+	}
+	l := newFolderList(storageID, parent, fn)
+	if err := d.WalkObjPropList(req, 0, 0xFFFFFFFF, 0, 1, l.add); err != nil {
+		return err
+	}
+	return l.flush()
+}
+
+// folderList turns the property values of a folder listing into
+// objects. Devices send the values of one object together; an
+// object is passed on once values for the next one arrive.
+type folderList struct {
+	storageID, parent uint32
+	fn                func(handle uint32, info *ObjectInfo, size int64) error
+
+	// cur is the object being read, if info is set.
+	cur  uint32
+	info *ObjectInfo
+	size int64
+	// done holds the objects passed on.
+	done map[uint32]bool
+}
+
+func newFolderList(storageID, parent uint32, fn func(handle uint32, info *ObjectInfo, size int64) error) *folderList {
+	return &folderList{storageID: storageID, parent: parent, fn: fn, done: map[uint32]bool{}}
+}
+
+func (l *folderList) add(v *ObjectPropValue) error {
+	if l.info == nil || v.ObjectHandle != l.cur {
+		if err := l.flush(); err != nil {
+			return err
+		}
+		if l.done[v.ObjectHandle] {
+			return nil
+		}
+		l.cur, l.size = v.ObjectHandle, 0
+		l.info = &ObjectInfo{StorageID: l.storageID, ParentObject: l.parent}
+	}
+	l.size = setObjectProp(l.info, l.size, v)
+	return nil
+}
+
+// flush passes on the current object, unless it lies elsewhere: some
+// devices include the folder itself, or list the roots of all
+// storages.
+func (l *folderList) flush() error {
+	if l.info == nil {
+		return nil
+	}
+	info := l.info
+	l.info = nil
+	l.done[l.cur] = true
+	if l.cur == l.parent || info.StorageID != l.storageID || !inFolder(info.ParentObject, l.parent) {
+		return nil
+	}
+	return l.fn(l.cur, info, l.size)
+}
+
+// inFolder returns whether an object with parent p lies in the folder.
+func inFolder(p, folder uint32) bool {
+	if folder == noParent {
+		return p == 0 || p == noParent
+	}
+	return p == folder
+}
+
+// setObjectProp sets the ObjectInfo field for a property value, and
+// returns the size, which is updated for OPC_ObjectSize.
+func setObjectProp(info *ObjectInfo, size int64, v *ObjectPropValue) int64 {
+	switch val := v.Value.(type) {
+	case uint16:
+		switch v.PropertyCode {
+		case OPC_ObjectFormat:
+			info.ObjectFormat = val
+		case OPC_ProtectionStatus:
+			info.ProtectionStatus = val
+		}
+	case uint32:
+		switch v.PropertyCode {
+		case OPC_StorageID:
+			info.StorageID = val
+		case OPC_ParentObject:
+			info.ParentObject = val
+		}
+	case uint64:
+		if v.PropertyCode == OPC_ObjectSize {
+			size = int64(val)
+			info.CompressedSize = 0xFFFFFFFF
+			if val < 0xFFFFFFFF {
+				info.CompressedSize = uint32(val)
+			}
+		}
+	case string:
+		switch v.PropertyCode {
+		case OPC_ObjectFileName:
+			info.Filename = val
+		case OPC_DateCreated:
+			info.CaptureDate, _ = ParseTime(val, time.UTC)
+		case OPC_DateModified:
+			info.ModificationDate, _ = ParseTime(val, time.UTC)
+		}
+	}
+	return size
+}
+
+// walkFolderInfo is WalkFolder for devices without GetObjPropList.
+// Objects whose info cannot be read are left out.
+func (d *Device) walkFolderInfo(storageID, parent uint32, fn func(handle uint32, info *ObjectInfo, size int64) error) error {
+	var handles Uint32Array
+	if err := d.GetObjectHandles(storageID, 0, parent, &handles); err != nil {
+		return err
+	}
+	for _, h := range handles.Values {
+		var info ObjectInfo
+		if err := d.GetObjectInfo(h, &info); err != nil {
+			log.Printf("GetObjectInfo for handle 0x%x failed: %v", h, err)
+			continue
+		}
+		size := int64(info.CompressedSize)
+		if info.CompressedSize == 0xFFFFFFFF {
+			var val Uint64Value
+			if err := d.GetObjectPropValue(h, OPC_ObjectSize, &val); err != nil {
+				return fmt.Errorf("GetObjectPropValue 0x%x: %v", h, err)
+			}
+			size = int64(val.Value)
+		}
+		if err := fn(h, &info, size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodePropList decodes a property list, calling fn for each
+// element.
+func decodePropList(r io.Reader, fn func(val *ObjectPropValue) error) error {
+	var n uint32
+	if err := binary.Read(r, byteOrder, &n); err != nil {
+		return err
+	}
+	for i := uint32(0); i < n; i++ {
+		var val ObjectPropValue
+		if err := Decode(r, &val); err != nil {
+			return err
+		}
+		if err := fn(&val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (d *Device) GetDeviceInfo(info *DeviceInfo) error {
 	var req Container
 	req.Code = OC_GetDeviceInfo
@@ -170,6 +388,9 @@ func (d *Device) GetNumObjects(storageId uint32, formatCode uint16, parent uint3
 	if err := d.RunTransaction(&req, &rep, nil, nil, 0); err != nil {
 		return 0, err
 	}
+	if len(rep.Param) < 1 {
+		return 0, fmt.Errorf("GetNumObjects: got %v, need 1 response parameter", rep.Param)
+	}
 	return rep.Param[0], nil
 }
 
@@ -212,9 +433,56 @@ func (d *Device) GetObject(handle uint32, w io.Writer) error {
 	return d.RunTransaction(&req, &rep, w, nil, 0)
 }
 
+// GetPartialObject reads size bytes of an object from offset.
 func (d *Device) GetPartialObject(handle uint32, w io.Writer, offset uint32, size uint32) error {
 	var req, rep Container
-	req.Code = OC_ANDROID_GET_PARTIAL_OBJECT64
+	req.Code = OC_GetPartialObject
 	req.Param = []uint32{handle, offset, size}
 	return d.RunTransaction(&req, &rep, w, nil, 0)
 }
+
+// GetObjectReferences returns the objects referenced by an object,
+// eg. the tracks of a playlist or album.
+func (d *Device) GetObjectReferences(handle uint32, refs *Uint32Array) error {
+	var req Container
+	req.Code = OC_MTP_GetObjectReferences
+	req.Param = []uint32{handle}
+	return d.GetData(&req, refs)
+}
+
+// SetObjectReferences replaces the references of an object.
+func (d *Device) SetObjectReferences(handle uint32, refs *Uint32Array) error {
+	var req, rep Container
+	req.Code = OC_MTP_SetObjectReferences
+	req.Param = []uint32{handle}
+	return d.SendData(&req, &rep, refs)
+}
+
+// MoveObject moves an object to a different folder or storage. Use
+// 0xFFFFFFFF as parent to move to the storage root.
+func (d *Device) MoveObject(handle, storageID, parent uint32) error {
+	var req, rep Container
+	req.Code = OC_MoveObject
+	req.Param = []uint32{handle, storageID, parent}
+	return d.RunTransaction(&req, &rep, nil, nil, 0)
+}
+
+// SetDateTime sets the device clock (DPC_DateTime) to the wall clock
+// time of t. It returns the previous device time, read in t's time
+// zone, or the zero time if the device did not have a valid time.
+func (d *Device) SetDateTime(t time.Time) (time.Time, error) {
+	var old StringValue
+	if err := d.GetDevicePropValue(DPC_DateTime, &old); err != nil {
+		return zeroTime, err
+	}
+	prev, err := ParseTime(old.Value, t.Location())
+	if err != nil {
+		prev = zeroTime
+	}
+
+	val := StringValue{FormatTime(t)}
+	if err := d.SetDevicePropValue(DPC_DateTime, &val); err != nil {
+		return zeroTime, err
+	}
+	return prev, nil
+}
@@ -0,0 +1,82 @@
+package mtp
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFolderList(t *testing.T) {
+	type entry struct {
+		handle uint32
+		name   string
+		format uint16
+		size   int64
+		mtime  time.Time
+	}
+	var got []entry
+	l := newFolderList(0x10001, 7, func(h uint32, info *ObjectInfo, size int64) error {
+		if info.ParentObject != 7 || info.StorageID != 0x10001 {
+			t.Errorf("0x%x: parent 0x%x, storage 0x%x", h, info.ParentObject, info.StorageID)
+		}
+		got = append(got, entry{h, info.Filename, info.ObjectFormat, size, info.ModificationDate})
+		return nil
+	})
+
+	vals := []ObjectPropValue{
+		// The folder itself.
+		{7, OPC_ObjectFileName, DTC_STR, "DCIM"},
+		{7, OPC_ObjectFormat, DTC_UINT16, uint16(OFC_Association)},
+		{8, OPC_ObjectFileName, DTC_STR, "a.jpg"},
+		{8, OPC_ObjectFormat, DTC_UINT16, uint16(OFC_EXIF_JPEG)},
+		{8, OPC_ObjectSize, DTC_UINT64, uint64(5 << 30)},
+		{8, OPC_DateModified, DTC_STR, "20200102T030405"},
+		{8, OPC_ParentObject, DTC_UINT32, uint32(7)},
+		// In another folder.
+		{9, OPC_ObjectFileName, DTC_STR, "b.jpg"},
+		{9, OPC_ParentObject, DTC_UINT32, uint32(3)},
+		{10, OPC_ObjectFileName, DTC_STR, "Camera"},
+		{10, OPC_ObjectFormat, DTC_UINT16, uint16(OFC_Association)},
+		// Late value for an object passed on already.
+		{8, OPC_ObjectFileName, DTC_STR, "again.jpg"},
+	}
+	for i := range vals {
+		if err := l.add(&vals[i]); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+	if err := l.flush(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+
+	want := []entry{
+		{8, "a.jpg", OFC_EXIF_JPEG, 5 << 30, time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)},
+		{10, "Camera", OFC_Association, 0, time.Time{}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestFolderListRoot(t *testing.T) {
+	var got []uint32
+	l := newFolderList(0x10001, 0xFFFFFFFF, func(h uint32, info *ObjectInfo, size int64) error {
+		got = append(got, h)
+		return nil
+	})
+	vals := []ObjectPropValue{
+		{1, OPC_StorageID, DTC_UINT32, uint32(0x10001)},
+		{1, OPC_ParentObject, DTC_UINT32, uint32(0)},
+		// In the root of another storage.
+		{2, OPC_StorageID, DTC_UINT32, uint32(0x20001)},
+		{2, OPC_ParentObject, DTC_UINT32, uint32(0)},
+		{3, OPC_ParentObject, DTC_UINT32, uint32(0xFFFFFFFF)},
+	}
+	for i := range vals {
+		l.add(&vals[i])
+	}
+	l.flush()
+	if want := []uint32{1, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
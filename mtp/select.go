@@ -2,8 +2,10 @@ package mtp
 
 import (
 	"fmt"
+	"log"
 	"regexp"
 	"strings"
+	"sync"
 
 	"github.com/hanwen/usb"
 )
@@ -67,8 +69,8 @@ func FindDevices(c *usb.Context) ([]*Device, error) {
 	return cands, nil
 }
 
-// selectDevice finds a device that matches given pattern
-func selectDevice(cands []*Device, pattern string) (*Device, error) {
+// selectDevices opens the devices that match the given pattern.
+func selectDevices(cands []*Device, pattern string) ([]*Device, error) {
 	re, err := regexp.Compile(pattern)
 	if err != nil {
 		return nil, err
@@ -93,7 +95,14 @@ func selectDevice(cands []*Device, pattern string) (*Device, error) {
 	for i, cand := range cands {
 		id, err := cand.ID()
 		if err != nil {
-			// TODO - close cands
+			for _, c := range cands[i:] {
+				c.Close()
+				c.Done()
+			}
+			for _, c := range found {
+				c.Close()
+				c.Done()
+			}
 			return nil, fmt.Errorf("Id dev %d: %v", i, err)
 		}
 
@@ -110,23 +119,57 @@ func selectDevice(cands []*Device, pattern string) (*Device, error) {
 		return nil, fmt.Errorf("no device matched")
 	}
 
-	if len(found) > 1 {
-		return nil, fmt.Errorf("mtp: more than 1 device: %s", strings.Join(ids, ","))
+	var ok []*Device
+	for i, cand := range found {
+		if err = cand.setConfiguration(ids[i]); err != nil {
+			log.Printf("%v", err)
+			cand.Close()
+			cand.Done()
+			continue
+		}
+		ok = append(ok, cand)
 	}
+	if len(ok) == 0 {
+		return nil, err
+	}
+	return ok, nil
+}
+
+// setConfiguration selects the USB configuration holding the MTP
+// interface.
+func (d *Device) setConfiguration(id string) error {
+	config, err := d.h.GetConfiguration()
+	if err != nil {
+		return fmt.Errorf("could not get configuration of %v: %v",
+			id, err)
+	}
+	if config != d.configValue {
+		if err := d.h.SetConfiguration(d.configValue); err != nil {
+			return fmt.Errorf("could not set configuration of %v: %v",
+				id, err)
+		}
+	}
+	return nil
+}
 
-	cand := found[0]
-	config, err := cand.h.GetConfiguration()
+// selectDevice finds a device that matches given pattern
+func selectDevice(cands []*Device, pattern string) (*Device, error) {
+	found, err := selectDevices(cands, pattern)
 	if err != nil {
-		return nil, fmt.Errorf("could not get configuration of %v: %v",
-			ids[0], err)
+		return nil, err
 	}
-	if config != cand.configValue {
 
-		if err := cand.h.SetConfiguration(cand.configValue); err != nil {
-			return nil, fmt.Errorf("could not set configuration of %v: %v",
-				ids[0], err)
+	if len(found) > 1 {
+		var ids []string
+		for _, cand := range found {
+			id, _ := cand.ID()
+			ids = append(ids, id)
+			cand.Close()
+			cand.Done()
 		}
+		return nil, fmt.Errorf("mtp: more than 1 device: %s", strings.Join(ids, ","))
 	}
+
 	return found[0], nil
 }
 
@@ -144,3 +187,78 @@ func SelectDevice(pattern string) (*Device, error) {
 
 	return selectDevice(devs, pattern)
 }
+
+// SelectDevices returns all opened MTP devices that match the given
+// pattern.
+func SelectDevices(pattern string) ([]*Device, error) {
+	c := usb.NewContext()
+
+	devs, err := FindDevices(c)
+	if err != nil {
+		return nil, err
+	}
+	if len(devs) == 0 {
+		return nil, fmt.Errorf("no MTP devices found")
+	}
+
+	return selectDevices(devs, pattern)
+}
+
+// Location returns the USB bus and address of the device. It
+// identifies the device among the attached ones, without opening it.
+func (d *Device) Location() string {
+	return fmt.Sprintf("%03d:%03d", d.dev.GetBusNumber(), d.dev.GetDeviceAddress())
+}
+
+var scanContext struct {
+	sync.Once
+	c *usb.Context
+}
+
+// ScanDevices returns the locations of all attached MTP devices, and
+// the opened devices that match the pattern, skipping those whose
+// location is in skip. It is meant to be called repeatedly, to pick
+// up devices as they are attached.
+func ScanDevices(pattern string, skip map[string]bool) (map[string]bool, []*Device, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, nil, err
+	}
+	scanContext.Do(func() { scanContext.c = usb.NewContext() })
+	cands, err := FindDevices(scanContext.c)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	present := map[string]bool{}
+	var found []*Device
+	for _, cand := range cands {
+		loc := cand.Location()
+		present[loc] = true
+		if skip[loc] {
+			cand.Done()
+			continue
+		}
+		if err := cand.Open(); err != nil {
+			cand.Done()
+			continue
+		}
+		id, err := cand.ID()
+		if err == nil && re.FindStringIndex(id) == nil {
+			cand.Close()
+			cand.Done()
+			continue
+		}
+		if err == nil {
+			err = cand.setConfiguration(id)
+		}
+		if err != nil {
+			log.Printf("device at %s: %v", loc, err)
+			cand.Close()
+			cand.Done()
+			continue
+		}
+		found = append(found, cand)
+	}
+	return present, found, nil
+}
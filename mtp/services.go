@@ -0,0 +1,202 @@
+package mtp
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// MTP 1.1 device services. Services expose structured data (contacts,
+// calendar, device status) as typed properties and objects in a
+// service specific storage.
+
+const OC_MTP_GetServiceIDs = 0x9301
+const OC_MTP_GetServiceInfo = 0x9302
+const OC_MTP_GetServiceCapabilities = 0x9303
+const OC_MTP_GetServicePropDesc = 0x9304
+const OC_MTP_GetServicePropList = 0x9305
+const OC_MTP_SetServicePropList = 0x9306
+
+func init() {
+	// These overlap with Olympus vendor codes, but MTP 1.1 is what
+	// we speak.
+	OC_names[0x9301] = "MTP_GetServiceIDs"
+	OC_names[0x9302] = "MTP_GetServiceInfo"
+	OC_names[0x9303] = "MTP_GetServiceCapabilities"
+	OC_names[0x9304] = "MTP_GetServicePropDesc"
+	OC_names[0x9305] = "MTP_GetServicePropList"
+	OC_names[0x9306] = "MTP_SetServicePropList"
+}
+
+type ServiceProperty struct {
+	PropertyCode uint16
+	Namespace    [16]byte
+	PKeyID       uint32
+	Name         string
+}
+
+type ServiceFormat struct {
+	FormatCode     uint16
+	Namespace      [16]byte
+	PKeyID         uint32
+	Name           string
+	MIMEType       string
+	BaseFormatCode uint16
+}
+
+type ServiceMethod struct {
+	MethodCode       uint16
+	Namespace        [16]byte
+	PKeyID           uint32
+	Name             string
+	AssociatedFormat uint16
+}
+
+type ServiceEvent struct {
+	EventCode uint16
+	Namespace [16]byte
+	PKeyID    uint32
+	Name      string
+}
+
+// ServiceInfo describes a device service, as returned by
+// GetServiceInfo.
+type ServiceInfo struct {
+	ServiceID        uint32
+	ServiceStorageID uint32
+	ServicePGUID     [16]byte
+	ServiceVersion   uint32
+	ServiceGUID      [16]byte
+	ServiceName      string
+	ServiceType      uint16
+	BaseServiceID    uint32
+	UsesServiceGUIDs [][16]byte
+	Properties       []ServiceProperty
+	Formats          []ServiceFormat
+	Methods          []ServiceMethod
+	Events           []ServiceEvent
+	DataBlock        []uint8
+}
+
+// ServicePropDesc describes a service property.
+type ServicePropDesc struct {
+	ServicePropertyCode uint16
+	DataType            DataTypeSelector
+	GetSet              uint8
+	FormFlag            uint8
+	Form                interface{}
+}
+
+func (pd *ServicePropDesc) Decode(r io.Reader) error {
+	if err := binary.Read(r, byteOrder, &pd.ServicePropertyCode); err != nil {
+		return err
+	}
+	if err := binary.Read(r, byteOrder, &pd.DataType); err != nil {
+		return err
+	}
+	if err := binary.Read(r, byteOrder, &pd.GetSet); err != nil {
+		return err
+	}
+	if err := binary.Read(r, byteOrder, &pd.FormFlag); err != nil {
+		return err
+	}
+	form, err := decodePropDescForm(r, pd.DataType, pd.FormFlag)
+	pd.Form = form
+	return err
+}
+
+func (pd *ServicePropDesc) Encode(w io.Writer) error {
+	for _, v := range []interface{}{pd.ServicePropertyCode, pd.DataType, pd.GetSet, pd.FormFlag} {
+		if err := binary.Write(w, byteOrder, v); err != nil {
+			return err
+		}
+	}
+	if pd.Form == nil {
+		return nil
+	}
+	return Encode(w, pd.Form)
+}
+
+// ServiceFormatCapability lists the object properties that a service
+// supports for one of its formats.
+type ServiceFormatCapability struct {
+	FormatCode uint16
+	Props      []ObjectPropDesc
+}
+
+// ServiceCapabilities is the result of GetServiceCapabilities.
+type ServiceCapabilities struct {
+	Formats []ServiceFormatCapability
+}
+
+// GetServiceIDs returns the IDs of the services on the device.
+func (d *Device) GetServiceIDs(ids *Uint32Array) error {
+	var req Container
+	req.Code = OC_MTP_GetServiceIDs
+	return d.GetData(&req, ids)
+}
+
+func (d *Device) GetServiceInfo(serviceID uint32, info *ServiceInfo) error {
+	var req Container
+	req.Code = OC_MTP_GetServiceInfo
+	req.Param = []uint32{serviceID}
+	return d.GetData(&req, info)
+}
+
+// GetServiceCapabilities returns the supported object properties for
+// the given format, or for all formats if formatCode is 0.
+func (d *Device) GetServiceCapabilities(serviceID uint32, formatCode uint16, caps *ServiceCapabilities) error {
+	var req Container
+	req.Code = OC_MTP_GetServiceCapabilities
+	req.Param = []uint32{serviceID, uint32(formatCode)}
+	return d.GetData(&req, caps)
+}
+
+// GetServicePropDesc describes a service property. If propCode is
+// 0xFFFFFFFF, all properties are described.
+func (d *Device) GetServicePropDesc(serviceID uint32, propCode uint32) ([]ServicePropDesc, error) {
+	var req Container
+	req.Code = OC_MTP_GetServicePropDesc
+	req.Param = []uint32{serviceID, propCode}
+
+	var descs []ServicePropDesc
+	err := d.GetDataStream(&req, func(r io.Reader) error {
+		var n uint32
+		if err := binary.Read(r, byteOrder, &n); err != nil {
+			return err
+		}
+		for i := uint32(0); i < n; i++ {
+			var desc ServicePropDesc
+			if err := Decode(r, &desc); err != nil {
+				return err
+			}
+			descs = append(descs, desc)
+		}
+		return nil
+	})
+	return descs, err
+}
+
+// GetServicePropList returns the values of a service's properties. If
+// propCode is 0xFFFFFFFF, all properties are returned.
+func (d *Device) GetServicePropList(serviceID uint32, propCode uint32) ([]ObjectPropValue, error) {
+	var req Container
+	req.Code = OC_MTP_GetServicePropList
+	req.Param = []uint32{serviceID, propCode}
+
+	var vals []ObjectPropValue
+	err := d.GetDataStream(&req, func(r io.Reader) error {
+		return decodePropList(r, func(v *ObjectPropValue) error {
+			vals = append(vals, *v)
+			return nil
+		})
+	})
+	return vals, err
+}
+
+// WalkServiceObjects calls fn for the handle of each object that
+// belongs to the service. The objects live in the service's storage,
+// and can be read with GetObjectInfo and GetObject. See
+// GetDataStream for restrictions on fn.
+func (d *Device) WalkServiceObjects(info *ServiceInfo, fn func(handle uint32) error) error {
+	return d.WalkObjectHandles(info.ServiceStorageID, 0x0, 0x0, fn)
+}
@@ -35,6 +35,25 @@ type DeviceInfo struct {
 	SerialNumber              string
 }
 
+// HasOperation returns whether the device supports an operation.
+func (d *DeviceInfo) HasOperation(code uint16) bool {
+	return hasCode(d.OperationsSupported, code)
+}
+
+// HasDeviceProperty returns whether the device has a device property.
+func (d *DeviceInfo) HasDeviceProperty(code uint16) bool {
+	return hasCode(d.DevicePropertiesSupported, code)
+}
+
+func hasCode(codes []uint16, code uint16) bool {
+	for _, c := range codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
 // DataTypeSelector is the special type to indicate the actual type of
 // fields of DataDependentType.
 type DataTypeSelector uint16
@@ -88,6 +107,15 @@ type ObjectPropDesc struct {
 	Form interface{}
 }
 
+// ObjectPropValue is an element of the property list returned by
+// GetObjPropList.
+type ObjectPropValue struct {
+	ObjectHandle uint32
+	PropertyCode uint16
+	DataType     DataTypeSelector
+	Value        DataDependentType
+}
+
 type Uint32Array struct {
 	Values []uint32
 }
@@ -100,10 +128,23 @@ type Uint64Value struct {
 	Value uint64
 }
 
+// Uint128Value holds a 128-bit value, such as
+// OPC_PersistantUniqueObjectIdentifier, in device byte order.
+type Uint128Value struct {
+	Value [16]byte
+}
+
 type StringValue struct {
 	Value string
 }
 
+// DataValue is a single value whose encoding is given by DataType,
+// eg. a device property value typed by its DevicePropDesc.
+type DataValue struct {
+	DataType DataTypeSelector
+	Value    DataDependentType
+}
+
 type StorageInfo struct {
 	StorageType        uint16
 	FilesystemType     uint16
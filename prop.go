@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"math/big"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/hanwen/go-mtpfs/mtp"
+)
+
+// The prop command reads and writes device properties.
+
+// resolveProp returns the code for a property given as hex code, or
+// DPC_* name with or without the DPC_ and MTP_ prefixes, in any case.
+func resolveProp(name string) (uint16, error) {
+	if strings.HasPrefix(name, "0x") || strings.HasPrefix(name, "0X") {
+		n, err := strconv.ParseUint(name[2:], 16, 16)
+		if err != nil {
+			return 0, usageError(fmt.Sprintf("bad property code %q", name))
+		}
+		return uint16(n), nil
+	}
+
+	n := strings.TrimPrefix(name, "DPC_")
+	var exact, prefixed []uint16
+	for code, s := range mtp.DPC_names {
+		if strings.EqualFold(s, n) {
+			exact = append(exact, uint16(code))
+		} else if strings.EqualFold(s, "MTP_"+n) {
+			prefixed = append(prefixed, uint16(code))
+		}
+	}
+	if len(exact) == 0 {
+		exact = prefixed
+	}
+	switch len(exact) {
+	case 0:
+		return 0, usageError(fmt.Sprintf("unknown property %q", name))
+	case 1:
+		return exact[0], nil
+	default:
+		return 0, usageError(fmt.Sprintf("property name %q is ambiguous; use its code", name))
+	}
+}
+
+func devicePropName(code uint16) codeName {
+	return codeName{code, mtp.DPC_names[int(code)]}
+}
+
+var intTypes = map[mtp.DataTypeSelector]reflect.Type{
+	mtp.DTC_INT8:   reflect.TypeOf(int8(0)),
+	mtp.DTC_UINT8:  reflect.TypeOf(uint8(0)),
+	mtp.DTC_INT16:  reflect.TypeOf(int16(0)),
+	mtp.DTC_UINT16: reflect.TypeOf(uint16(0)),
+	mtp.DTC_INT32:  reflect.TypeOf(int32(0)),
+	mtp.DTC_UINT32: reflect.TypeOf(uint32(0)),
+	mtp.DTC_INT64:  reflect.TypeOf(int64(0)),
+	mtp.DTC_UINT64: reflect.TypeOf(uint64(0)),
+}
+
+// parsePropValue parses s as a value of type t. Integers may be
+// given in decimal, or hex with 0x. 128-bit values are given as 32
+// hex digits in device byte order, as the info command prints them.
+func parsePropValue(s string, t mtp.DataTypeSelector) (interface{}, error) {
+	switch t {
+	case mtp.DTC_STR:
+		return s, nil
+	case mtp.DTC_INT128, mtp.DTC_UINT128:
+		var v [16]byte
+		h := strings.TrimPrefix(s, "0x")
+		if len(h) != 2*len(v) {
+			return nil, fmt.Errorf("want %d hex digits, got %q", 2*len(v), s)
+		}
+		if _, err := hex.Decode(v[:], []byte(h)); err != nil {
+			return nil, fmt.Errorf("bad 128-bit value %q: %v", s, err)
+		}
+		return v, nil
+	}
+
+	typ, ok := intTypes[t]
+	if !ok {
+		return nil, fmt.Errorf("cannot set values of type %s", dataTypeName(t))
+	}
+	bits := typ.Bits()
+	if typ.Kind() >= reflect.Int8 && typ.Kind() <= reflect.Int64 {
+		n, err := strconv.ParseInt(s, 0, bits)
+		if err != nil {
+			return nil, fmt.Errorf("bad %s value %q", dataTypeName(t), s)
+		}
+		return reflect.ValueOf(n).Convert(typ).Interface(), nil
+	}
+	n, err := strconv.ParseUint(s, 0, bits)
+	if err != nil {
+		return nil, fmt.Errorf("bad %s value %q", dataTypeName(t), s)
+	}
+	return reflect.ValueOf(n).Convert(typ).Interface(), nil
+}
+
+func dataTypeName(t mtp.DataTypeSelector) string {
+	if n, ok := mtp.DTC_names[int(t)]; ok {
+		return n
+	}
+	return fmt.Sprintf("0x%x", uint16(t))
+}
+
+// bigValue returns an integer property value as big.Int. 128-bit
+// values are taken as unsigned.
+func bigValue(v interface{}) (*big.Int, bool) {
+	if b, ok := v.([16]byte); ok {
+		var be [16]byte
+		for i := range b {
+			be[len(b)-1-i] = b[i]
+		}
+		return new(big.Int).SetBytes(be[:]), true
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return big.NewInt(rv.Int()), true
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return new(big.Int).SetUint64(rv.Uint()), true
+	}
+	return nil, false
+}
+
+// checkForm checks a value against the range or enumeration form of
+// a property description.
+func checkForm(v interface{}, form interface{}) error {
+	switch f := form.(type) {
+	case *mtp.PropDescRangeForm:
+		n, ok1 := bigValue(v)
+		min, ok2 := bigValue(f.MinimumValue)
+		max, ok3 := bigValue(f.MaximumValue)
+		if !ok1 || !ok2 || !ok3 {
+			return nil
+		}
+		if n.Cmp(min) < 0 || n.Cmp(max) > 0 {
+			return fmt.Errorf("value %v out of range [%v..%v]", n, min, max)
+		}
+		if step, ok := bigValue(f.StepSize); ok && step.Sign() > 0 {
+			if new(big.Int).Mod(new(big.Int).Sub(n, min), step).Sign() != 0 {
+				return fmt.Errorf("value %v is not %v plus a multiple of %v", n, min, step)
+			}
+		}
+	case *mtp.PropDescEnumForm:
+		var vals []string
+		for _, e := range f.Values {
+			if reflect.DeepEqual(e, v) {
+				return nil
+			}
+			vals = append(vals, formatValue(jsonValue(e)))
+		}
+		return fmt.Errorf("value %s is not one of %s", formatValue(jsonValue(v)), strings.Join(vals, ", "))
+	}
+	return nil
+}
+
+// dateTimeRE matches the MTP DateTime format, eg. 20060102T150405.
+var dateTimeRE = regexp.MustCompile(`^\d{8}T\d{6}(\.\d)?(Z|[+-]\d{4})?$`)
+
+// checkPropValue parses and validates a new value for a property.
+func checkPropValue(desc *mtp.DevicePropDesc, s string) (interface{}, error) {
+	if desc.GetSet != mtp.DPGS_GetSet {
+		return nil, fmt.Errorf("property is read-only")
+	}
+	v, err := parsePropValue(s, desc.DataType)
+	if err != nil {
+		return nil, err
+	}
+	if desc.DevicePropertyCode == mtp.DPC_DateTime && !dateTimeRE.MatchString(s) {
+		return nil, fmt.Errorf("bad date %q, want YYYYMMDDThhmmss", s)
+	}
+	if err := checkForm(v, desc.Form); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func cmdProp(c *deviceConfig, args []string) error {
+	sub := "list"
+	if len(args) > 0 {
+		sub, args = args[0], args[1:]
+	}
+	min, max := 1, -1
+	switch sub {
+	case "list":
+		min, max = 0, 0
+	case "set":
+		min, max = 2, 2
+	case "get", "reset":
+	default:
+		return usageError(fmt.Sprintf("unknown subcommand %q", sub))
+	}
+	args, err := parseFlags(flag.NewFlagSet("prop", flag.ContinueOnError), args, min, max)
+	if err != nil {
+		return err
+	}
+	var codes []uint16
+	if sub != "list" {
+		names := args
+		if sub == "set" {
+			names = args[:1]
+		}
+		for _, a := range names {
+			code, err := resolveProp(a)
+			if err != nil {
+				return err
+			}
+			codes = append(codes, code)
+		}
+	}
+
+	dev, err := c.open()
+	if err != nil {
+		return err
+	}
+	defer dev.Close()
+
+	switch sub {
+	case "list":
+		var info mtp.DeviceInfo
+		if err := dev.GetDeviceInfo(&info); err != nil {
+			return err
+		}
+		for _, code := range info.DevicePropertiesSupported {
+			p := devicePropReport(dev, code)
+			p.print(os.Stdout, "")
+		}
+	case "get":
+		for _, code := range codes {
+			var desc mtp.DevicePropDesc
+			if err := dev.GetDevicePropDesc(code, &desc); err != nil {
+				return fmt.Errorf("%s: %v", devicePropName(code), err)
+			}
+			val := mtp.DataValue{DataType: desc.DataType}
+			if err := dev.GetDevicePropValue(uint32(code), &val); err != nil {
+				return fmt.Errorf("%s: %v", devicePropName(code), err)
+			}
+			fmt.Println(jsonValue(val.Value))
+		}
+	case "set":
+		code := codes[0]
+		var desc mtp.DevicePropDesc
+		if err := dev.GetDevicePropDesc(code, &desc); err != nil {
+			return fmt.Errorf("%s: %v", devicePropName(code), err)
+		}
+		v, err := checkPropValue(&desc, args[1])
+		if err != nil {
+			return fmt.Errorf("%s: %v", devicePropName(code), err)
+		}
+		if err := dev.SetDevicePropValue(uint32(code), &mtp.DataValue{DataType: desc.DataType, Value: v}); err != nil {
+			return fmt.Errorf("%s: %v", devicePropName(code), err)
+		}
+	case "reset":
+		for _, code := range codes {
+			if err := dev.ResetDevicePropValue(uint32(code)); err != nil {
+				return fmt.Errorf("%s: %v", devicePropName(code), err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/hanwen/go-mtpfs/mtp"
+)
+
+func TestResolveProp(t *testing.T) {
+	for name, want := range map[string]uint16{
+		"0x5011":                     mtp.DPC_DateTime,
+		"DateTime":                   mtp.DPC_DateTime,
+		"DPC_DateTime":               mtp.DPC_DateTime,
+		"batterylevel":               mtp.DPC_BatteryLevel,
+		"DeviceFriendlyName":         mtp.DPC_MTP_DeviceFriendlyName,
+		"DPC_MTP_DeviceFriendlyName": mtp.DPC_MTP_DeviceFriendlyName,
+	} {
+		got, err := resolveProp(name)
+		if err != nil || got != want {
+			t.Errorf("resolveProp(%q) = 0x%x, %v, want 0x%x", name, got, err, want)
+		}
+	}
+	for _, name := range []string{"NoSuchProperty", "0xzz", "0x12345"} {
+		if _, err := resolveProp(name); err == nil {
+			t.Errorf("resolveProp(%q) succeeded", name)
+		} else if _, ok := err.(usageError); !ok {
+			t.Errorf("resolveProp(%q): got %T, want usageError", name, err)
+		}
+	}
+}
+
+func TestParsePropValue(t *testing.T) {
+	for _, c := range []struct {
+		in   string
+		t    mtp.DataTypeSelector
+		want interface{}
+	}{
+		{"200", mtp.DTC_UINT8, uint8(200)},
+		{"-3", mtp.DTC_INT16, int16(-3)},
+		{"0x10", mtp.DTC_UINT32, uint32(16)},
+		{"phone", mtp.DTC_STR, "phone"},
+		{"0x0100000000000000000000000000000f", mtp.DTC_UINT128, [16]byte{0: 1, 15: 15}},
+	} {
+		got, err := parsePropValue(c.in, c.t)
+		if err != nil || got != c.want {
+			t.Errorf("parsePropValue(%q, %s) = %#v, %v, want %#v", c.in, mtp.DTC_names[int(c.t)], got, err, c.want)
+		}
+	}
+	for _, c := range []struct {
+		in string
+		t  mtp.DataTypeSelector
+	}{
+		{"256", mtp.DTC_UINT8},
+		{"-1", mtp.DTC_UINT16},
+		{"x", mtp.DTC_INT32},
+		{"0x01", mtp.DTC_UINT128},
+		{"1", mtp.DTC_UINT16 | mtp.DTC_ARRAY_MASK},
+	} {
+		if v, err := parsePropValue(c.in, c.t); err == nil {
+			t.Errorf("parsePropValue(%q, %s) = %#v, want error", c.in, mtp.DTC_names[int(c.t)], v)
+		}
+	}
+}
+
+func TestCheckPropValue(t *testing.T) {
+	battery := &mtp.DevicePropDesc{
+		DevicePropDescFixed: mtp.DevicePropDescFixed{
+			DevicePropertyCode: mtp.DPC_BatteryLevel,
+			DataType:           mtp.DTC_UINT8,
+			GetSet:             mtp.DPGS_GetSet,
+			FormFlag:           mtp.DPFF_Range,
+		},
+		Form: &mtp.PropDescRangeForm{MinimumValue: uint8(10), MaximumValue: uint8(100), StepSize: uint8(10)},
+	}
+	mode := &mtp.DevicePropDesc{
+		DevicePropDescFixed: mtp.DevicePropDescFixed{
+			DevicePropertyCode: mtp.DPC_FunctionalMode,
+			DataType:           mtp.DTC_UINT16,
+			GetSet:             mtp.DPGS_GetSet,
+			FormFlag:           mtp.DPFF_Enumeration,
+		},
+		Form: &mtp.PropDescEnumForm{Values: []mtp.DataDependentType{uint16(0), uint16(1)}},
+	}
+	date := &mtp.DevicePropDesc{
+		DevicePropDescFixed: mtp.DevicePropDescFixed{
+			DevicePropertyCode: mtp.DPC_DateTime,
+			DataType:           mtp.DTC_STR,
+			GetSet:             mtp.DPGS_GetSet,
+		},
+	}
+	readOnly := &mtp.DevicePropDesc{
+		DevicePropDescFixed: mtp.DevicePropDescFixed{
+			DevicePropertyCode: mtp.DPC_MTP_DeviceFriendlyName,
+			DataType:           mtp.DTC_STR,
+			GetSet:             mtp.DPGS_Get,
+		},
+	}
+
+	for _, c := range []struct {
+		desc *mtp.DevicePropDesc
+		in   string
+		ok   bool
+	}{
+		{battery, "50", true},
+		{battery, "100", true},
+		{battery, "5", false},
+		{battery, "110", false},
+		{battery, "55", false},
+		{mode, "1", true},
+		{mode, "2", false},
+		{date, "20240131T235959", true},
+		{date, "20240131T235959.5+0100", true},
+		{date, "2024-01-31", false},
+		{readOnly, "phone", false},
+	} {
+		_, err := checkPropValue(c.desc, c.in)
+		if (err == nil) != c.ok {
+			t.Errorf("checkPropValue(%s, %q): %v, want ok=%v", mtp.DPC_names[int(c.desc.DevicePropertyCode)], c.in, err, c.ok)
+		}
+	}
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/hanwen/go-mtpfs/fs"
+	"github.com/hanwen/go-mtpfs/mtp"
+)
+
+// Path based access to a device, for the commands. Paths look like
+// paths in the mount: STORAGE/dir/file, where STORAGE is the storage
+// description.
+
+const noParent = 0xFFFFFFFF
+
+// remoteObject is an object on the device. The root, which holds the
+// storages, has StorageID 0; a storage is a folder with handle
+// noParent.
+type remoteObject struct {
+	Path      string
+	Handle    uint32
+	StorageID uint32
+	Info      mtp.ObjectInfo
+	Size      int64
+}
+
+// parentHandle returns the handle of a parent as in remoteObject:
+// devices report objects in the storage root with parent 0 or
+// noParent.
+func parentHandle(h uint32) uint32 {
+	if h == 0 {
+		return noParent
+	}
+	return h
+}
+
+func (o *remoteObject) IsDir() bool {
+	return o.StorageID == 0 || o.Info.ObjectFormat == mtp.OFC_Association
+}
+
+func (o *remoteObject) IsStorage() bool {
+	return o.StorageID != 0 && o.Handle == noParent
+}
+
+// notFoundError is returned for paths that do not exist.
+type notFoundError string
+
+func (e notFoundError) Error() string {
+	return fmt.Sprintf("%s: no such file or directory", string(e))
+}
+
+type remote struct {
+	dev      *mtp.Device
+	root     remoteObject
+	storages []*remoteObject
+	// propList is set if folders are listed with GetObjPropList.
+	propList bool
+
+	// listings caches the contents of folders, which last as long
+	// as the command. Changes made through the remote are applied
+	// to them.
+	listings map[folderKey][]*remoteObject
+}
+
+// folderKey identifies a folder by its storage and handle.
+type folderKey struct {
+	storageID, handle uint32
+}
+
+func newRemote(dev *mtp.Device, storageFilter string) (*remote, error) {
+	sids, err := fs.SelectStorages(dev, storageFilter)
+	if err != nil {
+		return nil, err
+	}
+
+	var devInfo mtp.DeviceInfo
+	if err := dev.GetDeviceInfo(&devInfo); err != nil {
+		return nil, err
+	}
+
+	r := &remote{
+		dev:      dev,
+		propList: devInfo.HasOperation(mtp.OC_MTP_GetObjPropList),
+		listings: map[folderKey][]*remoteObject{},
+	}
+	r.root.Info.ObjectFormat = mtp.OFC_Association
+	for _, sid := range sids {
+		var info mtp.StorageInfo
+		if err := dev.GetStorageInfo(sid, &info); err != nil {
+			return nil, err
+		}
+		r.storages = append(r.storages, &remoteObject{
+			Path:      info.StorageDescription,
+			Handle:    noParent,
+			StorageID: sid,
+			Info: mtp.ObjectInfo{
+				StorageID:    sid,
+				ObjectFormat: mtp.OFC_Association,
+				ParentObject: noParent,
+				Filename:     info.StorageDescription,
+			},
+		})
+	}
+	return r, nil
+}
+
+// object fetches the info for a handle. Dir is the path of its parent.
+func (r *remote) object(dir string, handle uint32) (*remoteObject, error) {
+	o := &remoteObject{Handle: handle}
+	if err := r.dev.GetObjectInfo(handle, &o.Info); err != nil {
+		return nil, fmt.Errorf("GetObjectInfo 0x%x: %v", handle, err)
+	}
+	o.StorageID = o.Info.StorageID
+	o.Path = path.Join(dir, o.Info.Filename)
+	o.Size = int64(o.Info.CompressedSize)
+	if o.Info.CompressedSize == 0xFFFFFFFF {
+		var val mtp.Uint64Value
+		if err := r.dev.GetObjectPropValue(handle, mtp.OPC_ObjectSize, &val); err != nil {
+			return nil, fmt.Errorf("GetObjectPropValue 0x%x: %v", handle, err)
+		}
+		o.Size = int64(val.Value)
+	}
+	return o, nil
+}
+
+// children lists a folder.
+func (r *remote) children(dir *remoteObject) ([]*remoteObject, error) {
+	if dir.StorageID == 0 {
+		return r.storages, nil
+	}
+	if !dir.IsDir() {
+		return nil, fmt.Errorf("%s: not a directory", dir.Path)
+	}
+	key := folderKey{dir.StorageID, dir.Handle}
+	if l, ok := r.listings[key]; ok {
+		return l, nil
+	}
+
+	var result []*remoteObject
+	err := r.dev.WalkFolder(dir.StorageID, dir.Handle, r.propList, func(h uint32, info *mtp.ObjectInfo, size int64) error {
+		if info.Filename != "" {
+			result = append(result, &remoteObject{Handle: h, StorageID: dir.StorageID, Size: size, Info: *info})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listing %s: %v", dir.Path, err)
+	}
+
+	// Duplicate names get numbers, as in the mount.
+	names := map[uint32]string{}
+	for _, o := range result {
+		names[o.Handle] = o.Info.Filename
+	}
+	unique := fs.UniqueNames(names)
+	for _, o := range result {
+		o.Path = path.Join(dir.Path, unique[o.Handle])
+	}
+	r.listings[key] = result
+	return result, nil
+}
+
+// added records a new object in the listing of dir.
+func (r *remote) added(dir, o *remoteObject) {
+	key := folderKey{dir.StorageID, dir.Handle}
+	if l, ok := r.listings[key]; ok {
+		r.listings[key] = append(l, o)
+	}
+}
+
+// dropped removes a deleted object from the listings.
+func (r *remote) dropped(handle uint32) {
+	for key, l := range r.listings {
+		if key.handle == handle {
+			delete(r.listings, key)
+			continue
+		}
+		for i, o := range l {
+			if o.Handle == handle {
+				r.listings[key] = append(l[:i:i], l[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// forget drops all listings, eg. after objects moved.
+func (r *remote) forget() {
+	r.listings = map[folderKey][]*remoteObject{}
+}
+
+// deleteObject deletes an object, with its contents if it is a
+// folder. P names it in errors.
+func (r *remote) deleteObject(handle uint32, p string) error {
+	if err := r.dev.DeleteObject(handle); err != nil {
+		return fmt.Errorf("DeleteObject %s: %v", p, err)
+	}
+	r.dropped(handle)
+	return nil
+}
+
+func (r *remote) child(dir *remoteObject, name string) (*remoteObject, error) {
+	chs, err := r.children(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, ch := range chs {
+		if path.Base(ch.Path) == name {
+			return ch, nil
+		}
+	}
+	return nil, notFoundError(path.Join(dir.Path, name))
+}
+
+func splitPath(p string) []string {
+	var comps []string
+	for _, c := range strings.Split(p, "/") {
+		if c != "" && c != "." {
+			comps = append(comps, c)
+		}
+	}
+	return comps
+}
+
+// lookup resolves a path. The empty path and "/" are the root.
+func (r *remote) lookup(p string) (*remoteObject, error) {
+	o := &r.root
+	for _, c := range splitPath(p) {
+		ch, err := r.child(o, c)
+		if err != nil {
+			return nil, err
+		}
+		o = ch
+	}
+	return o, nil
+}
+
+// lookupParent resolves the directory part of p, and returns it with
+// the last path component.
+func (r *remote) lookupParent(p string) (*remoteObject, string, error) {
+	comps := splitPath(p)
+	if len(comps) < 2 {
+		return nil, "", fmt.Errorf("%q: need STORAGE/NAME", p)
+	}
+	dir, err := r.lookup(strings.Join(comps[:len(comps)-1], "/"))
+	if err != nil {
+		return nil, "", err
+	}
+	if !dir.IsDir() {
+		return nil, "", fmt.Errorf("%s: not a directory", dir.Path)
+	}
+	return dir, comps[len(comps)-1], nil
+}
+
+func (r *remote) mkdir(dir *remoteObject, name string) (*remoteObject, error) {
+	if dir.StorageID == 0 {
+		return nil, fmt.Errorf("cannot create storage %q", name)
+	}
+	info := mtp.ObjectInfo{
+		StorageID:        dir.StorageID,
+		ObjectFormat:     mtp.OFC_Association,
+		ParentObject:     dir.Handle,
+		Filename:         name,
+		ModificationDate: time.Now(),
+	}
+	_, _, handle, err := r.dev.SendObjectInfo(dir.StorageID, dir.Handle, &info)
+	if err != nil {
+		return nil, fmt.Errorf("SendObjectInfo %s: %v", path.Join(dir.Path, name), err)
+	}
+	o := &remoteObject{
+		Path:      path.Join(dir.Path, name),
+		Handle:    handle,
+		StorageID: dir.StorageID,
+		Info:      info,
+	}
+	r.added(dir, o)
+	return o, nil
+}
+
+// send creates a file with the given contents. Existing files are
+// replaced, as MTP cannot overwrite.
+func (r *remote) send(dir *remoteObject, name string, src io.Reader, size int64, mtime time.Time) (*remoteObject, error) {
+	return r.sendAs(dir, name, mtp.OFC_Undefined, src, size, mtime)
+}
+
+// sendAs is send with the given object format.
+func (r *remote) sendAs(dir *remoteObject, name string, format uint16, src io.Reader, size int64, mtime time.Time) (*remoteObject, error) {
+	if dir.StorageID == 0 {
+		return nil, fmt.Errorf("cannot create files outside a storage")
+	}
+	old, err := r.child(dir, name)
+	if _, ok := err.(notFoundError); ok {
+		old = nil
+	} else if err != nil {
+		return nil, err
+	} else if old.IsDir() {
+		return nil, fmt.Errorf("%s: is a directory", old.Path)
+	}
+	return r.replace(dir, name, format, old, src, size, mtime)
+}
+
+// partialPrefix marks files being sent to replace another.
+const partialPrefix = ".partial-"
+
+// replace creates a file in dir, replacing old if it is not nil. The
+// new contents are sent under a temporary name, and take the place of
+// old only once they are complete, so a failed transfer keeps old.
+func (r *remote) replace(dir *remoteObject, name string, format uint16, old *remoteObject, src io.Reader, size int64, mtime time.Time) (*remoteObject, error) {
+	sendName := name
+	if old != nil {
+		sendName = partialPrefix + name
+	}
+	o, err := r.sendObject(dir, sendName, format, src, size, mtime)
+	if err != nil || old == nil {
+		return o, err
+	}
+
+	err = r.dev.DeleteObject(old.Handle)
+	if rc, ok := err.(mtp.RCError); ok && rc == mtp.RC_InvalidObjectHandle {
+		// Gone already.
+		err = nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("DeleteObject %s: %v; new contents are in %s", old.Path, err, o.Path)
+	}
+	r.dropped(old.Handle)
+	v := mtp.StringValue{Value: name}
+	if err := r.dev.SetObjectPropValue(o.Handle, mtp.OPC_ObjectFileName, &v); err != nil {
+		return nil, fmt.Errorf("rename %s: %v", o.Path, err)
+	}
+	o.Info.Filename = name
+	o.Path = path.Join(dir.Path, name)
+	return o, nil
+}
+
+// sendObject creates a file, which must not exist yet. A partly sent
+// file is removed.
+func (r *remote) sendObject(dir *remoteObject, name string, format uint16, src io.Reader, size int64, mtime time.Time) (*remoteObject, error) {
+	info := mtp.ObjectInfo{
+		StorageID:        dir.StorageID,
+		ObjectFormat:     format,
+		ParentObject:     dir.Handle,
+		Filename:         name,
+		CompressedSize:   uint32(size),
+		ModificationDate: mtime,
+	}
+	if size > 0xFFFFFFFF {
+		info.CompressedSize = 0xFFFFFFFF
+	}
+	p := path.Join(dir.Path, name)
+	_, _, handle, err := r.dev.SendObjectInfo(dir.StorageID, dir.Handle, &info)
+	if err != nil {
+		return nil, fmt.Errorf("SendObjectInfo %s: %v", p, err)
+	}
+	if err := r.dev.SendObject(src, size); err != nil {
+		if derr := r.dev.DeleteObject(handle); derr != nil {
+			log.Printf("removing partial %s: %v", p, derr)
+		}
+		return nil, fmt.Errorf("SendObject %s: %v", p, err)
+	}
+	o := &remoteObject{
+		Path:      p,
+		Handle:    handle,
+		StorageID: dir.StorageID,
+		Info:      info,
+		Size:      size,
+	}
+	r.added(dir, o)
+	return o, nil
+}
+
+// progress reports transfer progress on stderr.
+type progress struct {
+	name  string
+	total int64
+	done  int64
+	start time.Time
+	last  time.Time
+	quiet bool
+	tty   bool
+}
+
+func newProgress(name string, total int64, quiet bool) *progress {
+	p := &progress{
+		name:  name,
+		total: total,
+		start: time.Now(),
+		quiet: quiet,
+	}
+	if fi, err := os.Stderr.Stat(); err == nil {
+		p.tty = fi.Mode()&os.ModeCharDevice != 0
+	}
+	return p
+}
+
+func (p *progress) add(n int) {
+	p.done += int64(n)
+	if p.quiet || !p.tty || time.Now().Sub(p.last) < 250*time.Millisecond {
+		return
+	}
+	p.last = time.Now()
+	pct := int64(100)
+	if p.total > 0 {
+		pct = 100 * p.done / p.total
+	}
+	fmt.Fprintf(os.Stderr, "\r%s: %d / %d bytes (%d%%)", p.name, p.done, p.total, pct)
+}
+
+func (p *progress) finish() {
+	if p.quiet {
+		return
+	}
+	if p.tty && !p.last.IsZero() {
+		fmt.Fprintf(os.Stderr, "\r")
+	}
+	dt := time.Now().Sub(p.start)
+	fmt.Fprintf(os.Stderr, "%s: %d bytes in %d ms. %.1f MB/s\n", p.name, p.done,
+		dt.Nanoseconds()/1e6, 1e3*float64(p.done)/float64(dt.Nanoseconds()+1))
+}
+
+type progressWriter struct {
+	w io.Writer
+	p *progress
+}
+
+func (w *progressWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.p.add(n)
+	return n, err
+}
+
+type progressReader struct {
+	r io.Reader
+	p *progress
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.p.add(n)
+	return n, err
+}
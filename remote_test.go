@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/hanwen/go-mtpfs/mtp"
+)
+
+func TestRemoteListings(t *testing.T) {
+	r := &remote{listings: map[folderKey][]*remoteObject{}}
+	dir := &remoteObject{Path: "SD/DCIM", Handle: 7, StorageID: 1, Info: mtp.ObjectInfo{ObjectFormat: mtp.OFC_Association}}
+	sub := &remoteObject{Path: "SD/DCIM/Camera", Handle: 8, StorageID: 1, Info: mtp.ObjectInfo{ObjectFormat: mtp.OFC_Association}}
+	a := &remoteObject{Path: "SD/DCIM/a.jpg", Handle: 9, StorageID: 1}
+	r.listings[folderKey{1, 7}] = []*remoteObject{sub, a}
+	r.listings[folderKey{1, 8}] = nil
+
+	b := &remoteObject{Path: "SD/DCIM/b.jpg", Handle: 10, StorageID: 1}
+	r.added(dir, b)
+	if chs, err := r.children(dir); err != nil || len(chs) != 3 || chs[2] != b {
+		t.Fatalf("after added: %v, %v", chs, err)
+	}
+	if _, err := r.child(dir, "b.jpg"); err != nil {
+		t.Errorf("child b.jpg: %v", err)
+	}
+
+	r.dropped(a.Handle)
+	r.dropped(sub.Handle)
+	if chs, _ := r.children(dir); len(chs) != 1 || chs[0] != b {
+		t.Errorf("after dropped: %v", chs)
+	}
+	if _, ok := r.listings[folderKey{1, 8}]; ok {
+		t.Errorf("listing of deleted folder kept")
+	}
+
+	r.forget()
+	if len(r.listings) != 0 {
+		t.Errorf("forget kept %v", r.listings)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"path"
+	"strings"
+
+	"github.com/hanwen/go-mtpfs/mtp"
+)
+
+// Restore of archives, as written by export, to a device folder.
+
+// restoreProps are the properties reapplied from the manifest. Others
+// describe where the object lives, or are set by SendObjectInfo.
+var restoreProps = map[uint16]bool{
+	mtp.OPC_DateModified:        true,
+	mtp.OPC_DateCreated:         true,
+	mtp.OPC_DateAuthored:        true,
+	mtp.OPC_Name:                true,
+	mtp.OPC_Keywords:            true,
+	mtp.OPC_Description:         true,
+	mtp.OPC_Artist:              true,
+	mtp.OPC_AlbumName:           true,
+	mtp.OPC_AlbumArtist:         true,
+	mtp.OPC_Composer:            true,
+	mtp.OPC_Genre:               true,
+	mtp.OPC_Track:               true,
+	mtp.OPC_OriginalReleaseDate: true,
+	mtp.OPC_Rating:              true,
+	mtp.OPC_UseCount:            true,
+}
+
+type restorer struct {
+	r     *remote
+	dest  *remoteObject
+	quiet bool
+
+	// objects maps archive paths to the manifest.
+	objects map[string]*manifestObject
+	// dirs caches folders by archive path.
+	dirs map[string]*remoteObject
+	// writable caches whether properties can be set, keyed by
+	// format<<16 | property code. The value is the data type, or
+	// DTC_UNDEF if the property cannot be set.
+	writable map[uint32]mtp.DataTypeSelector
+}
+
+// cleanArchivePath checks that an archive member stays inside the
+// destination.
+func cleanArchivePath(name string) (string, error) {
+	comps := splitPath(name)
+	for _, c := range comps {
+		if c == ".." {
+			return "", fmt.Errorf("%q: path leaves the destination", name)
+		}
+	}
+	if len(comps) == 0 {
+		return "", fmt.Errorf("%q: empty path", name)
+	}
+	return strings.Join(comps, "/"), nil
+}
+
+func (rs *restorer) loadManifest(src io.Reader) error {
+	data, err := ioutil.ReadAll(src)
+	if err != nil {
+		return err
+	}
+	var m archiveManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return fmt.Errorf("%s: %v", manifestName, err)
+	}
+	rs.objects = map[string]*manifestObject{}
+	for i := range m.Objects {
+		rs.objects[m.Objects[i].Path] = &m.Objects[i]
+	}
+	log.Printf("restoring %d objects exported from %s %s", len(m.Objects), m.Manufacturer, m.Model)
+	return nil
+}
+
+// dir returns the folder for an archive path, creating it if needed.
+func (rs *restorer) dir(name string) (*remoteObject, error) {
+	if name == "." {
+		return rs.dest, nil
+	}
+	if o := rs.dirs[name]; o != nil {
+		return o, nil
+	}
+	parent, err := rs.dir(path.Dir(name))
+	if err != nil {
+		return nil, err
+	}
+	base := path.Base(name)
+	o, err := rs.r.child(parent, base)
+	if _, ok := err.(notFoundError); ok {
+		o, err = rs.r.mkdir(parent, base)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !o.IsDir() {
+		return nil, fmt.Errorf("%s: not a directory", o.Path)
+	}
+	rs.dirs[name] = o
+	return o, nil
+}
+
+func (rs *restorer) file(e *archiveEntry, src io.Reader) error {
+	dir, err := rs.dir(path.Dir(e.name))
+	if err != nil {
+		return err
+	}
+	format := uint16(mtp.OFC_Undefined)
+	mo := rs.objects[e.name]
+	if mo != nil && mo.Info.ObjectFormat != mtp.OFC_Association {
+		format = mo.Info.ObjectFormat
+	}
+
+	p := newProgress(path.Join(dir.Path, path.Base(e.name)), e.size, rs.quiet)
+	o, err := rs.r.sendAs(dir, path.Base(e.name), format, &progressReader{src, p}, e.size, e.mtime)
+	if err != nil {
+		return err
+	}
+	p.finish()
+	if mo != nil {
+		rs.setProps(o, mo.Properties)
+	}
+	return nil
+}
+
+// setProps reapplies recorded properties where the device allows it.
+// Failures are logged, as the file itself was restored.
+func (rs *restorer) setProps(o *remoteObject, props []manifestProp) {
+	format := o.Info.ObjectFormat
+	for _, prop := range props {
+		if !restoreProps[prop.Code] {
+			continue
+		}
+		key := uint32(format)<<16 | uint32(prop.Code)
+		t, ok := rs.writable[key]
+		if !ok {
+			var desc mtp.ObjectPropDesc
+			if err := rs.r.dev.GetObjectPropDesc(prop.Code, format, &desc); err == nil && desc.GetSet == mtp.DPGS_GetSet {
+				t = desc.DataType
+			}
+			rs.writable[key] = t
+		}
+		if t == mtp.DTC_UNDEF {
+			continue
+		}
+		v, err := parsePropValue(prop.Value, t)
+		if err == nil {
+			err = rs.r.dev.SetObjectPropValue(o.Handle, prop.Code, &mtp.DataValue{DataType: t, Value: v})
+		}
+		if err != nil {
+			log.Printf("%s: setting %s: %v", o.Path, mtp.OPC_names[int(prop.Code)], err)
+		}
+	}
+}
+
+func cmdImportArchive(c *deviceConfig, args []string) error {
+	fl := flag.NewFlagSet("import-archive", flag.ContinueOnError)
+	quiet := fl.Bool("q", false, "do not report progress")
+	args, err := parseFlags(fl, args, 2, 2)
+	if err != nil {
+		return err
+	}
+	ar, err := openArchive(args[0])
+	if err != nil {
+		return err
+	}
+	defer ar.Close()
+
+	return c.withRemote(func(r *remote) error {
+		dest, err := r.lookup(args[1])
+		if err != nil {
+			return err
+		}
+		if !dest.IsDir() {
+			return fmt.Errorf("%s: not a directory", dest.Path)
+		}
+		rs := &restorer{
+			r:        r,
+			dest:     dest,
+			quiet:    *quiet,
+			dirs:     map[string]*remoteObject{},
+			writable: map[uint32]mtp.DataTypeSelector{},
+		}
+		first := true
+		for ; ; first = false {
+			e, src, err := ar.next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if e.name == manifestName {
+				if !first {
+					log.Printf("%s is not the first member; ignoring it", manifestName)
+					continue
+				}
+				if err := rs.loadManifest(src); err != nil {
+					return err
+				}
+				continue
+			}
+			if e.name, err = cleanArchivePath(e.name); err != nil {
+				return err
+			}
+			if e.dir {
+				_, err = rs.dir(e.name)
+			} else {
+				err = rs.file(e, src)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	})
+}
@@ -0,0 +1,530 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hanwen/go-mtpfs/iofs"
+	"github.com/hanwen/go-mtpfs/mtp"
+	"golang.org/x/net/webdav"
+)
+
+// Device access for the network servers (WebDAV, SFTP), which may
+// run requests concurrently. The tree is the same as in the mount:
+// storages at the top, named by their description.
+
+// serveCacheTime is how long directory listings are reused.
+const serveCacheTime = time.Second
+
+type serveFS struct {
+	// mu serializes device access. It is held during uploads.
+	mu       sync.Mutex
+	r        *remote
+	readOnly bool
+
+	// ops holds the partial reads of the device.
+	ops iofs.ReadOps
+	// move is set if the device supports MoveObject.
+	move bool
+
+	// listings caches directory contents by path.
+	listings map[string]*serveListing
+}
+
+type serveListing struct {
+	time     time.Time
+	children []*remoteObject
+}
+
+var _ = (webdav.FileSystem)((*serveFS)(nil))
+
+func newServeFS(r *remote, readOnly bool) (*serveFS, error) {
+	var info mtp.DeviceInfo
+	if err := r.dev.GetDeviceInfo(&info); err != nil {
+		return nil, err
+	}
+	d := &serveFS{
+		r:        r,
+		readOnly: readOnly,
+		listings: map[string]*serveListing{},
+	}
+	d.ops = iofs.DeviceReadOps(&info)
+	d.move = info.HasOperation(mtp.OC_MoveObject)
+	return d, nil
+}
+
+// children lists a directory, using a recent listing if possible.
+func (d *serveFS) children(dir *remoteObject) ([]*remoteObject, error) {
+	if l := d.listings[dir.Path]; l != nil && time.Now().Sub(l.time) < serveCacheTime {
+		return l.children, nil
+	}
+	// The device may have changed since the remote listed it.
+	d.r.forget()
+	chs, err := d.r.children(dir)
+	if err != nil {
+		return nil, err
+	}
+	d.listings[dir.Path] = &serveListing{time.Now(), chs}
+	return chs, nil
+}
+
+// changed drops cached listings after a modification.
+func (d *serveFS) changed() {
+	d.listings = map[string]*serveListing{}
+	d.r.forget()
+}
+
+// lookup resolves a WebDAV path. Errors for missing paths satisfy
+// os.IsNotExist.
+func (d *serveFS) lookup(op, name string) (*remoteObject, error) {
+	o := &d.r.root
+	for _, c := range splitPath(name) {
+		if !o.IsDir() {
+			return nil, &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+		}
+		chs, err := d.children(o)
+		if err != nil {
+			return nil, err
+		}
+		var found *remoteObject
+		for _, ch := range chs {
+			if path.Base(ch.Path) == c {
+				found = ch
+				break
+			}
+		}
+		if found == nil {
+			return nil, &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+		}
+		o = found
+	}
+	return o, nil
+}
+
+// lookupParent resolves the folder for a new object. It must be in a
+// storage.
+func (d *serveFS) lookupParent(op, name string) (*remoteObject, string, error) {
+	comps := splitPath(name)
+	if len(comps) < 2 {
+		return nil, "", &os.PathError{Op: op, Path: name, Err: os.ErrPermission}
+	}
+	dir, err := d.lookup(op, strings.Join(comps[:len(comps)-1], "/"))
+	if err != nil {
+		return nil, "", err
+	}
+	if !dir.IsDir() {
+		return nil, "", &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	}
+	return dir, comps[len(comps)-1], nil
+}
+
+func (d *serveFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if d.readOnly {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrPermission}
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	dir, base, err := d.lookupParent("mkdir", name)
+	if err != nil {
+		return err
+	}
+	if _, err := d.lookup("mkdir", name); err == nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+	d.changed()
+	_, err = d.r.mkdir(dir, base)
+	return err
+}
+
+func (d *serveFS) RemoveAll(ctx context.Context, name string) error {
+	if d.readOnly {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrPermission}
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	o, err := d.lookup("remove", name)
+	if err != nil {
+		return err
+	}
+	if o.StorageID == 0 || o.IsStorage() {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrPermission}
+	}
+	d.changed()
+	// Deleting a folder deletes its contents.
+	return d.r.deleteObject(o.Handle, o.Path)
+}
+
+func (d *serveFS) Rename(ctx context.Context, oldName, newName string) error {
+	if d.readOnly {
+		return &os.PathError{Op: "rename", Path: oldName, Err: os.ErrPermission}
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	src, err := d.lookup("rename", oldName)
+	if err != nil {
+		return err
+	}
+	if src.StorageID == 0 || src.IsStorage() {
+		return &os.PathError{Op: "rename", Path: oldName, Err: os.ErrPermission}
+	}
+	dir, name, err := d.lookupParent("rename", newName)
+	if err != nil {
+		return err
+	}
+	if dir.StorageID == 0 {
+		return &os.PathError{Op: "rename", Path: newName, Err: os.ErrPermission}
+	}
+	if _, err := d.lookup("rename", newName); err == nil {
+		return &os.PathError{Op: "rename", Path: newName, Err: os.ErrExist}
+	}
+
+	d.changed()
+	if dir.Handle != parentHandle(src.Info.ParentObject) || dir.StorageID != src.StorageID {
+		if !d.move {
+			return fmt.Errorf("%s: device cannot move objects", src.Path)
+		}
+		if err := d.r.dev.MoveObject(src.Handle, dir.StorageID, dir.Handle); err != nil {
+			return fmt.Errorf("MoveObject %s: %v", src.Path, err)
+		}
+	}
+	if name != src.Info.Filename {
+		v := mtp.StringValue{Value: name}
+		if err := d.r.dev.SetObjectPropValue(src.Handle, mtp.OPC_ObjectFileName, &v); err != nil {
+			return fmt.Errorf("rename %s: %v", src.Path, err)
+		}
+	}
+	return nil
+}
+
+func (d *serveFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	o, err := d.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return serveInfo{o}, nil
+}
+
+// uploadSizeKey is the context key for the size of an upload, eg. the
+// Content-Length of a PUT request. If it is known, the upload streams
+// to the device.
+type uploadSizeKey struct{}
+
+func (d *serveFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		o, err := d.lookup("open", name)
+		if err != nil {
+			return nil, err
+		}
+		f := &serveFile{fs: d, obj: o}
+		if !o.IsDir() {
+			f.r = iofs.NewObjectReader(d.r.dev, d.ops, o.Handle, o.Size)
+		}
+		return f, nil
+	}
+
+	if d.readOnly {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrPermission}
+	}
+	if flag&os.O_TRUNC == 0 {
+		// MTP can only replace files as a whole.
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrPermission}
+	}
+	d.mu.Lock()
+	dir, base, err := d.lookupParent("open", name)
+	if err == nil && dir.StorageID == 0 {
+		err = &os.PathError{Op: "open", Path: name, Err: os.ErrPermission}
+	}
+	if err == nil {
+		if o, lerr := d.lookup("open", name); lerr == nil && o.IsDir() {
+			err = &os.PathError{Op: "open", Path: name, Err: errors.New("is a directory")}
+		}
+	}
+	if err != nil {
+		d.mu.Unlock()
+		return nil, err
+	}
+
+	w := &serveWriter{fs: d, dir: dir, name: base, size: -1}
+	if size, ok := ctx.Value(uploadSizeKey{}).(int64); ok && size >= 0 {
+		// Keep the lock: the device is busy until Close.
+		w.startStream(size)
+		return w, nil
+	}
+	d.mu.Unlock()
+
+	f, err := ioutil.TempFile("", "go-mtpfs-dav")
+	if err != nil {
+		return nil, err
+	}
+	w.spool = f
+	return w, nil
+}
+
+// serveInfo is the os.FileInfo for an object.
+type serveInfo struct {
+	obj *remoteObject
+}
+
+func (fi serveInfo) Name() string {
+	if fi.obj.Path == "" {
+		return "/"
+	}
+	return path.Base(fi.obj.Path)
+}
+
+func (fi serveInfo) Size() int64 {
+	return fi.obj.Size
+}
+
+func (fi serveInfo) Mode() os.FileMode {
+	if fi.obj.IsDir() {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+func (fi serveInfo) ModTime() time.Time {
+	return fi.obj.Info.ModificationDate
+}
+
+func (fi serveInfo) IsDir() bool {
+	return fi.obj.IsDir()
+}
+
+func (fi serveInfo) Sys() interface{} {
+	return &fi.obj.Info
+}
+
+// ContentType guesses from the name, so PROPFIND need not read from
+// every file.
+func (fi serveInfo) ContentType(ctx context.Context) (string, error) {
+	if t := mime.TypeByExtension(path.Ext(fi.obj.Path)); t != "" {
+		return t, nil
+	}
+	return "application/octet-stream", nil
+}
+
+var errReadOnlyFile = errors.New("file not open for writing")
+
+// serveFile is a file or directory opened for reading.
+type serveFile struct {
+	fs  *serveFS
+	obj *remoteObject
+	off int64
+
+	// dirRead is set once Readdir returned all entries.
+	dirRead bool
+	// r reads the contents of files.
+	r *iofs.ObjectReader
+}
+
+func (f *serveFile) Close() error {
+	f.r = nil
+	return nil
+}
+
+func (f *serveFile) Stat() (os.FileInfo, error) {
+	return serveInfo{f.obj}, nil
+}
+
+func (f *serveFile) Write(p []byte) (int, error) {
+	return 0, errReadOnlyFile
+}
+
+func (f *serveFile) Readdir(count int) ([]os.FileInfo, error) {
+	if !f.obj.IsDir() {
+		return nil, &os.PathError{Op: "readdir", Path: f.obj.Path, Err: errors.New("not a directory")}
+	}
+	if f.dirRead {
+		if count > 0 {
+			return nil, io.EOF
+		}
+		return nil, nil
+	}
+	f.fs.mu.Lock()
+	chs, err := f.fs.children(f.obj)
+	f.fs.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	f.dirRead = true
+	var r []os.FileInfo
+	for _, ch := range chs {
+		r = append(r, serveInfo{ch})
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].Name() < r[j].Name() })
+	return r, nil
+}
+
+func (f *serveFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += f.obj.Size
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.obj.Path, Err: os.ErrInvalid}
+	}
+	f.off = offset
+	return offset, nil
+}
+
+func (f *serveFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.off)
+	f.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// ReadAt is for SFTP, which may issue several reads at once.
+func (f *serveFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.obj.IsDir() {
+		return 0, &os.PathError{Op: "read", Path: f.obj.Path, Err: errors.New("is a directory")}
+	}
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	n, err := f.r.ReadAt(p, off)
+	if err != nil && err != io.EOF {
+		err = fmt.Errorf("read %s: %v", f.obj.Path, err)
+	}
+	return n, err
+}
+
+// serveWriter uploads a file. With a known size, data streams to the
+// device while it is written; otherwise it is spooled to a
+// temporary file and sent on Close.
+type serveWriter struct {
+	fs   *serveFS
+	dir  *remoteObject
+	name string
+	size int64
+
+	// For streaming.
+	pipe    *io.PipeWriter
+	done    chan error
+	written int64
+
+	spool *os.File
+}
+
+// startStream starts sending; fs.mu must be held, and is released
+// by Close.
+func (w *serveWriter) startStream(size int64) {
+	w.size = size
+	w.fs.changed()
+	pr, pw := io.Pipe()
+	w.pipe = pw
+	w.done = make(chan error, 1)
+	go func() {
+		_, err := w.fs.r.send(w.dir, w.name, pr, size, time.Now())
+		pr.CloseWithError(err)
+		w.done <- err
+	}()
+}
+
+// WriteAt is for SFTP, which may send writes out of order. It works
+// only for spooled uploads.
+func (w *serveWriter) WriteAt(p []byte, off int64) (int, error) {
+	if w.spool == nil {
+		return 0, errors.New("cannot write at offset while streaming")
+	}
+	return w.spool.WriteAt(p, off)
+}
+
+func (w *serveWriter) Write(p []byte) (int, error) {
+	if w.spool != nil {
+		return w.spool.Write(p)
+	}
+	if w.written+int64(len(p)) > w.size {
+		return 0, fmt.Errorf("%s: more than %d bytes written", w.name, w.size)
+	}
+	n, err := w.pipe.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+func (w *serveWriter) Close() error {
+	if w.spool != nil {
+		return w.sendSpool()
+	}
+
+	defer w.fs.mu.Unlock()
+	if w.written < w.size {
+		w.pipe.CloseWithError(io.ErrUnexpectedEOF)
+	} else {
+		w.pipe.Close()
+	}
+	// A failed send removes its partial object, and keeps the old
+	// file.
+	return <-w.done
+}
+
+func (w *serveWriter) sendSpool() error {
+	defer os.Remove(w.spool.Name())
+	defer w.spool.Close()
+	size, err := w.spool.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := w.spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	w.fs.mu.Lock()
+	defer w.fs.mu.Unlock()
+	w.fs.changed()
+	_, err = w.fs.r.send(w.dir, w.name, w.spool, size, time.Now())
+	return err
+}
+
+func (w *serveWriter) Stat() (os.FileInfo, error) {
+	size := w.size
+	if w.spool != nil {
+		fi, err := w.spool.Stat()
+		if err != nil {
+			return nil, err
+		}
+		size = fi.Size()
+	}
+	return serveInfo{&remoteObject{
+		Path:      path.Join(w.dir.Path, w.name),
+		StorageID: w.dir.StorageID,
+		Info: mtp.ObjectInfo{
+			StorageID:        w.dir.StorageID,
+			ParentObject:     w.dir.Handle,
+			Filename:         w.name,
+			ModificationDate: time.Now(),
+		},
+		Size: size,
+	}}, nil
+}
+
+func (w *serveWriter) Read(p []byte) (int, error) {
+	return 0, errors.New("file not open for reading")
+}
+
+func (w *serveWriter) Seek(offset int64, whence int) (int64, error) {
+	return 0, errors.New("cannot seek while uploading")
+}
+
+func (w *serveWriter) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, errors.New("not a directory")
+}
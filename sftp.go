@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// SFTP access to the device, for remote users. Only the SFTP
+// subsystem is served; scp from OpenSSH 9 on uses it too.
+
+type sftpHandlers struct {
+	fs *serveFS
+}
+
+func newSFTPHandlers(fs *serveFS) sftp.Handlers {
+	h := &sftpHandlers{fs}
+	return sftp.Handlers{FileGet: h, FilePut: h, FileCmd: h, FileList: h}
+}
+
+func (h *sftpHandlers) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	f, err := h.fs.OpenFile(context.Background(), r.Filepath, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	sf := f.(*serveFile)
+	if sf.obj.IsDir() {
+		return nil, &os.PathError{Op: "open", Path: r.Filepath, Err: errors.New("is a directory")}
+	}
+	return sf, nil
+}
+
+// Filewrite replaces the file: MTP cannot change files in place.
+// The data is sent when the client closes the file.
+func (h *sftpHandlers) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	if r.Pflags().Append {
+		return nil, sftp.ErrSSHFxOpUnsupported
+	}
+	f, err := h.fs.OpenFile(context.Background(), r.Filepath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return f.(*serveWriter), nil
+}
+
+func (h *sftpHandlers) Filecmd(r *sftp.Request) error {
+	ctx := context.Background()
+	switch r.Method {
+	case "Setstat":
+		// Times and modes cannot be changed.
+		return nil
+	case "Rename":
+		return h.fs.Rename(ctx, r.Filepath, r.Target)
+	case "Mkdir":
+		return h.fs.Mkdir(ctx, r.Filepath, 0755)
+	case "Rmdir", "Remove":
+		fi, err := h.fs.Stat(ctx, r.Filepath)
+		if err != nil {
+			return err
+		}
+		if r.Method == "Remove" && fi.IsDir() {
+			return &os.PathError{Op: "remove", Path: r.Filepath, Err: errors.New("is a directory")}
+		}
+		if r.Method == "Rmdir" {
+			if !fi.IsDir() {
+				return &os.PathError{Op: "rmdir", Path: r.Filepath, Err: errors.New("not a directory")}
+			}
+			entries, err := h.list(r.Filepath)
+			if err != nil {
+				return err
+			}
+			if len(entries) > 0 {
+				return &os.PathError{Op: "rmdir", Path: r.Filepath, Err: errors.New("directory not empty")}
+			}
+		}
+		return h.fs.RemoveAll(ctx, r.Filepath)
+	}
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+func (h *sftpHandlers) list(name string) (listerAt, error) {
+	f, err := h.fs.OpenFile(context.Background(), name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fis, err := f.Readdir(-1)
+	return listerAt(fis), err
+}
+
+func (h *sftpHandlers) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	switch r.Method {
+	case "List":
+		return h.list(r.Filepath)
+	case "Stat", "Lstat":
+		fi, err := h.fs.Stat(context.Background(), r.Filepath)
+		if err != nil {
+			return nil, err
+		}
+		return listerAt{fi}, nil
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+type listerAt []os.FileInfo
+
+func (l listerAt) ListAt(dest []os.FileInfo, off int64) (int, error) {
+	if off >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(dest, l[off:])
+	if n < len(dest) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// readAuthorizedKeys reads a file in the format of
+// ~/.ssh/authorized_keys. Keys are returned in wire format. Keys with
+// options, such as command= or from=, are skipped: the server cannot
+// enforce them, and would give such keys full access.
+func readAuthorizedKeys(name string) (map[string]bool, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	keys := map[string]bool{}
+	for len(data) > 0 {
+		key, comment, options, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			// Only comments and blank lines are left.
+			break
+		}
+		data = rest
+		if len(options) > 0 {
+			log.Printf("%s: skipping key %q with options %s", name, comment, strings.Join(options, ","))
+			continue
+		}
+		keys[string(key.Marshal())] = true
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no keys", name)
+	}
+	return keys, nil
+}
+
+// loadHostKey reads the server's private key. If the file does not
+// exist, a new key is generated and saved.
+func loadHostKey(name string) (ssh.Signer, error) {
+	data, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(priv)
+		if err != nil {
+			return nil, err
+		}
+		data = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(name, data, 0600); err != nil {
+			return nil, err
+		}
+		log.Printf("generated host key %s", name)
+	} else if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return signer, nil
+}
+
+// sshServerConfig accepts the given user with any of the keys.
+func sshServerConfig(userName string, keys map[string]bool, hostKey ssh.Signer) *ssh.ServerConfig {
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if meta.User() == userName && keys[string(key.Marshal())] {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("key not accepted for user %q", meta.User())
+		},
+	}
+	config.AddHostKey(hostKey)
+	return config
+}
+
+// serveSSH accepts connections, and runs the SFTP subsystem on
+// their sessions.
+func serveSSH(l net.Listener, config *ssh.ServerConfig, handlers sftp.Handlers) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go handleSSH(conn, config, handlers)
+	}
+}
+
+func handleSSH(conn net.Conn, config *ssh.ServerConfig, handlers sftp.Handlers) {
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		log.Printf("ssh from %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	defer sconn.Close()
+	log.Printf("ssh connection from %s", sconn.RemoteAddr())
+	go ssh.DiscardRequests(reqs)
+
+	for newCh := range chans {
+		if newCh.ChannelType() != "session" {
+			newCh.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		ch, requests, err := newCh.Accept()
+		if err != nil {
+			log.Printf("accepting channel: %v", err)
+			continue
+		}
+		go handleSession(ch, requests, handlers)
+	}
+}
+
+// handleSession serves a session that asks for the SFTP subsystem.
+func handleSession(ch ssh.Channel, requests <-chan *ssh.Request, handlers sftp.Handlers) {
+	defer ch.Close()
+	for req := range requests {
+		// The payload is the subsystem name as SSH string.
+		ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+		req.Reply(ok, nil)
+		if !ok {
+			continue
+		}
+		go ssh.DiscardRequests(requests)
+		server := sftp.NewRequestServer(ch, handlers)
+		if err := server.Serve(); err != nil && err != io.EOF {
+			log.Printf("sftp: %v", err)
+		}
+		server.Close()
+		return
+	}
+}
+
+func cmdServeSFTP(c *deviceConfig, args []string) error {
+	fl := flag.NewFlagSet("serve-sftp", flag.ContinueOnError)
+	addr := fl.String("addr", "localhost:2022", "address to listen on")
+	userName := fl.String("user", "", "user name to accept; default is the current user")
+	authorized := fl.String("authorized-keys", "", "file with the accepted public keys; default is ~/.ssh/authorized_keys")
+	hostKeyFile := fl.String("host-key", "", "server private key, generated if missing; default is in the user config directory")
+	if _, err := parseFlags(fl, args, 0, 0); err != nil {
+		return err
+	}
+	if *userName == "" || *authorized == "" {
+		u, err := user.Current()
+		if err != nil {
+			return err
+		}
+		if *userName == "" {
+			*userName = u.Username
+		}
+		if *authorized == "" {
+			*authorized = filepath.Join(u.HomeDir, ".ssh", "authorized_keys")
+		}
+	}
+	if *hostKeyFile == "" {
+		dir, err := os.UserConfigDir()
+		if err != nil {
+			return err
+		}
+		*hostKeyFile = filepath.Join(dir, "go-mtpfs", "ssh_host_ed25519_key")
+	}
+
+	keys, err := readAuthorizedKeys(*authorized)
+	if err != nil {
+		return err
+	}
+	hostKey, err := loadHostKey(*hostKeyFile)
+	if err != nil {
+		return err
+	}
+	config := sshServerConfig(*userName, keys, hostKey)
+
+	return c.withRemote(func(r *remote) error {
+		fsys, err := newServeFS(r, c.readOnly)
+		if err != nil {
+			return err
+		}
+		l, err := net.Listen("tcp", *addr)
+		if err != nil {
+			return err
+		}
+		defer l.Close()
+		log.Printf("serving SFTP for %s on %s", *userName, l.Addr())
+		return serveSSH(l, config, newSFTPHandlers(fsys))
+	})
+}
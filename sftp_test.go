@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+func newClientKey(t *testing.T) ssh.Signer {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func TestLoadHostKey(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "keys", "host_key")
+	k1, err := loadHostKey(name)
+	if err != nil {
+		t.Fatalf("generating: %v", err)
+	}
+	if fi, err := os.Stat(name); err != nil || fi.Mode().Perm() != 0600 {
+		t.Fatalf("key file: %v, %v", fi, err)
+	}
+	k2, err := loadHostKey(name)
+	if err != nil {
+		t.Fatalf("loading: %v", err)
+	}
+	if !bytes.Equal(k1.PublicKey().Marshal(), k2.PublicKey().Marshal()) {
+		t.Error("loaded key differs from generated key")
+	}
+}
+
+func TestReadAuthorizedKeys(t *testing.T) {
+	key := newClientKey(t)
+	name := filepath.Join(t.TempDir(), "authorized_keys")
+	content := "# lab key\n\n" + string(ssh.MarshalAuthorizedKey(key.PublicKey()))
+	if err := ioutil.WriteFile(name, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := readAuthorizedKeys(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || !keys[string(key.PublicKey().Marshal())] {
+		t.Errorf("got %d keys", len(keys))
+	}
+
+	restricted := "command=\"/bin/backup\",from=\"10.0.0.1\" " + string(ssh.MarshalAuthorizedKey(newClientKey(t).PublicKey()))
+	if err := ioutil.WriteFile(name, []byte(content+restricted), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err = readAuthorizedKeys(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || !keys[string(key.PublicKey().Marshal())] {
+		t.Errorf("got %d keys, want only the key without options", len(keys))
+	}
+
+	if err := ioutil.WriteFile(name, []byte("# nothing\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readAuthorizedKeys(name); err == nil {
+		t.Error("file without keys accepted")
+	}
+}
+
+// TestServeSSH runs a client against the server, with files in
+// memory rather than on a device.
+func TestServeSSH(t *testing.T) {
+	hostKey, err := loadHostKey(filepath.Join(t.TempDir(), "host_key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientKey := newClientKey(t)
+	config := sshServerConfig("lab", map[string]bool{string(clientKey.PublicKey().Marshal()): true}, hostKey)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go serveSSH(l, config, sftp.InMemHandler())
+
+	dial := func(user string, key ssh.Signer) (*ssh.Client, error) {
+		return ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+			User:            user,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(key)},
+			HostKeyCallback: ssh.FixedHostKey(hostKey.PublicKey()),
+		})
+	}
+	if c, err := dial("other", clientKey); err == nil {
+		c.Close()
+		t.Error("wrong user accepted")
+	}
+	if c, err := dial("lab", newClientKey(t)); err == nil {
+		c.Close()
+		t.Error("unknown key accepted")
+	}
+
+	conn, err := dial("lab", clientKey)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		t.Fatalf("sftp: %v", err)
+	}
+	defer client.Close()
+
+	f, err := client.Create("/hello.txt")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := f.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	f.Close()
+
+	f, err = client.Open("/hello.txt")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil || string(data) != "hello" {
+		t.Errorf("read back %q, %v", data, err)
+	}
+}
+
+func TestListerAt(t *testing.T) {
+	l := listerAt{serveInfo{&remoteObject{Path: "a"}}, serveInfo{&remoteObject{Path: "b"}}}
+	dest := make([]os.FileInfo, 1)
+	if n, err := l.ListAt(dest, 1); n != 1 || err != nil || dest[0].Name() != "b" {
+		t.Errorf("ListAt(1): %d, %v", n, err)
+	}
+	dest = make([]os.FileInfo, 5)
+	if n, err := l.ListAt(dest, 0); n != 2 || err == nil {
+		t.Errorf("ListAt(0): %d, %v", n, err)
+	}
+	if n, err := l.ListAt(dest, 2); n != 0 || err == nil {
+		t.Errorf("ListAt(2): %d, %v", n, err)
+	}
+}
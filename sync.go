@@ -0,0 +1,645 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hanwen/go-mtpfs/fs"
+	"github.com/hanwen/go-mtpfs/mtp"
+)
+
+// One-way sync from a local directory to a device folder.
+//
+// Device objects cannot be given a modification time after they are
+// created, so a manifest per device remembers what was pushed: the
+// object handle, and the size, mtime and hash of the local file. An
+// object whose handle is in the manifest needs no GetObjectInfo, which
+// makes repeated syncs of large trees fast.
+
+// patternList is a repeatable flag of shell patterns. Patterns match
+// either the path relative to the synced directory or the base name.
+type patternList []string
+
+func (l *patternList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *patternList) Set(s string) error {
+	if _, err := path.Match(s, ""); err != nil {
+		return fmt.Errorf("bad pattern %q: %v", s, err)
+	}
+	*l = append(*l, s)
+	return nil
+}
+
+func (l patternList) match(rel string) bool {
+	for _, p := range l {
+		if ok, _ := path.Match(p, rel); ok {
+			return true
+		}
+		if ok, _ := path.Match(p, path.Base(rel)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+type syncOptions struct {
+	dryRun  bool
+	delete  bool
+	check   bool
+	quiet   bool
+	include patternList
+	exclude patternList
+}
+
+// selected returns whether a path takes part in the sync. Excluding
+// a directory excludes its contents; includes only apply to files.
+func (o *syncOptions) selected(rel string, dir bool) bool {
+	for p := rel; p != "." && p != ""; p = path.Dir(p) {
+		if o.exclude.match(p) {
+			return false
+		}
+	}
+	return dir || len(o.include) == 0 || o.include.match(rel)
+}
+
+// syncFile is a file or directory on either side of the sync.
+type syncFile struct {
+	Dir     bool
+	Size    int64
+	ModTime time.Time
+
+	// Handle is set for device objects.
+	Handle uint32
+}
+
+// syncEntry is the manifest record for a device object.
+type syncEntry struct {
+	Handle uint32
+	Dir    bool `json:",omitempty"`
+	Size   int64
+	// ModTime is the local mtime of the file when it was pushed.
+	ModTime time.Time
+	// Hash is the hex SHA-1 of the contents.
+	Hash string `json:",omitempty"`
+}
+
+// syncManifest holds the entries for a device, keyed by device path.
+type syncManifest struct {
+	Device  string
+	Entries map[string]*syncEntry
+
+	byHandle map[uint32]string
+}
+
+func loadManifest(name, device string) (*syncManifest, error) {
+	m := &syncManifest{}
+	data, err := ioutil.ReadFile(name)
+	if err == nil {
+		err = json.Unmarshal(data, m)
+		if err == nil && m.Device != device {
+			err = fmt.Errorf("manifest is for device %q", m.Device)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	m.Device = device
+	if m.Entries == nil {
+		m.Entries = map[string]*syncEntry{}
+	}
+	m.byHandle = map[uint32]string{}
+	for p, e := range m.Entries {
+		m.byHandle[e.Handle] = p
+	}
+	return m, nil
+}
+
+func (m *syncManifest) save(name string) error {
+	data, err := json.MarshalIndent(m, "", " ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	tmp := name + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+func (m *syncManifest) set(p string, e *syncEntry) {
+	if old, ok := m.Entries[p]; ok {
+		delete(m.byHandle, old.Handle)
+	}
+	m.Entries[p] = e
+	m.byHandle[e.Handle] = p
+}
+
+// remove drops p and everything below it.
+func (m *syncManifest) remove(p string) {
+	for q, e := range m.Entries {
+		if q == p || strings.HasPrefix(q, p+"/") {
+			delete(m.Entries, q)
+			delete(m.byHandle, e.Handle)
+		}
+	}
+}
+
+var unsafeChars = regexp.MustCompile("[^a-zA-Z0-9_.-]+")
+
+func defaultManifest(device string) (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "go-mtpfs", "sync-"+unsafeChars.ReplaceAllString(device, "_")+".json"), nil
+}
+
+// Operations of a sync plan.
+const (
+	syncMkdir  = "mkdir"
+	syncPush   = "push"
+	syncDelete = "delete"
+	// syncKeep marks unchanged files, to refresh their manifest entry.
+	syncKeep = "keep"
+)
+
+type syncAction struct {
+	Op   string
+	Path string
+}
+
+// unchanged returns whether remote file r holds the contents of
+// local file l. Known is the manifest entry for the path, if any.
+func unchanged(l, r *syncFile, known *syncEntry, hash func() (string, error)) (bool, error) {
+	if r.Dir || r.Size != l.Size {
+		return false, nil
+	}
+	if known != nil && known.Handle == r.Handle && !known.Dir && known.Size == l.Size {
+		if known.ModTime.Equal(l.ModTime) {
+			return true, nil
+		}
+		if known.Hash == "" {
+			return false, nil
+		}
+		h, err := hash()
+		return h == known.Hash, err
+	}
+
+	// Not pushed by us. The device date has second resolution.
+	d := r.ModTime.Sub(l.ModTime)
+	return d > -2*time.Second && d < 2*time.Second, nil
+}
+
+// planSync computes the actions to make the remote tree match the
+// local one. Both maps are keyed by slash separated relative paths,
+// and known holds the manifest entries by the same paths.
+func planSync(local, remote map[string]*syncFile, known map[string]*syncEntry, hash func(rel string) (string, error), opts *syncOptions) ([]syncAction, error) {
+	var plan []syncAction
+	deleted := map[string]bool{}
+	del := func(rel string) {
+		for p := path.Dir(rel); p != "."; p = path.Dir(p) {
+			if deleted[p] {
+				return
+			}
+		}
+		deleted[rel] = true
+		plan = append(plan, syncAction{syncDelete, rel})
+	}
+
+	for _, rel := range sortedKeys(local) {
+		l := local[rel]
+		if !opts.selected(rel, l.Dir) {
+			continue
+		}
+		r := remote[rel]
+		if r != nil && r.Dir != l.Dir {
+			del(rel)
+			r = nil
+		}
+		if l.Dir {
+			// With includes, folders are only created for the files in them.
+			if r == nil && len(opts.include) == 0 {
+				plan = append(plan, syncAction{syncMkdir, rel})
+			}
+			continue
+		}
+
+		op := syncPush
+		if r != nil {
+			same, err := unchanged(l, r, known[rel], func() (string, error) { return hash(rel) })
+			if err != nil {
+				return nil, err
+			}
+			if same {
+				op = syncKeep
+			}
+		}
+		plan = append(plan, syncAction{op, rel})
+	}
+
+	if opts.delete {
+		for _, rel := range sortedKeys(remote) {
+			if _, ok := local[rel]; ok || !opts.selected(rel, remote[rel].Dir) {
+				continue
+			}
+			del(rel)
+		}
+	}
+	return plan, nil
+}
+
+func sortedKeys(m map[string]*syncFile) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func hashFile(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha1.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+type syncer struct {
+	r        *remote
+	root     *remoteObject
+	local    string
+	opts     *syncOptions
+	manifest *syncManifest
+
+	remote map[string]*syncFile
+	// walked holds the remote folders that were listed.
+	walked map[string]bool
+}
+
+// devicePath returns the manifest key for a relative path.
+func (s *syncer) devicePath(rel string) string {
+	return path.Join(s.root.Path, rel)
+}
+
+func (s *syncer) walkLocal() (map[string]*syncFile, error) {
+	files := map[string]*syncFile{}
+	err := filepath.Walk(s.local, func(name string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(s.local, name)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if !s.opts.selected(rel, fi.IsDir()) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if fi.IsDir() || fi.Mode().IsRegular() {
+			files[rel] = &syncFile{
+				Dir:     fi.IsDir(),
+				Size:    fi.Size(),
+				ModTime: fi.ModTime(),
+			}
+		}
+		return nil
+	})
+	return files, err
+}
+
+// walkRemote lists the folder with the given handle. Objects
+// recorded in the manifest under this folder are not queried.
+func (s *syncer) walkRemote(handle uint32, rel string) error {
+	s.walked[rel] = true
+	dir := s.devicePath(rel)
+
+	var handles []uint32
+	names := map[uint32]string{}
+	files := map[uint32]*syncFile{}
+	add := func(h uint32, name string, f *syncFile) {
+		if name != "" {
+			handles = append(handles, h)
+			names[h], files[h] = name, f
+		}
+	}
+	var err error
+	if s.r.propList {
+		err = s.r.dev.WalkFolder(s.root.StorageID, handle, true, func(h uint32, info *mtp.ObjectInfo, size int64) error {
+			if name, f, ok := s.recorded(h, dir); ok {
+				add(h, name, f)
+			} else {
+				add(h, info.Filename, &syncFile{Dir: info.ObjectFormat == mtp.OFC_Association, Size: size, ModTime: info.ModificationDate, Handle: h})
+			}
+			return nil
+		})
+	} else {
+		all := mtp.Uint32Array{}
+		err = s.r.dev.GetObjectHandles(s.root.StorageID, 0x0, handle, &all)
+		for _, h := range all.Values {
+			if name, f, ok := s.recorded(h, dir); ok {
+				add(h, name, f)
+				continue
+			}
+			o, err := s.r.object(dir, h)
+			if err != nil {
+				return err
+			}
+			add(h, o.Info.Filename, &syncFile{Dir: o.IsDir(), Size: o.Size, ModTime: o.Info.ModificationDate, Handle: h})
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("listing %s: %v", dir, err)
+	}
+
+	// Duplicate names get numbers, as in the mount, so -delete
+	// removes the extra copies.
+	unique := fs.UniqueNames(names)
+	for _, h := range handles {
+		f := files[h]
+		childRel := path.Join(rel, unique[h])
+		s.remote[childRel] = f
+		if !f.Dir {
+			continue
+		}
+		s.manifest.set(s.devicePath(childRel), &syncEntry{Handle: h, Dir: true})
+		if s.opts.selected(childRel, true) {
+			if err := s.walkRemote(h, childRel); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// recorded returns the manifest entry for an object in dir, unless
+// the remote is checked.
+func (s *syncer) recorded(h uint32, dir string) (string, *syncFile, bool) {
+	p, ok := s.manifest.byHandle[h]
+	if !ok || s.opts.check || path.Dir(p) != dir {
+		return "", nil, false
+	}
+	e := s.manifest.Entries[p]
+	return path.Base(p), &syncFile{Dir: e.Dir, Size: e.Size, ModTime: e.ModTime, Handle: h}, true
+}
+
+// pruneManifest drops entries for objects that are gone from the
+// listed folders.
+func (s *syncer) pruneManifest() {
+	prefix := s.root.Path + "/"
+	for p, e := range s.manifest.Entries {
+		if !strings.HasPrefix(p, prefix) {
+			continue
+		}
+		rel := strings.TrimPrefix(p, prefix)
+		dir := path.Dir(rel)
+		if dir == "." {
+			dir = ""
+		}
+		if f, ok := s.remote[rel]; s.walked[dir] && (!ok || f.Handle != e.Handle) {
+			delete(s.manifest.Entries, p)
+			delete(s.manifest.byHandle, e.Handle)
+		}
+	}
+}
+
+// folder returns the device folder for rel, creating it if needed.
+func (s *syncer) folder(rel string) (*remoteObject, error) {
+	if rel == "." || rel == "" {
+		return s.root, nil
+	}
+	if f, ok := s.remote[rel]; ok && f.Dir {
+		return &remoteObject{
+			Path:      s.devicePath(rel),
+			Handle:    f.Handle,
+			StorageID: s.root.StorageID,
+			Info:      mtp.ObjectInfo{ObjectFormat: mtp.OFC_Association},
+		}, nil
+	}
+	parent, err := s.folder(path.Dir(rel))
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("%s %s\n", syncMkdir, rel)
+	o, err := s.r.mkdir(parent, path.Base(rel))
+	if err != nil {
+		return nil, err
+	}
+	s.remote[rel] = &syncFile{Dir: true, Handle: o.Handle}
+	s.manifest.set(o.Path, &syncEntry{Handle: o.Handle, Dir: true})
+	return o, nil
+}
+
+func (s *syncer) push(rel string) error {
+	dir, err := s.folder(path.Dir(rel))
+	if err != nil {
+		return err
+	}
+	// The old object is known, so the folder need not be listed
+	// again.
+	var old *remoteObject
+	if f, ok := s.remote[rel]; ok {
+		old = &remoteObject{Path: s.devicePath(rel), Handle: f.Handle}
+	}
+
+	name := filepath.Join(s.local, filepath.FromSlash(rel))
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s %s\n", syncPush, rel)
+	h := sha1.New()
+	p := newProgress(rel, fi.Size(), s.opts.quiet)
+	o, err := s.r.replace(dir, path.Base(rel), mtp.OFC_Undefined, old, io.TeeReader(&progressReader{f, p}, h), fi.Size(), fi.ModTime())
+	if err != nil {
+		return err
+	}
+	p.finish()
+	s.remote[rel] = &syncFile{Size: fi.Size(), ModTime: fi.ModTime(), Handle: o.Handle}
+	s.manifest.set(o.Path, &syncEntry{
+		Handle:  o.Handle,
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+		Hash:    hex.EncodeToString(h.Sum(nil)),
+	})
+	return nil
+}
+
+func (s *syncer) keep(rel string, l *syncFile) {
+	r := s.remote[rel]
+	e := &syncEntry{Handle: r.Handle, Size: l.Size, ModTime: l.ModTime}
+	if old, ok := s.manifest.Entries[s.devicePath(rel)]; ok && old.Handle == r.Handle {
+		e.Hash = old.Hash
+	}
+	s.manifest.set(s.devicePath(rel), e)
+}
+
+func (s *syncer) remove(rel string) error {
+	fmt.Printf("%s %s\n", syncDelete, rel)
+	if err := s.r.deleteObject(s.remote[rel].Handle, s.devicePath(rel)); err != nil {
+		return err
+	}
+	for p := range s.remote {
+		if p == rel || strings.HasPrefix(p, rel+"/") {
+			delete(s.remote, p)
+		}
+	}
+	s.manifest.remove(s.devicePath(rel))
+	return nil
+}
+
+func (s *syncer) run(plan []syncAction, local map[string]*syncFile) error {
+	for _, a := range plan {
+		if s.opts.dryRun {
+			if a.Op != syncKeep {
+				fmt.Printf("%s %s\n", a.Op, a.Path)
+			}
+			continue
+		}
+
+		var err error
+		switch a.Op {
+		case syncMkdir:
+			_, err = s.folder(a.Path)
+		case syncPush:
+			err = s.push(a.Path)
+		case syncKeep:
+			s.keep(a.Path, local[a.Path])
+		case syncDelete:
+			err = s.remove(a.Path)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func cmdSync(c *deviceConfig, args []string) error {
+	fl := flag.NewFlagSet("sync", flag.ContinueOnError)
+	opts := &syncOptions{}
+	fl.BoolVar(&opts.dryRun, "n", false, "only print what would be done")
+	fl.BoolVar(&opts.delete, "delete", false, "delete device files that are not in the local directory")
+	fl.BoolVar(&opts.check, "check", false, "query all device objects, rather than trusting the manifest")
+	fl.BoolVar(&opts.quiet, "q", false, "do not report progress")
+	fl.Var(&opts.include, "include", "only sync files matching this pattern (repeatable)")
+	fl.Var(&opts.exclude, "exclude", "skip files and directories matching this pattern (repeatable)")
+	manifestName := fl.String("manifest", "", "manifest file; default is per device in the user cache directory")
+	args, err := parseFlags(fl, args, 2, 2)
+	if err != nil {
+		return err
+	}
+	if fi, err := os.Stat(args[0]); err != nil {
+		return err
+	} else if !fi.IsDir() {
+		return fmt.Errorf("%s: not a directory", args[0])
+	}
+
+	return c.withRemote(func(r *remote) error {
+		id, err := r.dev.ID()
+		if err != nil {
+			return err
+		}
+		if *manifestName == "" {
+			if *manifestName, err = defaultManifest(id); err != nil {
+				return err
+			}
+		}
+		m, err := loadManifest(*manifestName, id)
+		if err != nil {
+			return err
+		}
+
+		var root *remoteObject
+		if opts.dryRun {
+			root, err = r.lookup(args[1])
+		} else {
+			root, err = r.mkdirAll(args[1])
+		}
+		missing := false
+		if _, ok := err.(notFoundError); ok && opts.dryRun {
+			// Everything would be pushed.
+			root, err, missing = &remoteObject{Path: path.Clean(args[1])}, nil, true
+		}
+		if err != nil {
+			return err
+		}
+		if !missing && (root.StorageID == 0 || !root.IsDir()) {
+			return fmt.Errorf("%s: need a folder on a storage", args[1])
+		}
+
+		s := &syncer{
+			r:        r,
+			root:     root,
+			local:    args[0],
+			opts:     opts,
+			manifest: m,
+			remote:   map[string]*syncFile{},
+			walked:   map[string]bool{},
+		}
+		local, err := s.walkLocal()
+		if err != nil {
+			return err
+		}
+		if !missing {
+			if err := s.walkRemote(root.Handle, ""); err != nil {
+				return err
+			}
+			s.pruneManifest()
+		}
+
+		known := map[string]*syncEntry{}
+		for rel := range s.remote {
+			known[rel] = m.Entries[s.devicePath(rel)]
+		}
+		plan, err := planSync(local, s.remote, known, func(rel string) (string, error) {
+			return hashFile(filepath.Join(s.local, filepath.FromSlash(rel)))
+		}, opts)
+		if err != nil {
+			return err
+		}
+
+		err = s.run(plan, local)
+		if !opts.dryRun {
+			// Record partial progress too.
+			if serr := m.save(*manifestName); err == nil {
+				err = serr
+			}
+		}
+		return err
+	})
+}
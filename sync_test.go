@@ -0,0 +1,90 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSyncSelected(t *testing.T) {
+	opts := &syncOptions{
+		include: patternList{"*.mp3"},
+		exclude: patternList{"tmp", "*.part"},
+	}
+	for rel, want := range map[string]bool{
+		"a.mp3":         true,
+		"album/b.mp3":   true,
+		"album/c.ogg":   false,
+		"tmp/d.mp3":     false,
+		"album/e.part":  false,
+		"album/tmp/mp3": false,
+	} {
+		if got := opts.selected(rel, false); got != want {
+			t.Errorf("selected(%q): got %v, want %v", rel, got, want)
+		}
+	}
+	if !opts.selected("album", true) {
+		t.Errorf("include pattern should not apply to directories")
+	}
+}
+
+func TestPlanSync(t *testing.T) {
+	t0 := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	t1 := t0.Add(time.Hour)
+	local := map[string]*syncFile{
+		"new.mp3":     {Size: 1, ModTime: t0},
+		"same.mp3":    {Size: 2, ModTime: t0},
+		"touched.mp3": {Size: 3, ModTime: t1},
+		"changed.mp3": {Size: 4, ModTime: t1},
+		"foreign.mp3": {Size: 5, ModTime: t0},
+		"dir":         {Dir: true},
+		"dir/x.mp3":   {Size: 6, ModTime: t0},
+		"wasdir":      {Size: 7, ModTime: t0},
+		"skip.part":   {Size: 8, ModTime: t0},
+	}
+	remote := map[string]*syncFile{
+		"same.mp3":     {Size: 2, Handle: 1},
+		"touched.mp3":  {Size: 3, Handle: 2},
+		"changed.mp3":  {Size: 4, Handle: 3},
+		"foreign.mp3":  {Size: 5, Handle: 4, ModTime: t0.Add(time.Second)},
+		"wasdir":       {Dir: true, Handle: 5},
+		"wasdir/y.mp3": {Size: 9, Handle: 6},
+		"extra.mp3":    {Size: 10, Handle: 7},
+		"keep.part":    {Size: 11, Handle: 8},
+	}
+	known := map[string]*syncEntry{
+		"same.mp3":    {Handle: 1, Size: 2, ModTime: t0},
+		"touched.mp3": {Handle: 2, Size: 3, ModTime: t0, Hash: "aaa"},
+		"changed.mp3": {Handle: 3, Size: 4, ModTime: t0, Hash: "bbb"},
+	}
+	hash := func(rel string) (string, error) {
+		return map[string]string{
+			"touched.mp3": "aaa",
+			"changed.mp3": "ccc",
+		}[rel], nil
+	}
+	opts := &syncOptions{
+		delete:  true,
+		exclude: patternList{"*.part"},
+	}
+
+	got, err := planSync(local, remote, known, hash, opts)
+	if err != nil {
+		t.Fatalf("planSync: %v", err)
+	}
+	want := []syncAction{
+		{syncPush, "changed.mp3"},
+		{syncMkdir, "dir"},
+		{syncPush, "dir/x.mp3"},
+		{syncKeep, "foreign.mp3"},
+		{syncPush, "new.mp3"},
+		{syncKeep, "same.mp3"},
+		{syncKeep, "touched.mp3"},
+		{syncDelete, "wasdir"},
+		{syncPush, "wasdir"},
+		{syncDelete, "extra.mp3"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
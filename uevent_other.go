@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "fmt"
+
+func watchUevents() (<-chan struct{}, error) {
+	return nil, fmt.Errorf("uevents are only available on Linux")
+}
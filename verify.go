@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hanwen/go-mtpfs/fs"
+	"github.com/hanwen/go-mtpfs/mtp"
+)
+
+// The verify command checks device contents against the hashes
+// recorded by mounts with -verify.
+
+// defaultHashDir is where the hashes are kept, next to the sync
+// manifests.
+func defaultHashDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "go-mtpfs"), nil
+}
+
+// Results of checking a file.
+const (
+	verifyOK      = "ok"
+	verifyChanged = "changed"
+	verifyMissing = "missing"
+	// verifyNew marks files without recorded hash.
+	verifyNew = "new"
+)
+
+// checkHash compares a device file with its entry.
+func checkHash(r *remote, o *remoteObject, e *fs.HashEntry, quiet bool) (string, string, error) {
+	if e != nil && e.Size != o.Size && !quiet {
+		fmt.Fprintf(os.Stderr, "%s: size %d, recorded %d\n", o.Path, o.Size, e.Size)
+	}
+	h := sha1.New()
+	p := newProgress(o.Path, o.Size, quiet)
+	if err := r.dev.GetObject(o.Handle, &progressWriter{h, p}); err != nil {
+		return "", "", fmt.Errorf("GetObject %s: %v", o.Path, err)
+	}
+	p.finish()
+	sum := hex.EncodeToString(h.Sum(nil))
+	if e == nil {
+		return verifyNew, sum, nil
+	}
+	if p.done != e.Size || sum != e.Hash {
+		return verifyChanged, sum, nil
+	}
+	return verifyOK, sum, nil
+}
+
+// walkFiles calls fn for the files at or below o.
+func walkFiles(r *remote, o *remoteObject, fn func(o *remoteObject) error) error {
+	if !o.IsDir() {
+		return fn(o)
+	}
+	chs, err := r.children(o)
+	if err != nil {
+		return err
+	}
+	for _, ch := range chs {
+		if err := walkFiles(r, ch, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hashPaths gives the keys of objects in the HashDB: their paths in
+// the mount, which shows the names on VFAT storages decoded.
+type hashPaths struct {
+	vfat map[uint32]string
+}
+
+// newHashPaths finds the VFAT storages, as the mount does.
+func newHashPaths(r *remote, removableVFat bool) (*hashPaths, error) {
+	hp := &hashPaths{vfat: map[uint32]string{}}
+	if !removableVFat {
+		return hp, nil
+	}
+	for _, s := range r.storages {
+		var info mtp.StorageInfo
+		if err := r.dev.GetStorageInfo(s.StorageID, &info); err != nil {
+			return nil, err
+		}
+		if info.IsRemovable() {
+			hp.vfat[s.StorageID] = s.Path
+		}
+	}
+	return hp, nil
+}
+
+func (hp *hashPaths) path(o *remoteObject) string {
+	root, ok := hp.vfat[o.StorageID]
+	if !ok || o.Path == root {
+		return o.Path
+	}
+	names := strings.Split(strings.TrimPrefix(o.Path, root+"/"), "/")
+	for i, n := range names {
+		names[i] = fs.VfatName(n)
+	}
+	return root + "/" + strings.Join(names, "/")
+}
+
+func cmdVerify(c *deviceConfig, args []string) error {
+	fl := flag.NewFlagSet("verify", flag.ContinueOnError)
+	update := fl.Bool("update", false, "record the hashes of new and changed files, and forget missing ones")
+	all := fl.Bool("all", false, "also hash files without recorded hash")
+	quiet := fl.Bool("q", false, "do not report progress")
+	args, err := parseFlags(fl, args, 0, 1)
+	if err != nil {
+		return err
+	}
+	p := ""
+	if len(args) > 0 {
+		p = args[0]
+	}
+	dir, err := defaultHashDir()
+	if err != nil {
+		return err
+	}
+
+	return c.withRemote(func(r *remote) error {
+		id, err := r.dev.ID()
+		if err != nil {
+			return err
+		}
+		db, err := fs.LoadHashDB(fs.HashDBName(dir, id), id)
+		if err != nil {
+			return err
+		}
+		top, err := r.lookup(p)
+		if err != nil {
+			return err
+		}
+		paths, err := newHashPaths(r, c.fsOptions.RemovableVFat)
+		if err != nil {
+			return err
+		}
+		topPath := paths.path(top)
+
+		counts := map[string]int{}
+		seen := map[string]bool{}
+		err = walkFiles(r, top, func(o *remoteObject) error {
+			key := paths.path(o)
+			seen[key] = true
+			e := db.Entries[key]
+			if e == nil && !*all && !*update {
+				counts[verifyNew]++
+				return nil
+			}
+			result, sum, err := checkHash(r, o, e, *quiet)
+			if err != nil {
+				return err
+			}
+			counts[result]++
+			if result != verifyOK {
+				fmt.Printf("%s %s\n", result, o.Path)
+			}
+			if result == verifyOK || *update {
+				db.Set(key, &fs.HashEntry{Size: o.Size, Hash: sum, Verified: time.Now()})
+			}
+			return nil
+		})
+
+		var missing []string
+		for q := range db.Entries {
+			if !seen[q] && (top.StorageID == 0 || q == topPath || strings.HasPrefix(q, topPath+"/")) {
+				missing = append(missing, q)
+			}
+		}
+		if err == nil {
+			sort.Strings(missing)
+			for _, q := range missing {
+				fmt.Printf("%s %s\n", verifyMissing, q)
+				if *update {
+					db.Remove(q)
+				}
+			}
+			counts[verifyMissing] = len(missing)
+		}
+
+		// Record partial progress too.
+		if serr := db.Save(); err == nil {
+			err = serr
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "%d ok, %d changed, %d missing, %d without recorded hash\n",
+			counts[verifyOK], counts[verifyChanged], counts[verifyMissing], counts[verifyNew])
+		if !*update && counts[verifyChanged]+counts[verifyMissing] > 0 {
+			return fmt.Errorf("%d files failed verification", counts[verifyChanged]+counts[verifyMissing])
+		}
+		return nil
+	})
+}
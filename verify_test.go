@@ -0,0 +1,19 @@
+package main
+
+import "testing"
+
+func TestHashPath(t *testing.T) {
+	hp := &hashPaths{vfat: map[uint32]string{0x20001: "SD card"}}
+	for _, c := range []struct {
+		o    remoteObject
+		want string
+	}{
+		{remoteObject{StorageID: 0x10001, Path: "Internal/a：b"}, "Internal/a：b"},
+		{remoteObject{StorageID: 0x20001, Path: "SD card"}, "SD card"},
+		{remoteObject{StorageID: 0x20001, Path: "SD card/x．/a：b (2).txt"}, "SD card/x./a:b (2).txt"},
+	} {
+		if got := hp.path(&c.o); got != c.want {
+			t.Errorf("path(%q) = %q, want %q", c.o.Path, got, c.want)
+		}
+	}
+}
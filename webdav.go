@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net/http"
+
+	"golang.org/x/net/webdav"
+)
+
+// WebDAV access to the device, for systems without FUSE.
+
+// davHandler passes the size of PUT requests to the FileSystem.
+type davHandler struct {
+	webdav.Handler
+}
+
+func (h *davHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut && r.ContentLength >= 0 {
+		r = r.WithContext(context.WithValue(r.Context(), uploadSizeKey{}, r.ContentLength))
+	}
+	h.Handler.ServeHTTP(w, r)
+}
+
+func cmdServeWebdav(c *deviceConfig, args []string) error {
+	fl := flag.NewFlagSet("serve-webdav", flag.ContinueOnError)
+	addr := fl.String("addr", "localhost:8080", "address to listen on")
+	if _, err := parseFlags(fl, args, 0, 0); err != nil {
+		return err
+	}
+	return c.withRemote(func(r *remote) error {
+		fsys, err := newServeFS(r, c.readOnly)
+		if err != nil {
+			return err
+		}
+		h := &davHandler{webdav.Handler{
+			FileSystem: fsys,
+			LockSystem: webdav.NewMemLS(),
+			Logger: func(req *http.Request, err error) {
+				if err != nil {
+					log.Printf("%s %s: %v", req.Method, req.URL.Path, err)
+				}
+			},
+		}}
+		log.Printf("serving WebDAV on http://%s/", *addr)
+		return http.ListenAndServe(*addr, h)
+	})
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/hanwen/go-mtpfs/mtp"
+	"golang.org/x/net/webdav"
+)
+
+// sizeFS records the upload size passed to OpenFile.
+type sizeFS struct {
+	webdav.FileSystem
+	size int64
+}
+
+func (s *sizeFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if v, ok := ctx.Value(uploadSizeKey{}).(int64); ok {
+		s.size = v
+	}
+	return s.FileSystem.OpenFile(ctx, name, flag, perm)
+}
+
+func TestDavHandlerPutSize(t *testing.T) {
+	fsys := &sizeFS{FileSystem: webdav.NewMemFS(), size: -1}
+	srv := httptest.NewServer(&davHandler{webdav.Handler{
+		FileSystem: fsys,
+		LockSystem: webdav.NewMemLS(),
+	}})
+	defer srv.Close()
+
+	req, err := http.NewRequest(http.MethodPut, srv.URL+"/hello.txt", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("PUT: got status %d", resp.StatusCode)
+	}
+	if fsys.size != 5 {
+		t.Errorf("got size %d, want 5", fsys.size)
+	}
+}
+
+func TestDavInfo(t *testing.T) {
+	fi := serveInfo{&remoteObject{
+		Path:      "Internal storage/Music/a.mp3",
+		StorageID: 0x10001,
+		Size:      3,
+	}}
+	if fi.Name() != "a.mp3" || fi.IsDir() || fi.Mode() != 0644 {
+		t.Errorf("got %q dir=%v mode %v", fi.Name(), fi.IsDir(), fi.Mode())
+	}
+	if ct, err := fi.ContentType(context.Background()); err != nil || ct != "audio/mpeg" {
+		t.Errorf("ContentType: got %q, %v", ct, err)
+	}
+
+	root := serveInfo{&remoteObject{Info: mtp.ObjectInfo{ObjectFormat: mtp.OFC_Association}}}
+	if root.Name() != "/" || !root.IsDir() {
+		t.Errorf("root: got %q dir=%v", root.Name(), root.IsDir())
+	}
+}